@@ -0,0 +1,284 @@
+package tplinky
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrNoAntiTheft is returned if the target device failed to perform
+// anti_theft commands.
+var ErrNoAntiTheft = errors.New("no anti_theft responded")
+
+// ParseAwayRule parses an away mode spec of the form
+//
+//	<start>-<end> [<days>] [disabled]
+//
+// where start and end are times as accepted by ParseScheduleRule and
+// the days are the same as for ParseScheduleRule. For example,
+// "sunset-21:30 weekdays". The rule is validated.
+func ParseAwayRule(spec string) (*AwayRule, error) {
+	fields := strings.Fields(strings.ToLower(spec))
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("bad away rule %q: want <start>-<end>", spec)
+	}
+	// Sunrise and sunset offsets can contain a dash too, so try
+	// each dash as the separator.
+	var times []string
+	for i, ch := range fields[0] {
+		if ch != '-' {
+			continue
+		}
+		start, end := fields[0][:i], fields[0][i+1:]
+		if _, _, _, err := parseRuleTime(start); err != nil {
+			continue
+		}
+		if _, _, _, err := parseRuleTime(end); err == nil {
+			times = []string{start, end}
+			break
+		}
+	}
+	if times == nil {
+		return nil, fmt.Errorf("bad away rule %q: want <start>-<end>", spec)
+	}
+	r := &AwayRule{
+		Enable: 1,
+		Repeat: 1,
+		WDay:   []int{1, 1, 1, 1, 1, 1, 1},
+	}
+	var err error
+	if r.STimeOpt, r.SMin, r.SOffset, err = parseRuleTime(times[0]); err != nil {
+		return nil, fmt.Errorf("bad away rule %q: %v", spec, err)
+	}
+	if r.ETimeOpt, r.EMin, r.EOffset, err = parseRuleTime(times[1]); err != nil {
+		return nil, fmt.Errorf("bad away rule %q: %v", spec, err)
+	}
+	for _, f := range fields[1:] {
+		if f == "disabled" {
+			r.Enable = 0
+			continue
+		}
+		if err := parseRuleDays(f, &r.WDay, &r.Repeat, &r.Year, &r.Month, &r.Day); err != nil {
+			return nil, fmt.Errorf("bad away rule %q: %v", spec, err)
+		}
+	}
+	if err := r.Validate(); err != nil {
+		return nil, fmt.Errorf("bad away rule %q: %v", spec, err)
+	}
+	return r, nil
+}
+
+// Validate confirms that the rule describes a window of time the
+// device can act on. Windows between fixed times of day must not
+// cross midnight, since the device does not carry them over into the
+// next day; such windows should be split into two rules.
+func (r *AwayRule) Validate() error {
+	for _, t := range []struct {
+		what        string
+		opt, min, o int
+	}{{"start", r.STimeOpt, r.SMin, r.SOffset}, {"end", r.ETimeOpt, r.EMin, r.EOffset}} {
+		switch t.opt {
+		case TimeFixed:
+			if t.min < 0 || t.min >= 24*60 {
+				return fmt.Errorf("%s time %d minutes is not within a day", t.what, t.min)
+			}
+		case TimeSunrise, TimeSunset:
+			if t.o < -12*60 || t.o > 12*60 {
+				return fmt.Errorf("%s offset %d minutes is too large", t.what, t.o)
+			}
+		default:
+			return fmt.Errorf("%s time option %d is not supported", t.what, t.opt)
+		}
+	}
+	if r.STimeOpt == TimeFixed && r.ETimeOpt == TimeFixed {
+		if r.EMin == r.SMin {
+			return errors.New("window is empty")
+		}
+		if r.EMin < r.SMin {
+			return errors.New("window crosses midnight")
+		}
+	}
+	if r.STimeOpt == r.ETimeOpt && r.STimeOpt != TimeFixed && r.EOffset <= r.SOffset {
+		return errors.New("window ends before it starts")
+	}
+	if len(r.WDay) != 7 {
+		return fmt.Errorf("want 7 weekday flags, got %d", len(r.WDay))
+	}
+	if r.Repeat != 0 {
+		days := 0
+		for _, d := range r.WDay {
+			days += d
+		}
+		if days == 0 {
+			return errors.New("repeating rule has no days")
+		}
+	} else if r.Year == 0 || r.Month < 1 || r.Month > 12 || r.Day < 1 || r.Day > 31 {
+		return fmt.Errorf("invalid date %04d-%02d-%02d", r.Year, r.Month, r.Day)
+	}
+	return nil
+}
+
+// String formats the rule in the form accepted by ParseAwayRule.
+func (r *AwayRule) String() string {
+	s := formatRuleTime(r.STimeOpt, r.SMin, r.SOffset) + "-" + formatRuleTime(r.ETimeOpt, r.EMin, r.EOffset)
+	s += " " + formatRuleDays(r.WDay, r.Repeat, r.Year, r.Month, r.Day)
+	if r.Enable == 0 {
+		s += " disabled"
+	}
+	return s
+}
+
+// sendAntiTheft sends an anti_theft command to the device.
+func (c *Conn) sendAntiTheft(cmd *AntiTheft) (*AntiTheftResponse, error) {
+	resp, err := c.Send(Control{
+		AntiTheft: cmd,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.AntiTheft == nil {
+		return nil, ErrNoAntiTheft
+	}
+	return resp.AntiTheft, nil
+}
+
+// AwayRules lists the device's away mode rules, and whether away
+// mode as a whole is enabled.
+func (c *Conn) AwayRules() ([]*AwayRule, bool, error) {
+	resp, err := c.sendAntiTheft(&AntiTheft{
+		GetRules: &RuleList{},
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	r := resp.GetRules
+	if r == nil {
+		return nil, false, ErrNoAntiTheft
+	}
+	if err := ruleError("anti_theft", r.ErrCode, r.ErrMsg); err != nil {
+		return nil, false, err
+	}
+	var rules []*AwayRule
+	if len(r.RuleList) != 0 {
+		if err := json.Unmarshal(r.RuleList, &rules); err != nil {
+			return nil, false, err
+		}
+	}
+	return rules, r.Enable != 0, nil
+}
+
+// AddAwayRule validates and adds an away mode rule to the device,
+// returning the identifier the device assigned to it.
+func (c *Conn) AddAwayRule(rule *AwayRule) (string, error) {
+	if err := rule.Validate(); err != nil {
+		return "", err
+	}
+	r := *rule
+	r.ID = ""
+	resp, err := c.sendAntiTheft(&AntiTheft{
+		AddRule: &r,
+	})
+	if err != nil {
+		return "", err
+	}
+	if resp.AddRule == nil {
+		return "", ErrNoAntiTheft
+	}
+	if err := ruleError("anti_theft", resp.AddRule.ErrCode, resp.AddRule.ErrMsg); err != nil {
+		return "", err
+	}
+	return resp.AddRule.ID, nil
+}
+
+// EditAwayRule validates and replaces the device's away mode rule
+// that has the same ID as rule.
+func (c *Conn) EditAwayRule(rule *AwayRule) error {
+	if rule.ID == "" {
+		return errors.New("away rule has no id")
+	}
+	if err := rule.Validate(); err != nil {
+		return err
+	}
+	resp, err := c.sendAntiTheft(&AntiTheft{
+		EditRule: rule,
+	})
+	if err != nil {
+		return err
+	}
+	if resp.EditRule == nil {
+		return ErrNoAntiTheft
+	}
+	return ruleError("anti_theft", resp.EditRule.ErrCode, resp.EditRule.ErrMsg)
+}
+
+// DeleteAwayRule deletes an away mode rule from the device.
+func (c *Conn) DeleteAwayRule(id string) error {
+	resp, err := c.sendAntiTheft(&AntiTheft{
+		DeleteRule: &RuleResult{ID: id},
+	})
+	if err != nil {
+		return err
+	}
+	if resp.DeleteRule == nil {
+		return ErrNoAntiTheft
+	}
+	return ruleError("anti_theft", resp.DeleteRule.ErrCode, resp.DeleteRule.ErrMsg)
+}
+
+// DeleteAllAwayRules deletes all of the device's away mode rules.
+func (c *Conn) DeleteAllAwayRules() error {
+	resp, err := c.sendAntiTheft(&AntiTheft{
+		DeleteAllRules: &RuleResult{},
+	})
+	if err != nil {
+		return err
+	}
+	if resp.DeleteAllRules == nil {
+		return ErrNoAntiTheft
+	}
+	return ruleError("anti_theft", resp.DeleteAllRules.ErrCode, resp.DeleteAllRules.ErrMsg)
+}
+
+// EnableAway enables or disables away mode as a whole. The rules
+// themselves are left unchanged.
+func (c *Conn) EnableAway(on bool) error {
+	en := 0
+	if on {
+		en = 1
+	}
+	resp, err := c.sendAntiTheft(&AntiTheft{
+		SetOverallEnable: &RuleResult{Enable: &en},
+	})
+	if err != nil {
+		return err
+	}
+	if resp.SetOverallEnable == nil {
+		return ErrNoAntiTheft
+	}
+	return ruleError("anti_theft", resp.SetOverallEnable.ErrCode, resp.SetOverallEnable.ErrMsg)
+}
+
+// SetAway replaces the device's away mode rules that have the
+// specified name by rule, and enables away mode. The rule's Name is
+// set to name.
+func (c *Conn) SetAway(rule *AwayRule, name string) (string, error) {
+	rules, _, err := c.AwayRules()
+	if err != nil {
+		return "", err
+	}
+	for _, r := range rules {
+		if r.Name == name {
+			if err := c.DeleteAwayRule(r.ID); err != nil {
+				return "", err
+			}
+		}
+	}
+	r := *rule
+	r.Name = name
+	id, err := c.AddAwayRule(&r)
+	if err != nil {
+		return "", err
+	}
+	return id, c.EnableAway(true)
+}
@@ -0,0 +1,84 @@
+package tplinky
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAwayRoundTrip(t *testing.T) {
+	rules := newFakeRules()
+	other := rules.add("", map[string]interface{}{"name": "holiday", "enable": 1, "wday": []int{1, 0, 0, 0, 0, 0, 1}, "repeat": 1, "smin": 600, "emin": 660})
+	var sent int
+	addr := fakeDevice(t, func(req map[string]interface{}) interface{} {
+		if m := module(req, "anti_theft"); m != nil {
+			if _, ok := m["get_rules"]; !ok {
+				sent++
+			}
+		}
+		return map[string]interface{}{"anti_theft": rules.serve(req, "anti_theft")}
+	})
+	c, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	rule, err := ParseAwayRule("sunset-21:30 weekdays")
+	if err != nil {
+		t.Fatalf("ParseAwayRule failed: %v", err)
+	}
+	if again, err := ParseAwayRule(rule.String()); err != nil || !reflect.DeepEqual(again, rule) {
+		t.Errorf("reparsing %q got %+v, %v, want %+v", rule, again, err, rule)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := c.SetAway(rule, "tple:away"); err != nil {
+			t.Fatalf("SetAway failed: %v", err)
+		}
+	}
+	rs, enabled, err := c.AwayRules()
+	if err != nil {
+		t.Fatalf("AwayRules failed: %v", err)
+	}
+	if !enabled || len(rs) != 2 || rs[0].ID != other {
+		t.Fatalf("got rules %+v, enabled=%v, want the other rule and one away rule", rs, enabled)
+	}
+	want := *rule
+	want.ID, want.Name = rs[1].ID, "tple:away"
+	if !reflect.DeepEqual(rs[1], &want) {
+		t.Errorf("got rule %+v, want %+v", rs[1], &want)
+	}
+
+	// An invalid rule is refused before anything is sent.
+	bad := want
+	bad.STimeOpt, bad.SMin = TimeFixed, 23*60
+	before := sent
+	if err := c.EditAwayRule(&bad); err == nil {
+		t.Error("edited in a window that crosses midnight")
+	}
+	if _, err := c.AddAwayRule(&bad); err == nil {
+		t.Error("added a window that crosses midnight")
+	}
+	if sent != before {
+		t.Errorf("sent %d commands for invalid rules", sent-before)
+	}
+
+	want.Enable = 0
+	if err := c.EditAwayRule(&want); err != nil {
+		t.Fatalf("EditAwayRule failed: %v", err)
+	}
+	if err := c.EnableAway(false); err != nil {
+		t.Fatalf("EnableAway failed: %v", err)
+	}
+	if rs, enabled, err = c.AwayRules(); err != nil || enabled || rs[1].Enable != 0 {
+		t.Errorf("got rules %+v, enabled=%v, %v, want away mode and the rule disabled", rs, enabled, err)
+	}
+	if err := c.DeleteAwayRule(other); err != nil {
+		t.Fatalf("DeleteAwayRule failed: %v", err)
+	}
+	if err := c.DeleteAllAwayRules(); err != nil {
+		t.Fatalf("DeleteAllAwayRules failed: %v", err)
+	}
+	if rs, _, err := c.AwayRules(); err != nil || len(rs) != 0 {
+		t.Errorf("got rules %v, %v after deleting all, want none", rs, err)
+	}
+}
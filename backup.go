@@ -0,0 +1,454 @@
+package tplinky
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// BackupVersion is the version of the Backup document format.
+const BackupVersion = 1
+
+// ErrIncompatible is returned when a Backup cannot be restored to a
+// device.
+var ErrIncompatible = errors.New("backup is not compatible with device")
+
+// ScheduleBackup holds the schedule rules of a device or socket.
+type ScheduleBackup struct {
+	Enabled bool            `json:"enabled"`
+	Rules   []*ScheduleRule `json:"rules"`
+}
+
+// AwayBackup holds the away mode rules of a device.
+type AwayBackup struct {
+	Enabled bool        `json:"enabled"`
+	Rules   []*AwayRule `json:"rules"`
+}
+
+// SocketBackup holds the configuration of one socket of a power
+// strip.
+type SocketBackup struct {
+	Alias     string           `json:"alias,omitempty"`
+	Schedule  *ScheduleBackup  `json:"schedule,omitempty"`
+	Countdown []*CountdownRule `json:"countdown,omitempty"`
+}
+
+// Backup holds the readable configuration of a device. Modules the
+// device does not support are omitted. For power strips, the
+// schedule and countdown rules are held per socket. It is stored as a
+// JSON file.
+type Backup struct {
+	Version   int              `json:"version"`
+	Taken     time.Time        `json:"taken"`
+	Model     string           `json:"model"`
+	DeviceID  string           `json:"device_id"`
+	Mac       string           `json:"mac"`
+	Alias     string           `json:"alias"`
+	Latitude  float64          `json:"latitude"`
+	Longitude float64          `json:"longitude"`
+	LED       bool             `json:"led"`
+	TimeZone  string           `json:"timezone,omitempty"`
+	Schedule  *ScheduleBackup  `json:"schedule,omitempty"`
+	Countdown []*CountdownRule `json:"countdown,omitempty"`
+	Away      *AwayBackup      `json:"away,omitempty"`
+	Sockets   []*SocketBackup  `json:"sockets,omitempty"`
+}
+
+// LoadBackup reads a backup file.
+func LoadBackup(path string) (*Backup, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	b := &Backup{}
+	if err := json.Unmarshal(data, b); err != nil {
+		return nil, err
+	}
+	if b.Version < 1 || b.Version > BackupVersion {
+		return nil, fmt.Errorf("backup version %d not supported", b.Version)
+	}
+	return b, nil
+}
+
+// Save writes the backup to a file.
+func (b *Backup) Save(path string) error {
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// backupSchedule reads the schedule of the device or sockets. A
+// device without a schedule module has a nil schedule.
+func (c *Conn) backupSchedule(sockets []int) (*ScheduleBackup, error) {
+	rules, enabled, err := c.scheduleRules(sockets)
+	if err == ErrNoSchedule {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ScheduleBackup{Enabled: enabled, Rules: rules}, nil
+}
+
+// backupCountdown reads the countdown rules of the device or
+// sockets, without the time remaining. A device without a countdown
+// module has nil rules, and one with no rules set has an empty list.
+func (c *Conn) backupCountdown(sockets []int) ([]*CountdownRule, error) {
+	rules, err := c.CountdownRules(sockets...)
+	if err == ErrNoCountdown {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rules {
+		r.Remain = 0
+	}
+	if rules == nil {
+		rules = []*CountdownRule{}
+	}
+	return rules, nil
+}
+
+// Backup reads the configuration of the device.
+func (c *Conn) Backup() (*Backup, error) {
+	sys, err := c.GetStatus()
+	if err != nil {
+		return nil, err
+	}
+	b := &Backup{
+		Version:  BackupVersion,
+		Taken:    time.Now(),
+		Model:    sys.Model,
+		DeviceID: sys.DeviceID,
+		Mac:      sys.Mac,
+		Alias:    sys.Alias,
+		LED:      sys.LEDOff == 0,
+	}
+	b.Latitude, b.Longitude = sys.Location()
+	if loc, err := c.GetTimeZone(); err == nil {
+		b.TimeZone = loc.String()
+	}
+	if len(sys.Children) == 0 {
+		if b.Schedule, err = c.backupSchedule(nil); err != nil {
+			return nil, err
+		}
+		if b.Countdown, err = c.backupCountdown(nil); err != nil {
+			return nil, err
+		}
+	}
+	for i, child := range sys.Children {
+		s := &SocketBackup{Alias: child.Alias}
+		if s.Schedule, err = c.backupSchedule([]int{i}); err != nil {
+			return nil, err
+		}
+		if s.Countdown, err = c.backupCountdown([]int{i}); err != nil {
+			return nil, err
+		}
+		b.Sockets = append(b.Sockets, s)
+	}
+	rules, enabled, err := c.AwayRules()
+	if err == nil {
+		b.Away = &AwayBackup{Enabled: enabled, Rules: rules}
+	} else if err != ErrNoAntiTheft {
+		return nil, err
+	}
+	return b, nil
+}
+
+// BackupChange describes a difference between two backups, and so a
+// change made by Restore. Socket is -1 for changes to the device as a
+// whole.
+type BackupChange struct {
+	Socket int
+	Item   string
+	Have   string
+	Want   string
+}
+
+// String summarizes the change.
+func (c BackupChange) String() string {
+	if c.Socket < 0 {
+		return fmt.Sprintf("%s: %s -> %s", c.Item, c.Have, c.Want)
+	}
+	return fmt.Sprintf("socket %d %s: %s -> %s", c.Socket, c.Item, c.Have, c.Want)
+}
+
+// compatibleModel confirms two model names, such as "HS110(US)",
+// name the same hardware, ignoring the region.
+func compatibleModel(a, b string) bool {
+	base := func(m string) string {
+		if i := strings.Index(m, "("); i >= 0 {
+			return m[:i]
+		}
+		return m
+	}
+	return base(a) == base(b)
+}
+
+// onOff formats a flag.
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+// describeSchedule formats schedule rules for comparison.
+func describeSchedule(s *ScheduleBackup) string {
+	if s == nil {
+		return "none"
+	}
+	d := fmt.Sprintf("%s [", onOff(s.Enabled))
+	for i, r := range s.Rules {
+		if i != 0 {
+			d += "; "
+		}
+		d += fmt.Sprintf("%q: %s", r.Name, r)
+		if r.Enable == 0 {
+			d += " disabled"
+		}
+	}
+	return d + "]"
+}
+
+// describeCountdown formats countdown rules for comparison.
+func describeCountdown(rs []*CountdownRule) string {
+	d := "["
+	for i, r := range rs {
+		if i != 0 {
+			d += "; "
+		}
+		d += fmt.Sprintf("%q: %s after %v", r.Name, onOff(r.Act != 0), time.Duration(r.Delay)*time.Second)
+		if r.Enable == 0 {
+			d += " disabled"
+		}
+	}
+	return d + "]"
+}
+
+// describeAway formats away rules for comparison.
+func describeAway(a *AwayBackup) string {
+	if a == nil {
+		return "none"
+	}
+	d := fmt.Sprintf("%s [", onOff(a.Enabled))
+	for i, r := range a.Rules {
+		if i != 0 {
+			d += "; "
+		}
+		d += fmt.Sprintf("%q: %s", r.Name, r)
+		if r.Enable == 0 {
+			d += " disabled"
+		}
+	}
+	return d + "]"
+}
+
+// DiffBackup lists the changes that would turn the configuration in
+// have into that in want. Modules missing from want are left alone.
+func DiffBackup(have, want *Backup) []BackupChange {
+	var changes []BackupChange
+	diff := func(socket int, item, h, w string) {
+		if h != w {
+			changes = append(changes, BackupChange{Socket: socket, Item: item, Have: h, Want: w})
+		}
+	}
+	diff(-1, "alias", fmt.Sprintf("%q", have.Alias), fmt.Sprintf("%q", want.Alias))
+	diff(-1, "location", fmt.Sprintf("%.4f,%.4f", have.Latitude, have.Longitude), fmt.Sprintf("%.4f,%.4f", want.Latitude, want.Longitude))
+	diff(-1, "led", onOff(have.LED), onOff(want.LED))
+	if want.TimeZone != "" {
+		diff(-1, "timezone", have.TimeZone, want.TimeZone)
+	}
+	if want.Schedule != nil {
+		diff(-1, "schedule", describeSchedule(have.Schedule), describeSchedule(want.Schedule))
+	}
+	if len(want.Sockets) == 0 {
+		diff(-1, "countdown", describeCountdown(have.Countdown), describeCountdown(want.Countdown))
+	}
+	if want.Away != nil {
+		diff(-1, "away", describeAway(have.Away), describeAway(want.Away))
+	}
+	for i, w := range want.Sockets {
+		h := &SocketBackup{}
+		if i < len(have.Sockets) {
+			h = have.Sockets[i]
+		}
+		diff(i, "alias", fmt.Sprintf("%q", h.Alias), fmt.Sprintf("%q", w.Alias))
+		if w.Schedule != nil {
+			diff(i, "schedule", describeSchedule(h.Schedule), describeSchedule(w.Schedule))
+		}
+		diff(i, "countdown", describeCountdown(h.Countdown), describeCountdown(w.Countdown))
+	}
+	return changes
+}
+
+// restorable confirms that the device whose configuration is in have
+// can hold everything in the backup want, so that Restore does not
+// fail part way through.
+func restorable(have, want *Backup) error {
+	if !compatibleModel(have.Model, want.Model) {
+		return fmt.Errorf("%w: model %s, backup of %s", ErrIncompatible, have.Model, want.Model)
+	}
+	if len(have.Sockets) != len(want.Sockets) {
+		return fmt.Errorf("%w: %d sockets, backup has %d", ErrIncompatible, len(have.Sockets), len(want.Sockets))
+	}
+	if want.TimeZone != "" && want.TimeZone != have.TimeZone {
+		loc, err := time.LoadLocation(want.TimeZone)
+		if err == nil {
+			_, err = TimeZoneIndex(loc)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: timezone: %v", ErrIncompatible, err)
+		}
+	}
+	if want.Schedule != nil && have.Schedule == nil {
+		return fmt.Errorf("%w: device has no schedule", ErrIncompatible)
+	}
+	if len(want.Sockets) == 0 && len(want.Countdown) != 0 && have.Countdown == nil {
+		return fmt.Errorf("%w: device has no countdown rules", ErrIncompatible)
+	}
+	if want.Away != nil && have.Away == nil {
+		return fmt.Errorf("%w: device has no away mode", ErrIncompatible)
+	}
+	for i, w := range want.Sockets {
+		h := have.Sockets[i]
+		if w.Schedule != nil && h.Schedule == nil {
+			return fmt.Errorf("%w: socket %d has no schedule", ErrIncompatible, i)
+		}
+		if len(w.Countdown) != 0 && h.Countdown == nil {
+			return fmt.Errorf("%w: socket %d has no countdown rules", ErrIncompatible, i)
+		}
+	}
+	return nil
+}
+
+// restoreSchedule replaces the schedule of the device or sockets.
+func (c *Conn) restoreSchedule(s *ScheduleBackup, sockets []int) error {
+	if err := c.DeleteAllScheduleRules(sockets...); err != nil {
+		return err
+	}
+	for _, r := range s.Rules {
+		rule := *r
+		rule.ID = ""
+		if _, err := c.AddScheduleRule(&rule, sockets...); err != nil {
+			return err
+		}
+	}
+	return c.EnableSchedule(s.Enabled, sockets...)
+}
+
+// restoreCountdown replaces the countdown rules of the device or
+// sockets.
+func (c *Conn) restoreCountdown(rs []*CountdownRule, sockets []int) error {
+	if err := c.DeleteAllCountdownRules(sockets...); err != nil {
+		return err
+	}
+	for _, r := range rs {
+		rule := *r
+		rule.ID = ""
+		if _, err := c.AddCountdownRule(&rule, sockets...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreAway replaces the away mode rules of the device.
+func (c *Conn) restoreAway(a *AwayBackup) error {
+	if err := c.DeleteAllAwayRules(); err != nil {
+		return err
+	}
+	for _, r := range a.Rules {
+		rule := *r
+		rule.ID = ""
+		if _, err := c.AddAwayRule(&rule); err != nil {
+			return err
+		}
+	}
+	return c.EnableAway(a.Enabled)
+}
+
+// setSocketAlias sets the alias of one socket of a power strip.
+func (c *Conn) setSocketAlias(socket int, name string) error {
+	ctx, err := c.childContext([]int{socket})
+	if err != nil {
+		return err
+	}
+	_, err = c.Send(Control{
+		Context: ctx,
+		System: &SystemCommands{
+			SetDevAlias: &SystemCommandParameters{
+				Alias: &name,
+			},
+		},
+	})
+	return err
+}
+
+// Restore applies a backup to the device, which may be the device it
+// was taken from or a replacement of a compatible model with the same
+// number of sockets. Only the settings that differ are changed, and
+// the changes are returned. With dryRun, the changes are only
+// reported. Nothing is changed unless the device supports every
+// module the backup holds rules for.
+func (c *Conn) Restore(b *Backup, dryRun bool) ([]BackupChange, error) {
+	have, err := c.Backup()
+	if err != nil {
+		return nil, err
+	}
+	if err := restorable(have, b); err != nil {
+		return nil, err
+	}
+	changes := DiffBackup(have, b)
+	if dryRun {
+		return changes, nil
+	}
+	for i, ch := range changes {
+		if ch.Socket >= 0 {
+			s := b.Sockets[ch.Socket]
+			switch ch.Item {
+			case "alias":
+				err = c.setSocketAlias(ch.Socket, s.Alias)
+			case "schedule":
+				err = c.restoreSchedule(s.Schedule, []int{ch.Socket})
+			case "countdown":
+				err = c.restoreCountdown(s.Countdown, []int{ch.Socket})
+			}
+		} else {
+			switch ch.Item {
+			case "alias":
+				err = c.SetAlias(b.Alias)
+			case "location":
+				err = c.SetLocation(b.Latitude, b.Longitude)
+			case "led":
+				err = c.SetLED(b.LED)
+			case "timezone":
+				var loc *time.Location
+				if loc, err = time.LoadLocation(b.TimeZone); err == nil {
+					err = c.SetTimeZone(loc)
+				}
+			case "schedule":
+				err = c.restoreSchedule(b.Schedule, nil)
+			case "countdown":
+				err = c.restoreCountdown(b.Countdown, nil)
+			case "away":
+				err = c.restoreAway(b.Away)
+			}
+		}
+		if err != nil {
+			return changes[:i], fmt.Errorf("%s: %v", ch, err)
+		}
+	}
+	return changes, nil
+}
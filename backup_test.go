@@ -0,0 +1,124 @@
+package tplinky
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCompatibleModel(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"HS110(US)", "HS110(US)", true},
+		{"HS110(US)", "HS110(EU)", true},
+		{"HS110", "HS110(UK)", true},
+		{"HS110(US)", "HS100(US)", false},
+		{"HS300(US)", "HS30(US)", false},
+	}
+	for _, tc := range tests {
+		if got := compatibleModel(tc.a, tc.b); got != tc.want {
+			t.Errorf("compatibleModel(%q, %q) = %v, want %v", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestDiffBackup(t *testing.T) {
+	have := &Backup{
+		Alias:     "lamp",
+		LED:       true,
+		TimeZone:  "America/Denver",
+		Schedule:  &ScheduleBackup{Enabled: true},
+		Countdown: []*CountdownRule{},
+	}
+	same := *have
+	if changes := DiffBackup(have, &same); len(changes) != 0 {
+		t.Errorf("got changes %v for an identical backup, want none", changes)
+	}
+
+	want := same
+	want.Alias = "heater"
+	want.LED = false
+	want.TimeZone = ""
+	want.Schedule = nil
+	want.Countdown = []*CountdownRule{{Name: "off", Enable: 1, Delay: 60}}
+	want.Away = &AwayBackup{}
+	var got []string
+	for _, ch := range DiffBackup(have, &want) {
+		if ch.Socket != -1 {
+			t.Errorf("got socket change %v on a plug", ch)
+		}
+		got = append(got, ch.Item)
+	}
+	if items := []string{"alias", "led", "countdown", "away"}; !reflect.DeepEqual(got, items) {
+		t.Errorf("got changes to %q, want %q", got, items)
+	}
+
+	strip := &Backup{Sockets: []*SocketBackup{{Alias: "a"}, {Alias: "b"}}}
+	wantStrip := &Backup{Sockets: []*SocketBackup{{Alias: "a"}, {Alias: "c", Schedule: &ScheduleBackup{}}}}
+	var sockets []BackupChange
+	for _, ch := range DiffBackup(strip, wantStrip) {
+		sockets = append(sockets, BackupChange{Socket: ch.Socket, Item: ch.Item})
+	}
+	if changes := []BackupChange{{Socket: 1, Item: "alias"}, {Socket: 1, Item: "schedule"}}; !reflect.DeepEqual(sockets, changes) {
+		t.Errorf("got strip changes %v, want %v", sockets, changes)
+	}
+}
+
+func TestRestoreIncompatible(t *testing.T) {
+	var mu sync.Mutex
+	var writes []string
+	addr := fakeDevice(t, func(req map[string]interface{}) interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		resp := make(map[string]interface{})
+		for name, m := range req {
+			cmds, _ := m.(map[string]interface{})
+			for cmd := range cmds {
+				if !strings.HasPrefix(cmd, "get_") {
+					writes = append(writes, name+"."+cmd)
+				}
+			}
+			switch name {
+			case "system":
+				resp[name] = map[string]interface{}{
+					"get_sysinfo": map[string]interface{}{"model": "HS103(US)", "alias": "old"},
+				}
+			case "time":
+				resp[name] = map[string]interface{}{"get_timezone": map[string]interface{}{"index": 18}}
+			case "schedule", "count_down":
+				resp[name] = map[string]interface{}{"get_rules": map[string]interface{}{"rule_list": []interface{}{}}}
+			}
+		}
+		return resp
+	})
+	c, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	b := &Backup{Model: "HS103(EU)", Alias: "new", LED: true, Away: &AwayBackup{Enabled: true}}
+	if _, err := c.Restore(b, false); !errors.Is(err, ErrIncompatible) {
+		t.Errorf("restoring away rules: got %v, want ErrIncompatible", err)
+	}
+	b.Away = nil
+	b.TimeZone = "Mars/Olympus_Mons"
+	if _, err := c.Restore(b, false); !errors.Is(err, ErrIncompatible) {
+		t.Errorf("restoring a bad timezone: got %v, want ErrIncompatible", err)
+	}
+	mu.Lock()
+	if len(writes) != 0 {
+		t.Errorf("got writes %q before the restore was refused", writes)
+	}
+	mu.Unlock()
+
+	b.TimeZone = ""
+	changes, err := c.Restore(b, true)
+	if err != nil || len(changes) != 1 || changes[0].Item != "alias" {
+		t.Errorf("got changes %v, %v, want only the alias", changes, err)
+	}
+}
@@ -179,11 +179,14 @@ func (c *Conn) EnableSocket(on bool, sockets ...int) error {
 	return err
 }
 
-// GetTime reads the time from the device.
+// GetTime reads the time from the device. The time is returned in
+// the device's timezone, or in the local timezone if that is not
+// known.
 func (c *Conn) GetTime() (time.Time, error) {
 	resp, err := c.Send(Control{
 		Time: &DevTime{
-			GetTime: &RawNull,
+			GetTime:     &RawNull,
+			GetTimeZone: &RawNull,
 		},
 	})
 	t := time.Now()
@@ -194,13 +197,19 @@ func (c *Conn) GetTime() (time.Time, error) {
 	if vs == nil || vs.GetTime == nil {
 		return t, ErrTimeFailed
 	}
+	loc := t.Location()
+	if z := vs.GetTimeZone; z != nil && z.ErrCode == 0 {
+		if l, err := LoadTimeZone(z.Index); err == nil {
+			loc = l
+		}
+	}
 	x := vs.GetTime
-	t = time.Date(x.Year, time.Month(x.Month), x.MDay, x.Hour, x.Min, x.Sec, 0, t.Location())
+	t = time.Date(x.Year, time.Month(x.Month), x.MDay, x.Hour, x.Min, x.Sec, 0, loc)
 	return t, err
 }
 
-// SetTime reads the time from the device.
-func (c *Conn) SetTime(t time.Time) error {
+// setTime sets the wall clock time and timezone index of the device.
+func (c *Conn) setTime(t time.Time, index int) error {
 	_, err := c.Send(Control{
 		Time: &DevTime{
 			SetTimeZone: &TimeZone{
@@ -210,13 +219,32 @@ func (c *Conn) SetTime(t time.Time) error {
 				Hour:  t.Hour(),
 				Min:   t.Minute(),
 				Sec:   t.Second(),
-				Index: 90,
+				Index: index,
 			},
 		},
 	})
 	return err
 }
 
+// SetTime sets the time of the device. The device keeps its
+// timezone, and t is converted into it. If the device's timezone
+// cannot be read, the device is set to the timezone of t, or to UTC
+// if that is not in the device table either.
+func (c *Conn) SetTime(t time.Time) error {
+	if index, err := c.timeZoneIndex(); err == nil {
+		if _, err := TimeZoneName(index); err == nil {
+			if loc, err := LoadTimeZone(index); err == nil {
+				t = t.In(loc)
+			}
+			return c.setTime(t, index)
+		}
+	}
+	if index, err := TimeZoneIndex(t.Location()); err == nil {
+		return c.setTime(t, index)
+	}
+	return c.setTime(t.UTC(), zoneAliases["UTC"])
+}
+
 // SetAlias sets the alias name for the device.
 func (c *Conn) SetAlias(name string) error {
 	_, err := c.Send(Control{
@@ -232,8 +260,22 @@ func (c *Conn) SetAlias(name string) error {
 // FactoryReset resets the device to its factory default
 // settings. This will make the device forget its WiFi settings and
 // revert it to broadcasting a self-generated WiFi network:
-// `"TP-LINK_Smart Plug_XXXX"`.
+// `"TP-LINK_Smart Plug_XXXX"`. As it is not confirmed, it fails with
+// ErrUnconfirmed unless the Policy allows Unconfirmed commands, and
+// it is audited like FactoryResetGuarded.
 func (c *Conn) FactoryReset() error {
+	return c.guarded("reset", "", "", c.reset)
+}
+
+// FactoryResetGuarded performs a FactoryReset, provided the token
+// matches the device's MAC address, see ConfirmToken, and the Policy
+// allows it.
+func (c *Conn) FactoryResetGuarded(token string) error {
+	return c.guarded("reset", "", token, c.reset)
+}
+
+// reset sends the factory reset command.
+func (c *Conn) reset() error {
 	one := 1
 	_, err := c.Send(Control{
 		System: &SystemCommands{
@@ -248,17 +290,11 @@ func (c *Conn) FactoryReset() error {
 // SetWiFi sets the ssid and password for the preferred
 // network. Performing this command will cause the device to
 // disconnect from the current network, and connect with the provided
-// parameters.
+// parameters. The key type of the network is taken from a WiFi scan
+// by the device, and WPA2 is assumed for networks it cannot see. See
+// JoinWiFi for a version that confirms the device joined.
 func (c *Conn) SetWiFi(ssid, password string) error {
-	_, err := c.Send(Control{
-		NetIf: &NetIfCommands{
-			SetStaInfo: &StaInfoParameters{
-				SSID:     ssid,
-				Password: password,
-				KeyType:  3,
-			},
-		},
-	})
+	_, err := c.SendWiFi(ssid, password, 3)
 	return err
 }
 
@@ -327,3 +363,26 @@ func (c *Conn) EMonState() (*EMeterResponse, error) {
 	}
 	return resp.EMeter.GetRealTime, nil
 }
+
+// DayStats reads the per-day energy consumption history of the
+// E-Meter for the specified month.
+func (c *Conn) DayStats(year int, month time.Month) ([]DayStat, error) {
+	resp, err := c.Send(Control{
+		EMeter: &EMeter{
+			GetDayStat: &DayStatResponse{
+				Year:  year,
+				Month: int(month),
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.EMeter == nil || resp.EMeter.GetDayStat == nil {
+		return nil, ErrNoEMeter
+	}
+	if eCode := resp.EMeter.GetDayStat.ErrCode; eCode != 0 {
+		return nil, fmt.Errorf("emeter error %d", eCode)
+	}
+	return resp.EMeter.GetDayStat.DayList, nil
+}
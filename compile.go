@@ -0,0 +1,339 @@
+package tplinky
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// ErrUnexpressible is returned for controller rules that the device
+// schedule module cannot represent.
+var ErrUnexpressible = errors.New("not expressible on-device")
+
+// ControlRule is a declarative switching rule, run by a controller or
+// compiled into the schedules of devices. The rule applies to a
+// Device (address, MAC or alias in the inventory) or to all of the
+// devices carrying a Label, optionally for specific Sockets of power
+// strips. On and Off are the times, "HH:MM" or a sunrise or sunset
+// offset such as "sunset+15", at which the rule switches the devices
+// on and off; either may be empty. Days is as for ParseScheduleRule.
+type ControlRule struct {
+	Name     string `json:"name"`
+	Device   string `json:"device,omitempty"`
+	Label    string `json:"label,omitempty"`
+	Sockets  []int  `json:"sockets,omitempty"`
+	On       string `json:"on,omitempty"`
+	Off      string `json:"off,omitempty"`
+	Days     string `json:"days,omitempty"`
+	Disabled bool   `json:"disabled,omitempty"`
+}
+
+// RuleSet holds a list of controller rules. It is stored as a JSON
+// file.
+type RuleSet struct {
+	Rules []*ControlRule `json:"rules"`
+}
+
+// LoadRuleSet reads a rule set file.
+func LoadRuleSet(path string) (*RuleSet, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rs := &RuleSet{}
+	if err := json.Unmarshal(data, rs); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// compileTime parses a rule time, rejecting those the device cannot
+// represent: times with seconds and very large sun offsets.
+func compileTime(s string) (opt, min, offset int, err error) {
+	if parts := strings.Split(s, ":"); len(parts) == 3 {
+		if parts[2] != "00" {
+			return 0, 0, 0, fmt.Errorf("time %q: seconds are %w", s, ErrUnexpressible)
+		}
+		s = parts[0] + ":" + parts[1]
+	}
+	if opt, min, offset, err = parseRuleTime(strings.ToLower(s)); err != nil {
+		return
+	}
+	if offset < -12*60 || offset > 12*60 {
+		err = fmt.Errorf("time %q: offset is %w", s, ErrUnexpressible)
+	}
+	return
+}
+
+// Compile converts the rule into device schedule rules. Most rules
+// compile into one schedule rule. A rule that switches on and off at
+// fixed times across midnight compiles into two: one to switch on,
+// and one to switch off on the following days.
+func (r *ControlRule) Compile() ([]*ScheduleRule, error) {
+	base := ScheduleRule{
+		Name:     r.Name,
+		Enable:   1,
+		Repeat:   1,
+		WDay:     []int{1, 1, 1, 1, 1, 1, 1},
+		ETimeOpt: -1,
+		EAct:     -1,
+	}
+	if r.Disabled {
+		base.Enable = 0
+	}
+	if r.Days != "" {
+		if err := parseRuleDays(strings.ToLower(r.Days), &base.WDay, &base.Repeat, &base.Year, &base.Month, &base.Day); err != nil {
+			return nil, fmt.Errorf("rule %q: %v", r.Name, err)
+		}
+	}
+	var acts [][4]int
+	for _, a := range []struct {
+		at  string
+		act int
+	}{{r.On, 1}, {r.Off, 0}} {
+		if a.at == "" {
+			continue
+		}
+		opt, min, offset, err := compileTime(a.at)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", r.Name, err)
+		}
+		acts = append(acts, [4]int{a.act, opt, min, offset})
+	}
+	switch len(acts) {
+	case 0:
+		return nil, fmt.Errorf("rule %q: no on or off time", r.Name)
+	case 1:
+		s := base
+		s.SAct, s.STimeOpt, s.SMin, s.SOffset = acts[0][0], acts[0][1], acts[0][2], acts[0][3]
+		return []*ScheduleRule{&s}, nil
+	}
+	on, off := acts[0], acts[1]
+	if on[1] != TimeFixed || off[1] != TimeFixed || off[2] > on[2] {
+		s := base
+		s.SAct, s.STimeOpt, s.SMin, s.SOffset = on[0], on[1], on[2], on[3]
+		s.EAct, s.ETimeOpt, s.EMin, s.EOffset = off[0], off[1], off[2], off[3]
+		return []*ScheduleRule{&s}, nil
+	}
+	if base.Repeat == 0 {
+		return nil, fmt.Errorf("rule %q: a dated rule crossing midnight is %w", r.Name, ErrUnexpressible)
+	}
+	s1, s2 := base, base
+	s1.SAct, s1.SMin = on[0], on[2]
+	s2.SAct, s2.SMin = off[0], off[2]
+	s2.WDay = make([]int, 7)
+	for i, d := range base.WDay {
+		s2.WDay[(i+1)%7] = d
+	}
+	return []*ScheduleRule{&s1, &s2}, nil
+}
+
+// ScheduleTarget identifies the schedule of a device, or of one
+// socket of a power strip. Socket is -1 for the whole device.
+type ScheduleTarget struct {
+	Addr   string
+	Socket int
+}
+
+// String formats the target.
+func (t ScheduleTarget) String() string {
+	if t.Socket < 0 {
+		return t.Addr
+	}
+	return fmt.Sprintf("%s[%d]", t.Addr, t.Socket)
+}
+
+// Sockets returns the sockets argument for schedule commands on the
+// target.
+func (t ScheduleTarget) Sockets() []int {
+	if t.Socket < 0 {
+		return nil
+	}
+	return []int{t.Socket}
+}
+
+// RuleProblem records a controller rule that could not be compiled.
+type RuleProblem struct {
+	Rule *ControlRule
+	Err  error
+}
+
+// String summarizes the problem.
+func (p RuleProblem) String() string {
+	return p.Err.Error()
+}
+
+// CompileRules compiles a rule set into the schedule rules of each
+// device, or socket, it applies to. The rules that cannot be
+// compiled are returned separately; those for which errors.Is(err,
+// ErrUnexpressible) is true must be left to a controller to run.
+func CompileRules(set *RuleSet, inv *Inventory) (map[ScheduleTarget][]*ScheduleRule, []RuleProblem) {
+	compiled := make(map[ScheduleTarget][]*ScheduleRule)
+	var problems []RuleProblem
+	for _, r := range set.Rules {
+		rules, err := r.Compile()
+		if err != nil {
+			problems = append(problems, RuleProblem{Rule: r, Err: err})
+			continue
+		}
+		var addrs []string
+		switch {
+		case r.Label != "":
+			if inv != nil {
+				for _, d := range inv.Labeled(r.Label) {
+					addrs = append(addrs, d.Addr)
+				}
+			}
+			if len(addrs) == 0 {
+				err = fmt.Errorf("rule %q: no devices labeled %q", r.Name, r.Label)
+			}
+		case r.Device != "":
+			addr := r.Device
+			if inv != nil {
+				if d := inv.Find(r.Device); d != nil {
+					addr = d.Addr
+				}
+			}
+			addrs = append(addrs, addr)
+		default:
+			err = fmt.Errorf("rule %q: no device or label", r.Name)
+		}
+		if err != nil {
+			problems = append(problems, RuleProblem{Rule: r, Err: err})
+			continue
+		}
+		for _, addr := range addrs {
+			sockets := r.Sockets
+			if len(sockets) == 0 {
+				sockets = []int{-1}
+			}
+			for _, s := range sockets {
+				t := ScheduleTarget{Addr: addr, Socket: s}
+				compiled[t] = append(compiled[t], rules...)
+			}
+		}
+	}
+	return compiled, problems
+}
+
+// The operations of a ScheduleChange.
+const (
+	ScheduleAdd    = "add"
+	ScheduleEdit   = "edit"
+	ScheduleDelete = "delete"
+)
+
+// ScheduleChange is a change needed to bring a device schedule in
+// line with the compiled rules.
+type ScheduleChange struct {
+	Target ScheduleTarget
+	Op     string
+	Rule   *ScheduleRule
+}
+
+// String summarizes the change.
+func (c ScheduleChange) String() string {
+	return fmt.Sprintf("%s: %s %q: %s", c.Target, c.Op, c.Rule.Name, c.Rule)
+}
+
+// DiffSchedule works out the changes that turn the device rules,
+// have, into the wanted rules. Only device rules whose names start
+// with prefix are considered to be managed; all others are left
+// alone. The wanted rules are named with the prefix. Rules that
+// already match are left unchanged.
+func DiffSchedule(target ScheduleTarget, have, want []*ScheduleRule, prefix string) []ScheduleChange {
+	key := func(r *ScheduleRule) string {
+		return r.Name + "\x00" + r.String()
+	}
+	existing := make(map[string][]*ScheduleRule)
+	var managed []*ScheduleRule
+	for _, r := range have {
+		if strings.HasPrefix(r.Name, prefix) {
+			managed = append(managed, r)
+			existing[key(r)] = append(existing[key(r)], r)
+		}
+	}
+	kept := make(map[*ScheduleRule]bool)
+	var adds []*ScheduleRule
+	for _, w := range want {
+		r := *w
+		r.Name = prefix + w.Name
+		if rs := existing[key(&r)]; len(rs) != 0 {
+			kept[rs[0]] = true
+			existing[key(&r)] = rs[1:]
+			continue
+		}
+		adds = append(adds, &r)
+	}
+	var changes []ScheduleChange
+	for _, r := range managed {
+		if kept[r] {
+			continue
+		}
+		// Reuse a stale rule of the same name, if there is one.
+		edited := false
+		for i, a := range adds {
+			if a.Name == r.Name {
+				a.ID = r.ID
+				changes = append(changes, ScheduleChange{Target: target, Op: ScheduleEdit, Rule: a})
+				adds = append(adds[:i], adds[i+1:]...)
+				edited = true
+				break
+			}
+		}
+		if !edited {
+			changes = append(changes, ScheduleChange{Target: target, Op: ScheduleDelete, Rule: r})
+		}
+	}
+	for _, a := range adds {
+		changes = append(changes, ScheduleChange{Target: target, Op: ScheduleAdd, Rule: a})
+	}
+	return changes
+}
+
+// SyncSchedule brings the schedule of the target, which must be the
+// device c is connected to, in line with the wanted rules. See
+// DiffSchedule. With dryRun, the changes are only reported.
+func (c *Conn) SyncSchedule(target ScheduleTarget, want []*ScheduleRule, prefix string, dryRun bool) ([]ScheduleChange, error) {
+	have, err := c.ScheduleRules(target.Sockets()...)
+	if err != nil {
+		return nil, err
+	}
+	changes := DiffSchedule(target, have, want, prefix)
+	if dryRun {
+		return changes, nil
+	}
+	for i, ch := range changes {
+		switch ch.Op {
+		case ScheduleAdd:
+			ch.Rule.ID, err = c.AddScheduleRule(ch.Rule, target.Sockets()...)
+		case ScheduleEdit:
+			err = c.EditScheduleRule(ch.Rule, target.Sockets()...)
+		case ScheduleDelete:
+			err = c.DeleteScheduleRule(ch.Rule.ID, target.Sockets()...)
+		}
+		if err != nil {
+			return changes[:i], fmt.Errorf("%s: %v", ch, err)
+		}
+	}
+	return changes, nil
+}
+
+// ScheduleTargets returns the targets of compiled rules in a stable
+// order.
+func ScheduleTargets(compiled map[ScheduleTarget][]*ScheduleRule) []ScheduleTarget {
+	var ts []ScheduleTarget
+	for t := range compiled {
+		ts = append(ts, t)
+	}
+	sort.Slice(ts, func(i, j int) bool {
+		if ts[i].Addr != ts[j].Addr {
+			return ts[i].Addr < ts[j].Addr
+		}
+		return ts[i].Socket < ts[j].Socket
+	})
+	return ts
+}
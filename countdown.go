@@ -0,0 +1,147 @@
+package tplinky
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// ErrNoCountdown is returned if the target device failed to perform
+// count_down commands.
+var ErrNoCountdown = errors.New("no count_down responded")
+
+// sendCountdown sends a count_down command to the device, for the
+// specified sockets of a power strip.
+func (c *Conn) sendCountdown(cmd *CountDown, sockets []int) (*CountDownResponse, error) {
+	ctx, err := c.childContext(sockets)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.Send(Control{
+		Context:   ctx,
+		CountDown: cmd,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.CountDown == nil {
+		return nil, ErrNoCountdown
+	}
+	return resp.CountDown, nil
+}
+
+// CountdownRules lists the device's countdown rules. For a power
+// strip, the rules of specific sockets can be selected.
+func (c *Conn) CountdownRules(sockets ...int) ([]*CountdownRule, error) {
+	resp, err := c.sendCountdown(&CountDown{
+		GetRules: &RuleList{},
+	}, sockets)
+	if err != nil {
+		return nil, err
+	}
+	r := resp.GetRules
+	if r == nil {
+		return nil, ErrNoCountdown
+	}
+	if err := ruleError("count_down", r.ErrCode, r.ErrMsg); err != nil {
+		return nil, err
+	}
+	var rules []*CountdownRule
+	if len(r.RuleList) != 0 {
+		if err := json.Unmarshal(r.RuleList, &rules); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+// AddCountdownRule adds a countdown rule to the device, returning the
+// identifier the device assigned to it. Most devices hold only one
+// countdown rule at a time.
+func (c *Conn) AddCountdownRule(rule *CountdownRule, sockets ...int) (string, error) {
+	r := *rule
+	r.ID = ""
+	r.Remain = 0
+	resp, err := c.sendCountdown(&CountDown{
+		AddRule: &r,
+	}, sockets)
+	if err != nil {
+		return "", err
+	}
+	if resp.AddRule == nil {
+		return "", ErrNoCountdown
+	}
+	if err := ruleError("count_down", resp.AddRule.ErrCode, resp.AddRule.ErrMsg); err != nil {
+		return "", err
+	}
+	return resp.AddRule.ID, nil
+}
+
+// EditCountdownRule replaces the device's countdown rule that has the
+// same ID as rule. Enabling a rule restarts its countdown.
+func (c *Conn) EditCountdownRule(rule *CountdownRule, sockets ...int) error {
+	if rule.ID == "" {
+		return errors.New("countdown rule has no id")
+	}
+	r := *rule
+	r.Remain = 0
+	resp, err := c.sendCountdown(&CountDown{
+		EditRule: &r,
+	}, sockets)
+	if err != nil {
+		return err
+	}
+	if resp.EditRule == nil {
+		return ErrNoCountdown
+	}
+	return ruleError("count_down", resp.EditRule.ErrCode, resp.EditRule.ErrMsg)
+}
+
+// DeleteCountdownRule cancels and deletes a countdown rule.
+func (c *Conn) DeleteCountdownRule(id string, sockets ...int) error {
+	resp, err := c.sendCountdown(&CountDown{
+		DeleteRule: &RuleResult{ID: id},
+	}, sockets)
+	if err != nil {
+		return err
+	}
+	if resp.DeleteRule == nil {
+		return ErrNoCountdown
+	}
+	return ruleError("count_down", resp.DeleteRule.ErrCode, resp.DeleteRule.ErrMsg)
+}
+
+// DeleteAllCountdownRules cancels and deletes all of the device's
+// countdown rules.
+func (c *Conn) DeleteAllCountdownRules(sockets ...int) error {
+	resp, err := c.sendCountdown(&CountDown{
+		DeleteAllRules: &RuleResult{},
+	}, sockets)
+	if err != nil {
+		return err
+	}
+	if resp.DeleteAllRules == nil {
+		return ErrNoCountdown
+	}
+	return ruleError("count_down", resp.DeleteAllRules.ErrCode, resp.DeleteAllRules.ErrMsg)
+}
+
+// Countdown arms a countdown that switches the device, or the
+// specified sockets of a power strip, on or off after a delay. Any
+// existing countdown is replaced. The delay is rounded up to a whole
+// number of seconds.
+func (c *Conn) Countdown(on bool, after time.Duration, sockets ...int) (string, error) {
+	if err := c.DeleteAllCountdownRules(sockets...); err != nil {
+		return "", err
+	}
+	act := 0
+	if on {
+		act = 1
+	}
+	return c.AddCountdownRule(&CountdownRule{
+		Name:   "countdown",
+		Enable: 1,
+		Delay:  int((after + time.Second - 1) / time.Second),
+		Act:    act,
+	}, sockets...)
+}
@@ -0,0 +1,80 @@
+package tplinky
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCountdownRoundTrip(t *testing.T) {
+	addr, s := fakeStrip(t, 2)
+	c, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	id, err := c.Countdown(false, 1500*time.Millisecond, 1)
+	if err != nil {
+		t.Fatalf("Countdown failed: %v", err)
+	}
+	rs, err := c.CountdownRules(1)
+	if err != nil {
+		t.Fatalf("CountdownRules failed: %v", err)
+	}
+	want := []*CountdownRule{{ID: id, Name: "countdown", Enable: 1, Delay: 2}}
+	if !reflect.DeepEqual(rs, want) {
+		t.Errorf("got rules %+v, want %+v", rs, want)
+	}
+	if rs, err := c.CountdownRules(0); err != nil || len(rs) != 0 {
+		t.Errorf("got rules %v, %v on the other socket, want none", rs, err)
+	}
+
+	// Arming a new countdown replaces the old one.
+	if id, err = c.Countdown(true, time.Minute, 1); err != nil {
+		t.Fatalf("Countdown failed: %v", err)
+	}
+	rs, err = c.CountdownRules(1)
+	if err != nil || len(rs) != 1 || rs[0].ID != id || rs[0].Delay != 60 || rs[0].Act != 1 {
+		t.Fatalf("got rules %+v, %v, want one to switch on after 60s", rs, err)
+	}
+
+	// The remaining time is the device's to report, not ours to
+	// send.
+	r := *rs[0]
+	r.Enable, r.Remain = 0, 30
+	if err := c.EditCountdownRule(&r, 1); err != nil {
+		t.Fatalf("EditCountdownRule failed: %v", err)
+	}
+	stored := s.countdown.list(childID(1))
+	if _, ok := stored[0]["remain"]; ok || stored[0]["enable"] != 0.0 {
+		t.Errorf("got stored rule %v, want disabled with no remain", stored[0])
+	}
+	if err := c.EditCountdownRule(&CountdownRule{Delay: 1}, 1); err == nil {
+		t.Error("edited a rule with no id")
+	}
+
+	if _, err := c.AddCountdownRule(&CountdownRule{ID: "mine", Name: "all", Enable: 1, Delay: 5, Remain: 3}); err != nil {
+		t.Fatalf("AddCountdownRule failed: %v", err)
+	}
+	if stored := s.countdown.list(""); len(stored) != 1 || stored[0]["id"] == "mine" || stored[0]["remain"] != nil {
+		t.Errorf("got stored rules %v, want one with a device assigned id", stored)
+	}
+
+	if err := c.DeleteCountdownRule(id, 1); err != nil {
+		t.Fatalf("DeleteCountdownRule failed: %v", err)
+	}
+	if rs, err := c.CountdownRules(1); err != nil || len(rs) != 0 {
+		t.Errorf("got rules %v, %v after delete, want none", rs, err)
+	}
+	if err := c.DeleteCountdownRule(id, 1); err == nil || !strings.Contains(err.Error(), "count_down error -14") {
+		t.Errorf("deleting a missing rule: got %v, want a count_down error", err)
+	}
+	if err := c.DeleteAllCountdownRules(); err != nil {
+		t.Fatalf("DeleteAllCountdownRules failed: %v", err)
+	}
+	if rs, err := c.CountdownRules(); err != nil || len(rs) != 0 {
+		t.Errorf("got rules %v, %v after deleting all, want none", rs, err)
+	}
+}
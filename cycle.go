@@ -0,0 +1,152 @@
+package tplinky
+
+import "time"
+
+// CycleEventType distinguishes the events of a CycleDetector.
+type CycleEventType int
+
+const (
+	CycleStarted CycleEventType = iota
+	CycleFinished
+	CycleIdle
+)
+
+// String returns a readable name for the event type.
+func (e CycleEventType) String() string {
+	switch e {
+	case CycleStarted:
+		return "started"
+	case CycleFinished:
+		return "finished"
+	case CycleIdle:
+		return "idle"
+	}
+	return "unknown"
+}
+
+// CycleEvent is generated by a CycleDetector. For CycleFinished
+// events, Duration, EnergyMWH and PeakMW summarize the whole cycle.
+type CycleEvent struct {
+	Type      CycleEventType
+	When      time.Time
+	Start     time.Time
+	Duration  time.Duration
+	EnergyMWH float64
+	PeakMW    int
+}
+
+// CycleDetector is a state machine that recognizes the operating
+// cycles of an appliance, such as a washing machine, from periodic
+// E-Meter readings of the plug it is connected to.
+type CycleDetector struct {
+	// A cycle starts once the power draw has been at or above
+	// StartMW for at least MinStart.
+	StartMW  int
+	MinStart time.Duration
+
+	// A running cycle finishes once the power draw has been
+	// below StopMW for at least MinStop. StopMW is normally lower
+	// than StartMW, and MinStop longer than any pause in the
+	// appliance's cycle (soaking, for example).
+	StopMW  int
+	MinStop time.Duration
+
+	// IdleAfter, if non-zero, is how long after a cycle finishes
+	// with the power remaining below StopMW that a CycleIdle
+	// event is generated.
+	IdleAfter time.Duration
+
+	running  bool
+	above    time.Time
+	below    time.Time
+	finished time.Time
+	idleSent bool
+	start    time.Time
+	peak     int
+	energy   *Integrator
+}
+
+// Running indicates whether a cycle is in progress.
+func (d *CycleDetector) Running() bool {
+	return d.running
+}
+
+// Add feeds an E-Meter reading to the detector and returns any
+// events it caused.
+func (d *CycleDetector) Add(when time.Time, s *EMeterResponse) []CycleEvent {
+	if s == nil {
+		return nil
+	}
+	var events []CycleEvent
+	p := s.PowerMW
+	if d.energy == nil {
+		d.energy = &Integrator{}
+	}
+	d.energy.Add(when, s)
+
+	if !d.running {
+		if p < d.StartMW {
+			d.above = time.Time{}
+			// Only retain the most recent sample while idle, so
+			// the start of the next cycle can be integrated.
+			d.energy = &Integrator{}
+			d.energy.Add(when, s)
+			if !d.finished.IsZero() && !d.idleSent && d.IdleAfter > 0 && p < d.StopMW && when.Sub(d.finished) >= d.IdleAfter {
+				d.idleSent = true
+				events = append(events, CycleEvent{
+					Type:  CycleIdle,
+					When:  when,
+					Start: d.finished,
+				})
+			}
+			return events
+		}
+		if d.above.IsZero() {
+			d.above = when
+			d.peak = 0
+		}
+		if p > d.peak {
+			d.peak = p
+		}
+		if when.Sub(d.above) < d.MinStart {
+			return nil
+		}
+		d.running = true
+		d.start = d.above
+		d.below = time.Time{}
+		d.idleSent = false
+		return append(events, CycleEvent{
+			Type:  CycleStarted,
+			When:  when,
+			Start: d.start,
+		})
+	}
+
+	if p > d.peak {
+		d.peak = p
+	}
+	if p >= d.StopMW {
+		d.below = time.Time{}
+		return nil
+	}
+	if d.below.IsZero() {
+		d.below = when
+	}
+	if when.Sub(d.below) < d.MinStop {
+		return nil
+	}
+	d.running = false
+	d.above = time.Time{}
+	d.finished = d.below
+	sum := d.energy.Summary(d.start, d.below.Add(time.Nanosecond))
+	d.energy = &Integrator{}
+	d.energy.Add(when, s)
+	return append(events, CycleEvent{
+		Type:      CycleFinished,
+		When:      when,
+		Start:     d.start,
+		Duration:  d.finished.Sub(d.start),
+		EnergyMWH: sum.EnergyMWH,
+		PeakMW:    d.peak,
+	})
+}
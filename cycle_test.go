@@ -0,0 +1,74 @@
+package tplinky
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestCycleDetector(t *testing.T) {
+	t0 := time.Date(2025, time.March, 1, 9, 0, 0, 0, time.UTC)
+	at := func(min int) time.Time { return t0.Add(time.Duration(min) * time.Minute) }
+	// A washing machine trace, one reading a minute: a blip too
+	// short to start a cycle, a wash with a five minute soak, and
+	// then a long quiet spell.
+	power := func(min int) int {
+		switch {
+		case min == 5:
+			return 50000
+		case min >= 8 && min <= 20:
+			return 50000
+		case min >= 21 && min <= 25:
+			return 2000
+		case min >= 26 && min <= 40:
+			return 60000
+		}
+		return 1000
+	}
+	d := &CycleDetector{
+		StartMW:   10000,
+		MinStart:  2 * time.Minute,
+		StopMW:    5000,
+		MinStop:   10 * time.Minute,
+		IdleAfter: 30 * time.Minute,
+	}
+	var got []CycleEvent
+	running := make(map[int]bool)
+	for min := 0; min <= 90; min++ {
+		got = append(got, d.Add(at(min), &EMeterResponse{PowerMW: power(min)})...)
+		running[min] = d.Running()
+	}
+	if d.Add(at(91), nil) != nil {
+		t.Error("a missing reading generated events")
+	}
+
+	want := []CycleEvent{
+		{Type: CycleStarted, When: at(10), Start: at(8)},
+		{Type: CycleFinished, When: at(51), Start: at(8), Duration: 33 * time.Minute, PeakMW: 60000,
+			EnergyMWH: (12*50000 + 26000 + 4*2000 + 31000 + 14*60000 + 30500) / 60.0},
+		{Type: CycleIdle, When: at(71), Start: at(41)},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got events %+v, want %d", got, len(want))
+	}
+	for i, e := range got {
+		w := want[i]
+		if math.Abs(e.EnergyMWH-w.EnergyMWH) > 1e-6 {
+			t.Errorf("event %d: got %.3f mWh, want %.3f", i, e.EnergyMWH, w.EnergyMWH)
+		}
+		e.EnergyMWH = w.EnergyMWH
+		if e != w {
+			t.Errorf("event %d: got %v %+v, want %v %+v", i, e.Type, e, w.Type, w)
+		}
+	}
+	for _, min := range []int{5, 9, 51, 90} {
+		if running[min] {
+			t.Errorf("running at minute %d", min)
+		}
+	}
+	for _, min := range []int{10, 23, 41, 50} {
+		if !running[min] {
+			t.Errorf("not running at minute %d", min)
+		}
+	}
+}
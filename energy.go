@@ -0,0 +1,206 @@
+package tplinky
+
+import (
+	"sort"
+	"time"
+)
+
+// EnergySample holds a single E-Meter reading along with the time it
+// was taken.
+type EnergySample struct {
+	When time.Time
+	EMeterResponse
+}
+
+// EnergySummary holds the statistics computed by an Integrator over
+// a window of time.
+type EnergySummary struct {
+	From, To time.Time
+
+	// Samples is the number of readings that fell inside the
+	// window and Missed is an estimate of the number of readings
+	// that were expected, but absent.
+	Samples int
+	Missed  int
+
+	// Covered is the amount of the window over which the power
+	// draw was integrated. Gaps longer than the Integrator's
+	// MaxGap are not included.
+	Covered time.Duration
+
+	MinMW  int
+	MaxMW  int
+	MeanMW float64
+
+	// EnergyMWH is the integrated energy consumption in
+	// milliwatt-hours.
+	EnergyMWH float64
+
+	// DutyCycle is the fraction of the Covered time during which
+	// the power draw was at or above the Integrator's OnMW.
+	DutyCycle float64
+
+	// Resets counts the number of times the device's own
+	// total_wh counter went backwards (EMonReset) in the window,
+	// and DeviceWH is the energy accumulated by that counter
+	// across the window, allowing for those resets.
+	Resets   int
+	DeviceWH int
+}
+
+// Integrator accumulates E-Meter readings and integrates the
+// instantaneous power_mw values over the measured time between
+// them. The device's own total_wh counter only increments in whole
+// watt-hours, so this gives a much finer resolution for small
+// loads.
+type Integrator struct {
+	// Interval is the expected time between samples. It is used
+	// to estimate missed samples. Zero disables that estimate.
+	Interval time.Duration
+
+	// MaxGap is the longest time between two samples that is
+	// integrated. If zero, 5*Interval is used, and if that is
+	// also zero, all gaps are integrated.
+	MaxGap time.Duration
+
+	// OnMW is the power threshold used to compute the duty
+	// cycle.
+	OnMW int
+
+	// Keep is how long samples are retained. Zero retains all
+	// samples.
+	Keep time.Duration
+
+	samples []EnergySample
+}
+
+// Add appends a reading to the integrator. Readings are expected in
+// time order, and any that are older than the most recent sample are
+// ignored.
+func (g *Integrator) Add(when time.Time, s *EMeterResponse) {
+	if s == nil {
+		return
+	}
+	if n := len(g.samples); n != 0 && !when.After(g.samples[n-1].When) {
+		return
+	}
+	g.samples = append(g.samples, EnergySample{When: when, EMeterResponse: *s})
+	if g.Keep > 0 {
+		cut := when.Add(-g.Keep)
+		i := sort.Search(len(g.samples), func(i int) bool {
+			return !g.samples[i].When.Before(cut)
+		})
+		if i > 0 {
+			g.samples = append(g.samples[:0], g.samples[i:]...)
+		}
+	}
+}
+
+// Samples returns the currently retained samples.
+func (g *Integrator) Samples() []EnergySample {
+	return g.samples
+}
+
+// maxGap returns the effective maximum integration gap, or zero for
+// no limit.
+func (g *Integrator) maxGap() time.Duration {
+	if g.MaxGap != 0 {
+		return g.MaxGap
+	}
+	return 5 * g.Interval
+}
+
+// powerAt linearly interpolates the power draw at t between two
+// samples.
+func powerAt(a, b EnergySample, t time.Time) float64 {
+	span := b.When.Sub(a.When)
+	if span <= 0 {
+		return float64(a.PowerMW)
+	}
+	f := float64(t.Sub(a.When)) / float64(span)
+	return float64(a.PowerMW) + f*float64(b.PowerMW-a.PowerMW)
+}
+
+// Summary computes statistics for the samples that fall in the
+// window [from, to). A zero from or to leaves that end of the window
+// unbounded.
+func (g *Integrator) Summary(from, to time.Time) EnergySummary {
+	sum := EnergySummary{From: from, To: to}
+	inside := func(t time.Time) bool {
+		return (from.IsZero() || !t.Before(from)) && (to.IsZero() || t.Before(to))
+	}
+	var on time.Duration
+	var prev *EnergySample
+	gap := g.maxGap()
+	for i := range g.samples {
+		s := &g.samples[i]
+		if inside(s.When) {
+			if sum.Samples == 0 || s.PowerMW < sum.MinMW {
+				sum.MinMW = s.PowerMW
+			}
+			if s.PowerMW > sum.MaxMW {
+				sum.MaxMW = s.PowerMW
+			}
+			sum.Samples++
+		}
+		if prev == nil {
+			prev = s
+			continue
+		}
+		a, b := *prev, *s
+		prev = s
+		start, end := a.When, b.When
+		if !from.IsZero() && start.Before(from) {
+			start = from
+		}
+		if !to.IsZero() && end.After(to) {
+			end = to
+		}
+		if !end.After(start) {
+			continue
+		}
+		if inside(b.When) {
+			if b.TotalWH < a.TotalWH {
+				sum.Resets++
+				sum.DeviceWH += b.TotalWH
+			} else {
+				sum.DeviceWH += b.TotalWH - a.TotalWH
+			}
+		}
+		span := b.When.Sub(a.When)
+		if g.Interval > 0 && span > g.Interval*3/2 {
+			sum.Missed += int((span+g.Interval/2)/g.Interval) - 1
+		}
+		if gap > 0 && span > gap {
+			continue
+		}
+		d := end.Sub(start)
+		mean := (powerAt(a, b, start) + powerAt(a, b, end)) / 2
+		sum.EnergyMWH += mean * d.Hours()
+		sum.Covered += d
+		if mean >= float64(g.OnMW) {
+			on += d
+		}
+	}
+	if sum.Covered > 0 {
+		sum.MeanMW = sum.EnergyMWH / sum.Covered.Hours()
+		sum.DutyCycle = float64(on) / float64(sum.Covered)
+	}
+	return sum
+}
+
+// PollEMon reads the device's E-Meter at a fixed rate, every
+// interval, and passes each reading to fn. A failed reading is
+// passed to fn as a nil *EMeterResponse with a non-nil error. The
+// polling stops when fn returns false.
+func (c *Conn) PollEMon(every time.Duration, fn func(when time.Time, s *EMeterResponse, err error) bool) {
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+	for {
+		s, err := c.EMonState()
+		if !fn(time.Now(), s, err) {
+			return
+		}
+		<-tick.C
+	}
+}
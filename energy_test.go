@@ -0,0 +1,132 @@
+package tplinky
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// reading is a sample for the Integrator tests, at a number of
+// seconds after t0.
+type reading struct {
+	sec, mw, wh int
+}
+
+func TestIntegratorSummary(t *testing.T) {
+	t0 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	at := func(sec int) time.Time { return t0.Add(time.Duration(sec) * time.Second) }
+	tests := []struct {
+		name     string
+		g        Integrator
+		readings []reading
+		from, to time.Time
+		want     EnergySummary
+	}{
+		{
+			name:     "constant",
+			g:        Integrator{Interval: 10 * time.Second, OnMW: 1000},
+			readings: []reading{{0, 60000, 0}, {10, 60000, 0}, {20, 60000, 0}, {30, 60000, 0}, {40, 60000, 0}, {50, 60000, 0}, {60, 60000, 1}},
+			want: EnergySummary{Samples: 7, Covered: time.Minute, MinMW: 60000, MaxMW: 60000, MeanMW: 60000,
+				EnergyMWH: 1000, DutyCycle: 1, DeviceWH: 1},
+		},
+		{
+			name:     "trapezoid",
+			readings: []reading{{0, 0, 0}, {3600, 3600, 0}},
+			want:     EnergySummary{Samples: 2, Covered: time.Hour, MaxMW: 3600, MeanMW: 1800, EnergyMWH: 1800, DutyCycle: 1},
+		},
+		{
+			name:     "clipped to window",
+			readings: []reading{{0, 0, 0}, {3600, 3600, 0}},
+			from:     at(0),
+			to:       at(1800),
+			want:     EnergySummary{From: at(0), To: at(1800), Samples: 1, Covered: 30 * time.Minute, MeanMW: 900, EnergyMWH: 450, DutyCycle: 1},
+		},
+		{
+			name:     "gap cutoff",
+			g:        Integrator{Interval: 10 * time.Second},
+			readings: []reading{{0, 3600, 0}, {10, 3600, 0}, {20, 3600, 0}, {100, 3600, 0}, {110, 3600, 0}},
+			want: EnergySummary{Samples: 5, Missed: 7, Covered: 30 * time.Second, MinMW: 3600, MaxMW: 3600,
+				MeanMW: 3600, EnergyMWH: 30, DutyCycle: 1},
+		},
+		{
+			name:     "explicit gap",
+			g:        Integrator{MaxGap: time.Minute},
+			readings: []reading{{0, 3600, 0}, {60, 3600, 0}, {200, 3600, 0}},
+			want:     EnergySummary{Samples: 3, Covered: time.Minute, MinMW: 3600, MaxMW: 3600, MeanMW: 3600, EnergyMWH: 60, DutyCycle: 1},
+		},
+		{
+			name:     "counter reset",
+			readings: []reading{{0, 0, 5}, {10, 0, 7}, {20, 0, 1}, {30, 0, 3}},
+			want:     EnergySummary{Samples: 4, Covered: 30 * time.Second, Resets: 1, DeviceWH: 5, DutyCycle: 1},
+		},
+		{
+			name:     "duty cycle",
+			g:        Integrator{OnMW: 1000},
+			readings: []reading{{0, 2000, 0}, {10, 2000, 0}, {20, 0, 0}, {30, 0, 0}},
+			want: EnergySummary{Samples: 4, Covered: 30 * time.Second, MaxMW: 2000, MeanMW: 1000,
+				EnergyMWH: 1000 * 30.0 / 3600, DutyCycle: 2.0 / 3},
+		},
+	}
+	near := func(a, b float64) bool { return math.Abs(a-b) < 1e-6 }
+	for _, tc := range tests {
+		g := tc.g
+		for _, r := range tc.readings {
+			g.Add(at(r.sec), &EMeterResponse{PowerMW: r.mw, TotalWH: r.wh})
+		}
+		got := g.Summary(tc.from, tc.to)
+		w := tc.want
+		if !near(got.EnergyMWH, w.EnergyMWH) || !near(got.MeanMW, w.MeanMW) || !near(got.DutyCycle, w.DutyCycle) {
+			t.Errorf("%s: got energy=%g mean=%g duty=%g, want %g %g %g", tc.name,
+				got.EnergyMWH, got.MeanMW, got.DutyCycle, w.EnergyMWH, w.MeanMW, w.DutyCycle)
+		}
+		got.EnergyMWH, got.MeanMW, got.DutyCycle = w.EnergyMWH, w.MeanMW, w.DutyCycle
+		if got != w {
+			t.Errorf("%s: got %+v\nwant %+v", tc.name, got, w)
+		}
+	}
+}
+
+func TestIntegratorAdd(t *testing.T) {
+	t0 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	g := &Integrator{Keep: time.Minute}
+	for _, sec := range []int{0, 30, 20, 30, 60, 90} {
+		g.Add(t0.Add(time.Duration(sec)*time.Second), &EMeterResponse{PowerMW: sec})
+	}
+	g.Add(t0.Add(2*time.Minute), nil)
+	var got []int
+	for _, s := range g.Samples() {
+		got = append(got, s.PowerMW)
+	}
+	if len(got) != 3 || got[0] != 30 || got[1] != 60 || got[2] != 90 {
+		t.Errorf("got samples %v, want [30 60 90]", got)
+	}
+}
+
+func TestPollEMon(t *testing.T) {
+	n := 0
+	addr := fakeDevice(t, func(req map[string]interface{}) interface{} {
+		n++
+		return map[string]interface{}{
+			"emeter": map[string]interface{}{
+				"get_realtime": map[string]interface{}{"power_mw": 1000 * n, "total_wh": n},
+			},
+		}
+	})
+	c, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	g := &Integrator{}
+	c.PollEMon(time.Millisecond, func(when time.Time, s *EMeterResponse, err error) bool {
+		if err != nil {
+			t.Fatalf("reading failed: %v", err)
+		}
+		g.Add(when, s)
+		return len(g.Samples()) < 3
+	})
+	ss := g.Samples()
+	if len(ss) != 3 || ss[0].PowerMW != 1000 || ss[2].TotalWH != 3 {
+		t.Errorf("got samples %+v, want 3 increasing readings", ss)
+	}
+}
@@ -5,12 +5,17 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"zappem.net/pub/net/tplinky"
@@ -27,14 +32,115 @@ var (
 	sockets   = flag.String("sockets", "", "comma separated socket indexes")
 	getTime   = flag.Bool("time", false, "request time from --device")
 	setNow    = flag.Bool("set-now", false, "set time on --device from time.Now()")
+	location  = flag.String("location", "", "set the latitude,longitude (degrees) of --device")
+	sun       = flag.Bool("sun", false, "show today's sun times at the location of --device")
+	zone      = flag.String("zone", "", "set the timezone of --device, e.g. America/Los_Angeles or Local")
 	alias     = flag.String("alias", "", "set alias for --device")
 	factory   = flag.Bool("factory-reset", false, "factory reset --device")
+	yes       = flag.Bool("yes", false, "skip the confirmation prompt of --factory-reset")
 	ssid      = flag.String("ssid", "", "sets the WiFi network for --device to connect to")
 	password  = flag.String("password", "", "password to connect to --ssid network")
+	joinScan  = flag.String("join-scan", "", "after --ssid, scan this network (<ip>/<bits>) until --device appears on it")
+	joinWait  = flag.Duration("join-wait", 2*time.Minute, "how long --join-scan waits for --device to appear")
+	keyType   = flag.Int("key-type", 3, "key type of an --ssid network that --device cannot see, or -1 to require that it sees it")
 	emon      = flag.Bool("emon", false, "read the current E-Meter status")
 	emonReset = flag.Bool("emon-reset", false, "reset the E-Meter state")
 	poll      = flag.Duration("poll", 0, "polling time interval for E-Meter reads")
 	wifi      = flag.Bool("wifi", false, "show results of WiFi scan")
+	forTime   = flag.Duration("for", 0, "with --on or --off, arm an on-device countdown to switch back after this long")
+	countdown = flag.Bool("countdowns", false, "list the on-device countdown rules of --device")
+	cancel    = flag.Bool("cancel-countdown", false, "cancel the on-device countdown rules of --device")
+	cycleOff  = flag.Duration("cycle", 0, "power cycle --device, switching it off for this long")
+	reboot    = flag.Bool("reboot", false, "reboot --device and wait for it to come back online")
+	backup    = flag.String("backup", "", "save the configuration of --device to this JSON file")
+	restore   = flag.String("restore", "", "apply a --backup file to --device (preview with --dry-run)")
+
+	emonWindow = flag.Duration("emon-window", 0, "with --emon --poll, summarize power over this window")
+	emonOn     = flag.Float64("emon-on", 1, "power (W) above which a load counts as on for --emon-window duty cycle")
+
+	history = flag.String("history", "", "directory of the local history store for recording and --report")
+	report  = flag.String("report", "", "summarize --history of --device: hourly or daily")
+	since   = flag.Duration("since", 24*time.Hour, "how far back --report looks")
+	compact = flag.Duration("compact", 0, "compact --history records older than this into rollups")
+
+	inventory = flag.String("inventory", "", "JSON inventory file of known devices, updated by --scan")
+	labels    = flag.String("labels", "", "comma separated labels to record for --device in --inventory")
+	cost      = flag.String("cost", "", "JSON or YAML tariff file used to report this month's energy cost")
+
+	watch      = flag.Bool("watch", false, "watch --device E-Meter (every --poll) for appliance cycles")
+	cycleStart = flag.Float64("cycle-start", 10, "--watch power (W) at or above which a cycle starts")
+	cycleStop  = flag.Float64("cycle-stop", 3, "--watch power (W) below which a cycle finishes")
+	minStart   = flag.Duration("cycle-min-start", 30*time.Second, "--watch duration above --cycle-start to start a cycle")
+	minStop    = flag.Duration("cycle-min-stop", 5*time.Minute, "--watch duration below --cycle-stop to finish a cycle")
+	idleAfter  = flag.Duration("cycle-idle", 0, "--watch reports idle this long after a cycle finishes")
+	notify     = flag.String("notify", "", "shell command run for each --watch event with TPLE_EVENT etc in its environment")
+
+	label      = flag.String("label", "", "act on the --inventory devices carrying this label instead of --device")
+	protect    = flag.Bool("protect", false, "switch off --device or --label devices that exceed --max-amps or --max-watts")
+	maxAmps    = flag.Float64("max-amps", 0, "--protect current limit (A)")
+	maxWatts   = flag.Float64("max-watts", 0, "--protect power limit (W)")
+	protectFor = flag.Duration("protect-for", 5*time.Second, "how long a --protect limit must be exceeded before switching off")
+	dryRun     = flag.Bool("dry-run", false, "only report what would be switched")
+
+	circuit    = flag.String("circuit", "", "shed loads of the --inventory devices with this label to keep within --budget-amps")
+	budgetAmps = flag.Float64("budget-amps", 15, "--circuit combined current budget (A)")
+	marginAmps = flag.Float64("margin-amps", 1, "--circuit headroom (A) required to restore a shed load")
+	shedOrder  = flag.String("shed-order", "", "comma separated --circuit devices (address, MAC or alias) to shed first")
+	shedHold   = flag.Duration("shed-hold", time.Minute, "how long --circuit headroom must last to restore a load")
+	shedMinOff = flag.Duration("shed-min-off", 5*time.Minute, "minimum time a --circuit load stays shed")
+
+	standby      = flag.Bool("standby", false, "switch off --device or --label devices left in standby")
+	standbyWatts = flag.Float64("standby-watts", 0, "--standby power threshold (W), learned from --history if zero")
+	standbyAfter = flag.Duration("standby-after", 10*time.Minute, "how long in standby before switching off")
+	wakeAt       = flag.String("wake", "", "comma separated HH:MM times to switch --standby devices back on")
+
+	voltage  = flag.Bool("voltage", false, "monitor mains voltage seen by --device or --label devices")
+	nominal  = flag.Float64("nominal", 120, "--voltage nominal mains voltage (VAC)")
+	sagPct   = flag.Float64("sag-pct", 10, "--voltage percentage below --nominal that is a sag")
+	swellPct = flag.Float64("swell-pct", 10, "--voltage percentage above --nominal that is a swell")
+
+	signalURL   = flag.String("signal-url", "", "switch --device or --label devices from a number served at this URL")
+	signalFile  = flag.String("signal-file", "", "switch --device or --label devices from a number read from this file")
+	signalCmd   = flag.String("signal-cmd", "", "switch --device or --label devices from a number output by this shell command")
+	signalField = flag.String("signal-field", "", "dot separated path to the signal number within a JSON document")
+	onAbove     = flag.Float64("on-above", 0, "switch on when the signal rises above this value")
+	offBelow    = flag.Float64("off-below", 0, "switch off when the signal falls below this value")
+	minOn       = flag.Duration("min-on", 5*time.Minute, "minimum time signal switched devices stay on")
+	minOff      = flag.Duration("min-off", 5*time.Minute, "minimum time signal switched devices stay off")
+	failOff     = flag.Bool("fail-off", true, "switch signal switched devices off when the signal is unavailable")
+
+	prices      = flag.String("prices", "", "CSV file or URL of hourly prices used to run --device or --label devices in the cheapest hours")
+	runHours    = flag.Duration("run-hours", 4*time.Hour, "how long --prices devices must run each day")
+	window      = flag.String("window", "00:00-00:00", "HH:MM-HH:MM time of day window within which --prices devices may run")
+	planOnboard = flag.Bool("plan-onboard", false, "write the --prices plan into the devices' schedules and exit")
+
+	rules       = flag.Bool("rules", false, "list the on-device schedule rules of --device")
+	rule        = flag.String("rule", "", "add a schedule rule to --device, e.g. \"on sunset+15 off 23:00 weekdays\"")
+	ruleID      = flag.String("rule-id", "", "replace the schedule rule with this id by --rule")
+	ruleName    = flag.String("rule-name", "", "name of the --rule")
+	deleteRule  = flag.String("delete-rule", "", "delete the schedule rule with this id from --device")
+	deleteRules = flag.Bool("delete-rules", false, "delete all schedule rules from --device")
+	schedule    = flag.String("schedule", "", "enable (on) or disable (off) the whole schedule of --device")
+
+	compile = flag.String("compile", "", "JSON rule set to compile into the on-device schedules of the devices it names")
+
+	timeSync      = flag.Bool("timesync", false, "check, and correct, the clocks of --device, --label or all --inventory devices")
+	syncThreshold = flag.Duration("sync-threshold", 2*time.Second, "--timesync corrects clocks that are off by more than this")
+	drift         = flag.Bool("drift", false, "report the clock drift of --timesync devices recorded in --history")
+
+	away = flag.String("away", "", "away mode for --device or --label devices: list, on, off or a window such as \"sunset-23:00 daily\"")
+
+	survey       = flag.Int("survey", 0, "sample the WiFi signal of --device, --label or all --inventory devices this many times, every --poll")
+	surveyAPs    = flag.Bool("survey-aps", false, "also record the access points each --survey device can see")
+	surveyOut    = flag.String("survey-out", "", "export the --survey to this .csv or .json file")
+	weakRSSI     = flag.Int("weak-rssi", tplinky.WeakRSSI, "--survey flags devices with a mean RSSI (dBm) below this")
+	surveySpread = flag.Float64("survey-stddev", 5, "--survey flags devices whose RSSI standard deviation (dB) exceeds this")
+
+	provision = flag.String("provision", "", "JSON plan applied to a new --device in setup mode, recorded in --inventory")
+	journal   = flag.String("journal", "", "file recording --provision progress, for resuming (default <plan>.journal)")
+
+	led   = flag.String("led", "", "switch the status LED of --device or --label devices on or off")
+	night = flag.String("night", "", "HH:MM-HH:MM window each night in which --device or --label device LEDs are kept off")
 )
 
 // status converts a device Sysinfo status into a string.
@@ -52,9 +158,83 @@ func status(dev *tplinky.Sysinfo) string {
 	return fmt.Sprintf("%s on=%-5v %q #children=%d", dev.Mac, dev.RelayState != 0, dev.Alias, len(dev.Children))
 }
 
+// costReport logs the cost of this month's energy consumption of the
+// targets.
+func costReport(tariff *tplinky.Tariff, targets []string, inv *tplinky.Inventory) {
+	now := time.Now()
+	usage := make(map[string][]tplinky.Usage)
+	for _, target := range targets {
+		dev, err := tplinky.DialTimeout(target, *timeout)
+		if err != nil {
+			log.Printf("failed to connect to %q: %v", target, err)
+			continue
+		}
+		// The device keeps its daily totals in its own timezone.
+		loc, err := dev.GetTimeZone()
+		if err != nil {
+			log.Printf("failed to read %q timezone, assuming local time: %v", target, err)
+			loc = time.Local
+		}
+		day := now.In(loc)
+		stats, err := dev.DayStats(day.Year(), day.Month())
+		dev.Close()
+		if err != nil {
+			log.Printf("failed to read %q energy history: %v", target, err)
+			continue
+		}
+		usage[target] = tplinky.UsageFromDayStats(stats, loc)
+	}
+	lines, err := tplinky.CostReport(tariff, usage, inv)
+	if err != nil {
+		log.Fatalf("unable to compute cost: %v", err)
+	}
+	for _, line := range lines {
+		name := line.Device
+		if name == "" {
+			name = "label:" + line.Label
+		}
+		log.Printf("%-20s %8.3fkWH %8.2f%s", name, line.EnergyWH/1e3, line.Cost.Cost, tariff.Currency)
+		var periods []string
+		for p := range line.ByPeriod {
+			periods = append(periods, p)
+		}
+		sort.Strings(periods)
+		for _, p := range periods {
+			log.Printf("  %-18s %8.3fkWH %8.2f%s", p, line.EnergyByPeriod[p]/1e3, line.ByPeriod[p], tariff.Currency)
+		}
+	}
+}
+
+// targets returns the devices selected by --device, or by --label
+// from the --inventory.
+func targets(inv *tplinky.Inventory) []string {
+	if *label == "" {
+		return []string{*device}
+	}
+	if inv == nil {
+		log.Fatal("--label requires --inventory")
+	}
+	var ts []string
+	for _, d := range inv.Labeled(*label) {
+		ts = append(ts, d.Addr)
+	}
+	if len(ts) == 0 {
+		log.Fatalf("no --inventory devices have label %q", *label)
+	}
+	return ts
+}
+
 func main() {
 	flag.Parse()
 
+	var inv *tplinky.Inventory
+	if *inventory != "" {
+		var err error
+		if inv, err = tplinky.LoadInventory(*inventory); err != nil {
+			log.Fatalf("unable to load inventory %q: %v", *inventory, err)
+		}
+	}
+
 	if *scan != "" {
 		devices := tplinky.Scan(*scan, *timeout)
 		if len(devices) == 0 {
@@ -62,6 +242,14 @@ func main() {
 		}
 		for ip, dev := range devices {
 			log.Printf("%s: %s", ip, status(dev))
+			if inv != nil {
+				inv.Update(ip, dev)
+			}
+		}
+		if inv != nil {
+			if err := inv.Save(*inventory); err != nil {
+				log.Fatalf("unable to save inventory %q: %v", *inventory, err)
+			}
 		}
 		os.Exit(0)
 	}
@@ -82,12 +270,786 @@ func main() {
 		}
 	}
 
+	if *cost != "" {
+		tariff, err := tplinky.LoadTariff(*cost)
+		if err != nil {
+			log.Fatalf("unable to load tariff %q: %v", *cost, err)
+		}
+		var addrs []string
+		if *device != "" || *label != "" {
+			addrs = targets(inv)
+		} else if inv != nil {
+			for _, d := range inv.Devices {
+				addrs = append(addrs, d.Addr)
+			}
+		} else {
+			log.Fatal("--cost requires --device or --inventory")
+		}
+		costReport(tariff, addrs, inv)
+		return
+	}
+
+	if *protect {
+		every := *poll
+		if every == 0 {
+			every = time.Second
+		}
+		p := &tplinky.Protector{
+			DryRun:  *dryRun,
+			Timeout: *timeout,
+			Log: func(e tplinky.ProtectEvent) {
+				log.Print(e)
+			},
+		}
+		for _, target := range targets(inv) {
+			p.Limits = append(p.Limits, &tplinky.Limit{
+				Outlet: tplinky.Outlet{Addr: target, Sockets: indexes},
+				MaxMA:  int(*maxAmps * 1e3),
+				MaxMW:  int(*maxWatts * 1e3),
+				For:    *protectFor,
+			})
+		}
+		// A SIGHUP clears all of the lockouts.
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				for _, l := range p.Limits {
+					p.Reset(l.Outlet)
+				}
+			}
+		}()
+		log.Printf("protecting %d outlet(s); send SIGHUP to pid %d to reset lockouts", len(p.Limits), os.Getpid())
+		p.Run(every, nil)
+		return
+	}
+
+	if *circuit != "" {
+		if inv == nil {
+			log.Fatal("--circuit requires --inventory")
+		}
+		every := *poll
+		if every == 0 {
+			every = 5 * time.Second
+		}
+		var order []string
+		if *shedOrder != "" {
+			order = strings.Split(*shedOrder, ",")
+		}
+		c := tplinky.CircuitFromInventory(inv, *circuit, int(*budgetAmps*1e3), order...)
+		if len(c.Loads) == 0 {
+			log.Fatalf("no --inventory devices have label %q", *circuit)
+		}
+		c.MarginMA = int(*marginAmps * 1e3)
+		c.Hold = *shedHold
+		c.MinOff = *shedMinOff
+		c.DryRun = *dryRun
+		c.Timeout = *timeout
+		c.Log = func(e tplinky.ShedEvent) {
+			log.Print(e)
+		}
+		log.Printf("budgeting %.1fA across %v", *budgetAmps, c.Loads)
+		c.Run(every, nil)
+		return
+	}
+
+	if *standby {
+		every := *poll
+		if every == 0 {
+			every = 30 * time.Second
+		}
+		var wakes []string
+		if *wakeAt != "" {
+			wakes = strings.Split(*wakeAt, ",")
+		}
+		var store *tplinky.Store
+		if *standbyWatts == 0 {
+			if *history == "" {
+				log.Fatal("--standby requires --standby-watts or --history to learn from")
+			}
+			var err error
+			if store, err = tplinky.OpenStore(*history); err != nil {
+				log.Fatalf("unable to open history %q: %v", *history, err)
+			}
+		}
+		// A SIGHUP switches the devices back on.
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		var wake []chan struct{}
+		for _, target := range targets(inv) {
+			s := &tplinky.Standby{
+				Outlet:      tplinky.Outlet{Addr: target, Sockets: indexes},
+				ThresholdMW: int(*standbyWatts * 1e3),
+				After:       *standbyAfter,
+				WakeAt:      wakes,
+				Timeout:     *timeout,
+				Log: func(e tplinky.StandbyEvent) {
+					log.Print(e)
+				},
+			}
+			if err := s.Validate(); err != nil {
+				log.Fatalf("bad --wake %q: %v", *wakeAt, err)
+			}
+			if store != nil {
+				baseline, err := s.Learn(store, target, time.Now().Add(-*since), time.Now())
+				if err != nil {
+					log.Fatalf("unable to learn standby power of %q: %v", target, err)
+				}
+				log.Printf("%s: standby baseline %.3fW, threshold %.3fW", target, float64(baseline)/1e3, float64(s.ThresholdMW)/1e3)
+			}
+			ch := make(chan struct{}, 1)
+			wake = append(wake, ch)
+			go s.Run(every, ch, nil)
+		}
+		log.Printf("send SIGHUP to pid %d to switch devices back on", os.Getpid())
+		for range hup {
+			for _, ch := range wake {
+				select {
+				case ch <- struct{}{}:
+				default:
+				}
+			}
+		}
+		return
+	}
+
+	if *voltage {
+		every := *poll
+		if every == 0 {
+			every = 5 * time.Second
+		}
+		m := &tplinky.VoltageMonitor{
+			Devices:   targets(inv),
+			NominalMV: int(*nominal * 1e3),
+			SagPct:    *sagPct,
+			SwellPct:  *swellPct,
+			Timeout:   *timeout,
+			Log: func(e tplinky.VoltageEvent) {
+				if e.End.IsZero() {
+					log.Printf("%s started", e)
+				} else {
+					log.Printf("%s ended", e)
+				}
+			},
+			LogError: func(device string, err error) {
+				log.Printf("%s: voltage not read: %v", device, err)
+			},
+		}
+		day := time.Now()
+		tick := time.NewTicker(every)
+		for {
+			m.Sample()
+			if now := time.Now(); now.Day() != day.Day() {
+				pq := m.DailySummary(day)
+				log.Printf("power quality for %s:", pq.Day.Format("2006-01-02"))
+				for _, d := range m.Devices {
+					st := pq.Devices[d]
+					if st == nil {
+						continue
+					}
+					log.Printf("  %s: %.1f/%.1f/%.1fVAC (min/mean/max) sags=%d (%v) swells=%d (%v) outages=%d (%v)", d,
+						float64(st.MinMV)/1e3, st.MeanMV()/1e3, float64(st.MaxMV)/1e3,
+						st.Sags, st.SagTime.Round(time.Second), st.Swells, st.SwellTime.Round(time.Second), st.Outages, st.OutageTime.Round(time.Second))
+				}
+				for _, g := range pq.Correlated {
+					log.Printf("  %s seen by %d devices at %s", g[0].Kind, len(g), g[0].Start.Format("15:04:05"))
+				}
+				m.Forget(now.AddDate(0, 0, -1))
+				day = now
+			}
+			<-tick.C
+		}
+	}
+
+	if *signalURL != "" || *signalFile != "" || *signalCmd != "" {
+		every := *poll
+		if every == 0 {
+			every = 30 * time.Second
+		}
+		sw := &tplinky.SignalSwitch{
+			OnAbove:  *onAbove,
+			OffBelow: *offBelow,
+			MinOn:    *minOn,
+			MinOff:   *minOff,
+			FailOff:  *failOff,
+			Timeout:  *timeout,
+			Log: func(e tplinky.SignalEvent) {
+				log.Print(e)
+			},
+		}
+		switch {
+		case *signalURL != "":
+			sw.Signal = &tplinky.HTTPSignal{URL: *signalURL, Field: *signalField}
+		case *signalFile != "":
+			sw.Signal = &tplinky.FileSignal{Path: *signalFile, Field: *signalField}
+		default:
+			sw.Signal = &tplinky.CommandSignal{Args: []string{"sh", "-c", *signalCmd}, Field: *signalField}
+		}
+		for _, target := range targets(inv) {
+			sw.Outlets = append(sw.Outlets, tplinky.Outlet{Addr: target, Sockets: indexes})
+		}
+		sw.Run(every, nil)
+		return
+	}
+
+	if *prices != "" {
+		every := *poll
+		if every == 0 {
+			every = time.Minute
+		}
+		clocks := strings.SplitN(*window, "-", 2)
+		if len(clocks) != 2 {
+			log.Fatalf("bad --window %q: want HH:MM-HH:MM", *window)
+		}
+		for {
+			now := time.Now()
+			from, to, err := tplinky.DailyWindow(now, clocks[0], clocks[1])
+			if err != nil {
+				log.Fatalf("bad --window %q: %v", *window, err)
+			}
+			if !to.After(now) {
+				from, to, _ = tplinky.DailyWindow(now.AddDate(0, 0, 1), clocks[0], clocks[1])
+			}
+			var series []tplinky.PricePoint
+			if strings.HasPrefix(*prices, "http://") || strings.HasPrefix(*prices, "https://") {
+				series, err = tplinky.FetchPrices(*prices, time.Local)
+			} else {
+				var f *os.File
+				if f, err = os.Open(*prices); err == nil {
+					series, err = tplinky.LoadPricesCSV(f, time.Local)
+					f.Close()
+				}
+			}
+			if err != nil {
+				log.Fatalf("unable to read prices %q: %v", *prices, err)
+			}
+			plan, err := tplinky.PlanCheapest(series, *runHours, from, to)
+			if err != nil {
+				log.Fatalf("unable to plan %v from %s to %s: %v", *runHours, from.Format("2006-01-02 15:04"), to.Format("2006-01-02 15:04"), err)
+			}
+			for _, b := range plan.Blocks() {
+				log.Printf("planned on %s to %s at %g", b.Start.Format("2006-01-02 15:04"), b.End.Format("15:04"), b.Price)
+			}
+			if *planOnboard {
+				for _, target := range targets(inv) {
+					dev, err := tplinky.DialTimeout(target, *timeout)
+					if err != nil {
+						log.Fatalf("failed to connect to %q: %v", target, err)
+					}
+					err = dev.WritePlan(plan, "tple-prices", indexes...)
+					dev.Close()
+					if err != nil {
+						log.Fatalf("failed to write plan to %q: %v", target, err)
+					}
+				}
+				return
+			}
+			r := &tplinky.PlanRunner{
+				Plan:    plan,
+				Timeout: *timeout,
+				Log: func(e tplinky.PlanEvent) {
+					log.Print(e)
+				},
+			}
+			for _, target := range targets(inv) {
+				r.Outlets = append(r.Outlets, tplinky.Outlet{Addr: target, Sockets: indexes})
+			}
+			r.Run(every, nil)
+		}
+	}
+
+	if *rules || *rule != "" || *deleteRule != "" || *deleteRules || *schedule != "" {
+		dev, err := tplinky.DialTimeout(*device, *timeout)
+		if err != nil {
+			log.Fatalf("failed to connect to %q: %v", *device, err)
+		}
+		defer dev.Close()
+		if *deleteRules {
+			if err := dev.DeleteAllScheduleRules(indexes...); err != nil {
+				log.Fatalf("failed to delete rules from %q: %v", *device, err)
+			}
+		} else if *deleteRule != "" {
+			if err := dev.DeleteScheduleRule(*deleteRule, indexes...); err != nil {
+				log.Fatalf("failed to delete rule %q from %q: %v", *deleteRule, *device, err)
+			}
+		}
+		if *rule != "" {
+			r, err := tplinky.ParseScheduleRule(*rule)
+			if err != nil {
+				log.Fatal(err)
+			}
+			r.Name = *ruleName
+			if *ruleID != "" {
+				r.ID = *ruleID
+				err = dev.EditScheduleRule(r, indexes...)
+			} else {
+				r.ID, err = dev.AddScheduleRule(r, indexes...)
+			}
+			if err != nil {
+				log.Fatalf("failed to write rule to %q: %v", *device, err)
+			}
+			log.Printf("%s %q: %s", r.ID, r.Name, r)
+		}
+		switch *schedule {
+		case "":
+		case "on", "off":
+			if err := dev.EnableSchedule(*schedule == "on", indexes...); err != nil {
+				log.Fatalf("failed to set schedule of %q %s: %v", *device, *schedule, err)
+			}
+		default:
+			log.Fatalf("bad --schedule %q: want on or off", *schedule)
+		}
+		if *rules {
+			enabled, err := dev.ScheduleEnabled(indexes...)
+			if err != nil {
+				log.Fatalf("failed to read schedule of %q: %v", *device, err)
+			}
+			rs, err := dev.ScheduleRules(indexes...)
+			if err != nil {
+				log.Fatalf("failed to read schedule of %q: %v", *device, err)
+			}
+			log.Printf("%s: schedule enabled=%v, %d rules", *device, enabled, len(rs))
+			lat, lon, err := dev.Location()
+			located := err == nil
+			if !located {
+				log.Printf("unable to get location of %q, listing rules without today's times: %v", *device, err)
+			}
+			now, err := dev.GetTime()
+			if err != nil {
+				now = time.Now()
+			}
+			for _, r := range rs {
+				when := ""
+				if located {
+					if start, end, err := r.Times(now, lat, lon); err == nil {
+						when = " (today " + start.Format("15:04")
+						if !end.IsZero() {
+							when += "-" + end.Format("15:04")
+						}
+						when += ")"
+					}
+				}
+				log.Printf("  %s %q: %s%s", r.ID, r.Name, r, when)
+			}
+		}
+		return
+	}
+
+	if *compile != "" {
+		set, err := tplinky.LoadRuleSet(*compile)
+		if err != nil {
+			log.Fatalf("unable to load rules %q: %v", *compile, err)
+		}
+		compiled, problems := tplinky.CompileRules(set, inv)
+		for _, p := range problems {
+			if errors.Is(p.Err, tplinky.ErrUnexpressible) {
+				log.Printf("skipped: %v", p)
+			} else {
+				log.Printf("error: %v", p)
+			}
+		}
+		if inv != nil {
+			// Clear out the rules of devices, and of power
+			// strip sockets, no longer named by any rule.
+			for _, d := range inv.Devices {
+				targets := []tplinky.ScheduleTarget{{Addr: d.Addr, Socket: -1}}
+				if dev, err := tplinky.DialTimeout(d.Addr, *timeout); err == nil {
+					if sys, err := dev.GetStatus(); err == nil {
+						for i := range sys.Children {
+							targets = append(targets, tplinky.ScheduleTarget{Addr: d.Addr, Socket: i})
+						}
+					}
+					dev.Close()
+				}
+				for _, t := range targets {
+					if _, ok := compiled[t]; !ok {
+						compiled[t] = nil
+					}
+				}
+			}
+		}
+		failed := len(problems) != 0
+		for _, t := range tplinky.ScheduleTargets(compiled) {
+			dev, err := tplinky.DialTimeout(t.Addr, *timeout)
+			if err != nil {
+				log.Printf("failed to connect to %q: %v", t.Addr, err)
+				failed = true
+				continue
+			}
+			changes, err := dev.SyncSchedule(t, compiled[t], "tple:", *dryRun)
+			dev.Close()
+			for _, c := range changes {
+				log.Print(c)
+			}
+			if err != nil {
+				log.Printf("%s: %v", t, err)
+				failed = true
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *away != "" {
+		var rule *tplinky.AwayRule
+		switch *away {
+		case "list", "on", "off":
+		default:
+			var err error
+			if rule, err = tplinky.ParseAwayRule(*away); err != nil {
+				log.Fatal(err)
+			}
+		}
+		failed := false
+		for _, target := range targets(inv) {
+			dev, err := tplinky.DialTimeout(target, *timeout)
+			if err != nil {
+				log.Printf("failed to connect to %q: %v", target, err)
+				failed = true
+				continue
+			}
+			switch *away {
+			case "list":
+				var rs []*tplinky.AwayRule
+				var enabled bool
+				if rs, enabled, err = dev.AwayRules(); err == nil {
+					log.Printf("%s: away enabled=%v, %d rules", target, enabled, len(rs))
+					for _, r := range rs {
+						log.Printf("  %s %q: %s", r.ID, r.Name, r)
+					}
+				}
+			case "on", "off":
+				if err = dev.EnableAway(*away == "on"); err == nil {
+					log.Printf("%s: away %s", target, *away)
+				}
+			default:
+				if _, err = dev.SetAway(rule, "tple-away"); err == nil {
+					log.Printf("%s: away %s", target, rule)
+				}
+			}
+			dev.Close()
+			if err != nil {
+				log.Printf("%s: away failed: %v", target, err)
+				failed = true
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *provision != "" {
+		if inv == nil {
+			log.Fatal("--provision requires --inventory")
+		}
+		plan, err := tplinky.LoadProvisionPlan(*provision)
+		if err != nil {
+			log.Fatalf("unable to load plan %q: %v", *provision, err)
+		}
+		path := *journal
+		if path == "" {
+			path = *provision + ".journal"
+		}
+		j, err := tplinky.LoadProvisionJournal(path)
+		if err != nil {
+			log.Fatalf("unable to load journal %q: %v", path, err)
+		}
+		p := &tplinky.Provisioner{
+			Plan:          plan,
+			Journal:       j,
+			Inventory:     inv,
+			InventoryPath: *inventory,
+			Wait:          *joinWait,
+			Timeout:       *timeout,
+			Log: func(e tplinky.ProvisionEvent) {
+				log.Print(e)
+			},
+		}
+		if *device == "" {
+			// Finish off devices that were interrupted after
+			// being sent their WiFi settings.
+			rs, err := p.Resume()
+			for _, r := range rs {
+				log.Printf("%s: provisioned as %s", r.Mac, r.Addr)
+			}
+			if err != nil {
+				log.Fatalf("unable to resume provisioning: %v", err)
+			}
+			return
+		}
+		dev, err := tplinky.DialTimeout(*device, *timeout)
+		if err != nil {
+			log.Fatalf("failed to connect to %q: %v", *device, err)
+		}
+		r, err := p.Provision(dev)
+		dev.Close()
+		if err != nil {
+			log.Fatalf("unable to provision %q: %v", *device, err)
+		}
+		log.Printf("%s: provisioned as %s", r.Mac, r.Addr)
+		return
+	}
+
+	if *led != "" {
+		if *led != "on" && *led != "off" {
+			log.Fatalf("bad --led %q: want on or off", *led)
+		}
+		failed := false
+		for _, target := range targets(inv) {
+			dev, err := tplinky.DialTimeout(target, *timeout)
+			if err != nil {
+				log.Printf("failed to connect to %q: %v", target, err)
+				failed = true
+				continue
+			}
+			err = dev.SetLED(*led == "on")
+			dev.Close()
+			if err != nil {
+				log.Printf("%s: unable to set LED: %v", target, err)
+				failed = true
+				continue
+			}
+			log.Printf("%s: LED %s", target, *led)
+		}
+		if failed {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *night != "" {
+		span := strings.SplitN(*night, "-", 2)
+		if len(span) != 2 {
+			log.Fatalf("bad --night %q: want HH:MM-HH:MM", *night)
+		}
+		n := &tplinky.NightMode{
+			Devices: targets(inv),
+			Off:     span[0],
+			On:      span[1],
+			Timeout: *timeout,
+			Log: func(e tplinky.NightEvent) {
+				log.Print(e)
+			},
+		}
+		if _, err := n.Night(time.Now()); err != nil {
+			log.Fatalf("bad --night %q: %v", *night, err)
+		}
+		every := *poll
+		if every == 0 {
+			every = time.Minute
+		}
+		n.Run(every, nil)
+		return
+	}
+
+	if *labels != "" {
+		if inv == nil {
+			log.Fatal("--labels requires --inventory")
+		}
+		dev, err := tplinky.DialTimeout(*device, *timeout)
+		if err != nil {
+			log.Fatalf("failed to connect to %q: %v", *device, err)
+		}
+		sys, err := dev.GetStatus()
+		dev.Close()
+		if err != nil {
+			log.Fatalf("failed to get status for %q: %v", *device, err)
+		}
+		d := inv.Update(*device, sys)
+		d.Labels = strings.Split(*labels, ",")
+		if err := inv.Save(*inventory); err != nil {
+			log.Fatalf("unable to save inventory %q: %v", *inventory, err)
+		}
+		log.Printf("%s: %s labels=%q", *device, status(sys), d.Labels)
+		return
+	}
+
+	var store *tplinky.Store
+	if *history != "" {
+		var err error
+		if store, err = tplinky.OpenStore(*history); err != nil {
+			log.Fatalf("unable to open history %q: %v", *history, err)
+		}
+		if *compact != 0 {
+			names, err := store.Devices()
+			if err != nil {
+				log.Fatalf("unable to list history: %v", err)
+			}
+			for _, name := range names {
+				if err := store.Compact(name, time.Now().Add(-*compact)); err != nil {
+					log.Fatalf("failed to compact history for %q: %v", name, err)
+				}
+			}
+		}
+	}
+
+	// The history of a device is recorded under its --device
+	// address, so unreachable devices can be recorded too.
+	if *report != "" {
+		if store == nil {
+			log.Fatal("--report requires --history")
+		}
+		span := tplinky.Hourly
+		switch *report {
+		case "hourly":
+		case "daily":
+			span = tplinky.Daily
+		default:
+			log.Fatalf("unrecognized --report=%q", *report)
+		}
+		from := time.Now().Add(-*since)
+		rollups, err := store.Rollups(*device, span, from, time.Time{})
+		if err != nil {
+			log.Fatalf("unable to read history: %v", err)
+		}
+		total, err := store.Aggregate(*device, from, time.Now())
+		if err != nil {
+			log.Fatalf("unable to read history: %v", err)
+		}
+		for _, r := range append(rollups, *total) {
+			log.Printf("%s %s: mean=%.3fW max=%.3fW energy=%.3fWH on=%v switched=%d rssi=%.0fdBm reachable=%d/%d",
+				r.Start.Format("2006-01-02 15:04"), r.End.Sub(r.Start).Round(time.Minute), r.MeanMW()/1e3, float64(r.MaxMW)/1e3, r.EnergyMWH/1e3,
+				time.Duration(r.OnSec)*time.Second, r.Transitions, r.MeanRSSI(), r.Reachable, r.Reachable+r.Unreachable)
+		}
+		return
+	}
+
+	if *timeSync || *drift {
+		var addrs []string
+		if *device != "" || *label != "" {
+			addrs = targets(inv)
+		} else if inv != nil {
+			for _, d := range inv.Devices {
+				addrs = append(addrs, d.Addr)
+			}
+		} else {
+			log.Fatal("--timesync requires --device or --inventory")
+		}
+		if *drift {
+			if store == nil {
+				log.Fatal("--drift requires --history")
+			}
+			for _, addr := range addrs {
+				d, err := store.DriftReport(addr, time.Now().Add(-*since), time.Time{})
+				if err != nil {
+					log.Fatalf("unable to read clock history of %q: %v", addr, err)
+				}
+				log.Print(d)
+			}
+			return
+		}
+		ts := &tplinky.TimeSync{
+			Devices:   addrs,
+			Threshold: *syncThreshold,
+			DryRun:    *dryRun,
+			Store:     store,
+			Timeout:   *timeout,
+			Log: func(r tplinky.ClockReading) {
+				log.Print(r)
+			},
+		}
+		if *poll == 0 {
+			ts.Check()
+			return
+		}
+		ts.Run(*poll, nil)
+		return
+	}
+
+	if *survey > 0 {
+		var addrs []string
+		if *device != "" || *label != "" {
+			addrs = targets(inv)
+		} else if inv != nil {
+			for _, d := range inv.Devices {
+				addrs = append(addrs, d.Addr)
+			}
+		} else {
+			log.Fatal("--survey requires --device or --inventory")
+		}
+		every := *poll
+		if every == 0 {
+			every = 30 * time.Second
+		}
+		s := &tplinky.Survey{
+			Devices:   addrs,
+			ScanAPs:   *surveyAPs,
+			Threshold: *weakRSSI,
+			MaxStdDev: *surveySpread,
+			Timeout:   *timeout,
+			Log: func(r tplinky.SurveySample) {
+				log.Print(r)
+			},
+		}
+		s.Run(every, *survey, nil)
+		for _, st := range s.Stats() {
+			log.Print(st)
+		}
+		for _, ap := range s.APStats() {
+			log.Printf("  %s sees %q: RSSI mean=%.1fdBm min=%d max=%d (seen %d times)", ap.Device, ap.SSID, ap.MeanRSSI, ap.MinRSSI, ap.MaxRSSI, ap.Seen)
+		}
+		if *surveyOut == "" {
+			return
+		}
+		f, err := os.Create(*surveyOut)
+		if err != nil {
+			log.Fatalf("unable to create %q: %v", *surveyOut, err)
+		}
+		if strings.HasSuffix(*surveyOut, ".json") {
+			err = s.WriteJSON(f)
+		} else {
+			err = s.WriteCSV(f)
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			log.Fatalf("unable to write %q: %v", *surveyOut, err)
+		}
+		return
+	}
+
 	dev, err := tplinky.DialTimeout(*device, *timeout)
 	if err != nil {
+		if store != nil {
+			store.RecordStatus(*device, time.Now(), nil, err)
+		}
 		log.Fatalf("failed to connect to %q: %v", *device, err)
 	}
 	defer dev.Close()
 
+	if *backup != "" {
+		b, err := dev.Backup()
+		if err != nil {
+			log.Fatalf("unable to back up %q: %v", *device, err)
+		}
+		if err := b.Save(*backup); err != nil {
+			log.Fatalf("unable to save backup %q: %v", *backup, err)
+		}
+		log.Printf("%s: saved %s %q (%s) to %q", *device, b.Model, b.Alias, b.DeviceID, *backup)
+		return
+	}
+	if *restore != "" {
+		b, err := tplinky.LoadBackup(*restore)
+		if err != nil {
+			log.Fatalf("unable to load backup %q: %v", *restore, err)
+		}
+		changes, err := dev.Restore(b, *dryRun)
+		for _, ch := range changes {
+			log.Printf("%s: %v", *device, ch)
+		}
+		if err != nil {
+			log.Fatalf("unable to restore %q to %q: %v", *restore, *device, err)
+		}
+		if len(changes) == 0 {
+			log.Printf("%s: already matches %q", *device, *restore)
+		}
+		return
+	}
+
 	if *wifi {
 		data, err := dev.ListWiFi()
 		if err != nil {
@@ -104,9 +1066,27 @@ func main() {
 		return
 	}
 	if *ssid != "" {
-		if err := dev.SetWiFi(*ssid, *password); err != nil {
-			log.Fatalf("unable to set WiFi to %q", *ssid)
+		var j *tplinky.Joined
+		var err error
+		if *joinScan != "" {
+			j, err = dev.JoinWiFi(*ssid, *password, *keyType, *joinScan, *joinWait)
+		} else {
+			j, err = dev.SendWiFi(*ssid, *password, *keyType)
+		}
+		if j != nil && j.AP == nil {
+			log.Printf("warning: device cannot see %q, assuming key type %d", *ssid, *keyType)
+		}
+		if j != nil && j.Weak {
+			log.Printf("warning: weak signal from %q (RSSI=%ddBm)", *ssid, j.AP.RSSI)
+		}
+		if err != nil {
+			log.Fatalf("unable to set WiFi to %q: %v", *ssid, err)
+		}
+		if j.Addr != "" {
+			log.Printf("device joined %q as %s after %v", *ssid, j.Addr, j.Took.Round(time.Second))
+			return
 		}
+		log.Printf("WiFi settings sent, but not verified that the device joined %q: use --join-scan to check", *ssid)
 		log.Printf("reconnect to device via %q WiFi network", *ssid)
 		return
 	}
@@ -124,7 +1104,27 @@ func main() {
 		if err != nil {
 			log.Fatalf("unable to get status: %v", err)
 		}
-		if err := dev.FactoryReset(); err != nil {
+		tplinky.SetPolicy(tplinky.Policy{
+			Audit: func(r tplinky.AuditRecord) {
+				log.Printf("audit: %v", r)
+				if store == nil {
+					return
+				}
+				if err := store.RecordAudit(r); err != nil {
+					log.Printf("failed to record audit: %v", err)
+				}
+			},
+		})
+		token := tplinky.ConfirmToken(s.Mac)
+		if !*yes {
+			fmt.Printf("factory reset %q (%s, %s)? type %s to confirm: ", s.Alias, *device, s.Mac, token)
+			var answer string
+			fmt.Scanln(&answer)
+			if !strings.EqualFold(answer, token) {
+				log.Fatal("factory reset not confirmed")
+			}
+		}
+		if err := dev.FactoryResetGuarded(token); err != nil {
 			log.Fatalf("failed to factory reset device: %v", err)
 		}
 		log.Printf("factory resetting device %q (%s)...", s.Alias, *device)
@@ -144,12 +1144,50 @@ func main() {
 		log.Printf("%s: %s", *device, status(s))
 		return
 	}
+	if *location != "" {
+		var lat, lon float64
+		if _, err := fmt.Sscanf(*location, "%g,%g", &lat, &lon); err != nil {
+			log.Fatalf("bad --location %q: want <latitude>,<longitude>", *location)
+		}
+		if err := dev.SetLocation(lat, lon); err != nil {
+			log.Fatalf("unable to set location: %v", err)
+		}
+	}
+	if *sun || *location != "" {
+		lat, lon, err := dev.Location()
+		if err != nil {
+			log.Fatalf("unable to get location: %v", err)
+		}
+		now, err := dev.GetTime()
+		if err != nil {
+			now = time.Now()
+		}
+		s := tplinky.Sun(now, lat, lon)
+		clock := func(t time.Time) string {
+			if t.IsZero() {
+				return "none"
+			}
+			return t.Format("15:04:05")
+		}
+		log.Printf("%.4f,%.4f on %s: dawn=%s sunrise=%s noon=%s sunset=%s dusk=%s", lat, lon, now.Format("2006-01-02 MST"),
+			clock(s.Dawn), clock(s.Sunrise), clock(s.Noon), clock(s.Sunset), clock(s.Dusk))
+		return
+	}
+	if *zone != "" {
+		loc, err := time.LoadLocation(*zone)
+		if err != nil {
+			log.Fatalf("unrecognized --zone %q: %v", *zone, err)
+		}
+		if err := dev.SetTimeZone(loc); err != nil {
+			log.Fatalf("unable to set timezone: %v", err)
+		}
+	}
 	if *setNow {
 		if err := dev.SetTime(time.Now()); err != nil {
 			log.Fatalf("unable to set current time: %v", err)
 		}
 	}
-	if *getTime || *setNow {
+	if *getTime || *setNow || *zone != "" {
 		t, err := dev.GetTime()
 		if err != nil {
 			log.Fatalf("unable to get time: %v", err)
@@ -157,20 +1195,137 @@ func main() {
 		log.Printf("device time is %v", t)
 		return
 	}
+	if *watch {
+		every := *poll
+		if every == 0 {
+			every = 10 * time.Second
+		}
+		d := &tplinky.CycleDetector{
+			StartMW:   int(*cycleStart * 1e3),
+			StopMW:    int(*cycleStop * 1e3),
+			MinStart:  *minStart,
+			MinStop:   *minStop,
+			IdleAfter: *idleAfter,
+		}
+		dev.PollEMon(every, func(when time.Time, s *tplinky.EMeterResponse, err error) bool {
+			if err != nil {
+				log.Printf("failed to get E-Monitor state: %v", err)
+				return true
+			}
+			for _, e := range d.Add(when, s) {
+				if e.Type == tplinky.CycleFinished {
+					log.Printf("%s: cycle finished after %v using %.3fWH (peak %.3fW)", *device, e.Duration.Round(time.Second), e.EnergyMWH/1e3, float64(e.PeakMW)/1e3)
+				} else {
+					log.Printf("%s: cycle %v", *device, e.Type)
+				}
+				if *notify == "" {
+					continue
+				}
+				cmd := exec.Command("sh", "-c", *notify)
+				cmd.Env = append(os.Environ(),
+					"TPLE_DEVICE="+*device,
+					"TPLE_EVENT="+e.Type.String(),
+					fmt.Sprintf("TPLE_DURATION=%d", int(e.Duration.Seconds())),
+					fmt.Sprintf("TPLE_ENERGY_WH=%.3f", e.EnergyMWH/1e3),
+				)
+				cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+				if err := cmd.Run(); err != nil {
+					log.Printf("--notify command failed: %v", err)
+				}
+			}
+			return true
+		})
+		return
+	}
 	if *emon {
-		for {
+		if *poll == 0 {
 			s, err := dev.EMonState()
 			if err != nil {
 				log.Fatalf("failed to get E-Monitor state: %v", err)
 			}
 			log.Printf("%.3fA %.3fVAC %.3fW %dWH", float64(s.CurrentMA)/1e3, float64(s.VoltageMV)/1e3, float64(s.PowerMW)/1e3, s.TotalWH)
-			if *poll == 0 {
-				break
-			}
-			time.Sleep(*poll)
+			return
+		}
+		g := &tplinky.Integrator{
+			Interval: *poll,
+			OnMW:     int(*emonOn * 1e3),
+			Keep:     *emonWindow + 2**poll,
 		}
+		started := time.Now()
+		var total float64
+		var last time.Time
+		dev.PollEMon(*poll, func(when time.Time, s *tplinky.EMeterResponse, err error) bool {
+			if err != nil {
+				log.Printf("failed to get E-Monitor state: %v", err)
+				return true
+			}
+			g.Add(when, s)
+			if store != nil {
+				if err := store.RecordEMon(*device, when, s); err != nil {
+					log.Printf("failed to record history: %v", err)
+				}
+			}
+			if !last.IsZero() {
+				total += g.Summary(last, time.Time{}).EnergyMWH
+			}
+			last = when
+			log.Printf("%.3fA %.3fVAC %.3fW %dWH (%.3fmWH)", float64(s.CurrentMA)/1e3, float64(s.VoltageMV)/1e3, float64(s.PowerMW)/1e3, s.TotalWH, total)
+			if *emonWindow != 0 && when.Sub(started) >= *emonWindow {
+				started = when
+				sum := g.Summary(when.Add(-*emonWindow), time.Time{})
+				log.Printf("last %v: min=%.3fW max=%.3fW mean=%.3fW energy=%.3fmWH duty=%.1f%% missed=%d", *emonWindow, float64(sum.MinMW)/1e3, float64(sum.MaxMW)/1e3, sum.MeanMW/1e3, sum.EnergyMWH, 100*sum.DutyCycle, sum.Missed)
+			}
+			return true
+		})
 		return
 	}
+	if *reboot {
+		addr := dev.Addr()
+		down, err := dev.Reboot(time.Second)
+		if err != nil {
+			log.Fatalf("failed to reboot %q (a device that moves to another subnet is not found): %v", *device, err)
+		}
+		log.Printf("%s: rebooted, unreachable for %v", *device, down.Round(100*time.Millisecond))
+		if dev.Addr() != addr {
+			log.Printf("%s: came back at a new address, %s", *device, dev.Addr())
+		}
+	}
+	if *cycleOff != 0 {
+		if *on || *off {
+			log.Fatal("--cycle cannot be combined with --on or --off")
+		}
+		if err := dev.PowerCycle(*cycleOff, indexes...); err != nil {
+			log.Fatalf("failed to power cycle %q: %v", *device, err)
+		}
+	}
+	if *cancel {
+		if err := dev.DeleteAllCountdownRules(indexes...); err != nil {
+			log.Fatalf("failed to cancel countdown of %q: %v", *device, err)
+		}
+	}
+	if *forTime != 0 {
+		if *on == *off {
+			log.Fatal("--for requires one of --on or --off")
+		}
+		// Arm the countdown first, so the device switches back
+		// even if the switch below is the last thing we do.
+		if _, err := dev.Countdown(*off, *forTime, indexes...); err != nil {
+			log.Fatalf("failed to arm countdown on %q: %v", *device, err)
+		}
+	}
+	if *countdown {
+		rules, err := dev.CountdownRules(indexes...)
+		if err != nil {
+			log.Fatalf("failed to list countdowns of %q: %v", *device, err)
+		}
+		for _, r := range rules {
+			act := "off"
+			if r.Act != 0 {
+				act = "on"
+			}
+			log.Printf("%s %q: %s in %v (enabled=%v)", r.ID, r.Name, act, time.Duration(r.Remain)*time.Second, r.Enable != 0)
+		}
+	}
 	if *on {
 		if *off {
 			log.Fatal("use --on or --off not both")
@@ -193,6 +1348,9 @@ func main() {
 	}
 	if *stat {
 		sys, err := dev.GetStatus()
+		if store != nil {
+			store.RecordStatus(*device, time.Now(), sys, err)
+		}
 		if err != nil {
 			log.Fatalf("failed to get status for %q: %v", *device, err)
 		}
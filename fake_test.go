@@ -0,0 +1,376 @@
+package tplinky
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// chunked is returned by a fakeDevice handler to send its reply a
+// few bytes at a time, as a device does with long replies.
+type chunked struct {
+	reply interface{}
+	size  int
+}
+
+// hangup is returned by a fakeDevice handler to drop the connection
+// without replying, as a device does when it switches networks.
+type hangup struct{}
+
+// fakeDevice serves the device protocol on a local port, until the
+// test ends, and returns its address. Each request is decoded and
+// passed to handle, and whatever it returns is sent back as the reply.
+func fakeDevice(t *testing.T, handle func(req map[string]interface{}) interface{}) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	serveDevice(l, handle)
+	return l.Addr().String()
+}
+
+// serveDevice serves the device protocol, as fakeDevice does, on
+// the connections accepted by l until it is closed.
+func serveDevice(l net.Listener, handle func(req map[string]interface{}) interface{}) {
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				for {
+					var n [4]byte
+					if _, err := io.ReadFull(c, n[:]); err != nil {
+						return
+					}
+					body := make([]byte, binary.BigEndian.Uint32(n[:]))
+					if _, err := io.ReadFull(c, body); err != nil {
+						return
+					}
+					var req map[string]interface{}
+					if err := json.Unmarshal(Decode(append(n[:], body...)).Bytes(), &req); err != nil {
+						return
+					}
+					reply := handle(req)
+					if _, ok := reply.(hangup); ok {
+						return
+					}
+					size := 0
+					if ch, ok := reply.(chunked); ok {
+						reply, size = ch.reply, ch.size
+					}
+					resp, err := json.Marshal(reply)
+					if err != nil {
+						return
+					}
+					data := Encode(resp).Bytes()
+					for size > 0 && len(data) > size {
+						if _, err := c.Write(data[:size]); err != nil {
+							return
+						}
+						data = data[size:]
+						time.Sleep(time.Millisecond)
+					}
+					if _, err := c.Write(data); err != nil {
+						return
+					}
+				}
+			}(c)
+		}
+	}()
+}
+
+// module returns the named module of a request, or nil.
+func module(req map[string]interface{}, name string) map[string]interface{} {
+	m, _ := req[name].(map[string]interface{})
+	return m
+}
+
+// plug is the state of a fake single outlet plug. While on, it
+// draws ma from a 120V supply.
+type plug struct {
+	mu       sync.Mutex
+	on       bool
+	switches int
+	ma       int
+}
+
+// set switches the plug, as its button does, and sets its draw.
+func (p *plug) set(on bool, ma int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.on, p.ma = on, ma
+}
+
+// state returns whether the plug is on, and how often it has been
+// switched.
+func (p *plug) state() (on bool, switches int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.on, p.switches
+}
+
+// fakePlug serves a single outlet plug that reports its sysinfo and
+// E-Meter readings, and can be switched on and off.
+func fakePlug(t *testing.T) (string, *plug) {
+	p := &plug{}
+	addr := fakeDevice(t, func(req map[string]interface{}) interface{} {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		sys := module(req, "system")
+		resp := make(map[string]interface{})
+		if set, ok := sys["set_relay_state"].(map[string]interface{}); ok {
+			if on := set["state"] == 1.0; on != p.on {
+				p.on = on
+				p.switches++
+			}
+			resp["set_relay_state"] = map[string]interface{}{"err_code": 0}
+		}
+		if _, ok := sys["get_sysinfo"]; ok {
+			state := 0
+			if p.on {
+				state = 1
+			}
+			resp["get_sysinfo"] = map[string]interface{}{
+				"alias":       "fake",
+				"mac":         "50:C7:BF:00:00:01",
+				"relay_state": state,
+			}
+		}
+		if _, ok := module(req, "emeter")["get_realtime"]; ok {
+			ma := 0
+			if p.on {
+				ma = p.ma
+			}
+			return map[string]interface{}{
+				"emeter": map[string]interface{}{
+					"get_realtime": map[string]interface{}{"current_ma": ma, "voltage_mv": 120000, "power_mw": 120 * ma},
+				},
+			}
+		}
+		return map[string]interface{}{"system": resp}
+	})
+	return addr, p
+}
+
+// fakeRules holds the rules of a fake device's rule module, such as
+// schedule, count_down or anti_theft, for the device as a whole and
+// for each socket of a strip, by child ID.
+type fakeRules struct {
+	mu     sync.Mutex
+	next   int
+	enable map[string]int
+	rules  map[string][]map[string]interface{}
+}
+
+func newFakeRules() *fakeRules {
+	return &fakeRules{
+		enable: make(map[string]int),
+		rules:  make(map[string][]map[string]interface{}),
+	}
+}
+
+// add adds a rule directly, returning its ID.
+func (f *fakeRules) add(child string, rule map[string]interface{}) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.next++
+	r := map[string]interface{}{"id": fmt.Sprintf("R%d", f.next)}
+	for k, v := range rule {
+		if k != "id" {
+			r[k] = v
+		}
+	}
+	f.rules[child] = append(f.rules[child], r)
+	return r["id"].(string)
+}
+
+// list returns the rules of the device, or of a socket.
+func (f *fakeRules) list(child string) []map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]map[string]interface{}(nil), f.rules[child]...)
+}
+
+// enabled reports whether the rules of the device, or of a socket,
+// are enabled as a whole.
+func (f *fakeRules) enabled(child string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.enable[child] != 0
+}
+
+// serve answers the commands for the named module in a request, for
+// the sockets selected by its context, or nil if there are none.
+func (f *fakeRules) serve(req map[string]interface{}, name string) map[string]interface{} {
+	m := module(req, name)
+	if m == nil {
+		return nil
+	}
+	children := []string{""}
+	if ctx := module(req, "context"); ctx != nil {
+		children = nil
+		ids, _ := ctx["child_ids"].([]interface{})
+		for _, id := range ids {
+			children = append(children, id.(string))
+		}
+	}
+	resp := make(map[string]interface{})
+	for cmd, v := range m {
+		arg, _ := v.(map[string]interface{})
+		switch cmd {
+		case "get_rules":
+			f.mu.Lock()
+			rs := append([]map[string]interface{}{}, f.rules[children[0]]...)
+			resp[cmd] = map[string]interface{}{"rule_list": rs, "enable": f.enable[children[0]]}
+			f.mu.Unlock()
+		case "add_rule":
+			var id string
+			for _, child := range children {
+				id = f.add(child, arg)
+			}
+			resp[cmd] = map[string]interface{}{"id": id}
+		case "edit_rule", "delete_rule":
+			f.mu.Lock()
+			found := false
+			for _, child := range children {
+				rs := f.rules[child]
+				for i, r := range rs {
+					if r["id"] != arg["id"] {
+						continue
+					}
+					found = true
+					if cmd == "delete_rule" {
+						f.rules[child] = append(rs[:i:i], rs[i+1:]...)
+					} else {
+						rs[i] = arg
+					}
+					break
+				}
+			}
+			f.mu.Unlock()
+			if found {
+				resp[cmd] = map[string]interface{}{"err_code": 0}
+			} else {
+				resp[cmd] = map[string]interface{}{"err_code": -14, "err_msg": "entry not exist"}
+			}
+		case "delete_all_rules":
+			f.mu.Lock()
+			for _, child := range children {
+				delete(f.rules, child)
+			}
+			f.mu.Unlock()
+			resp[cmd] = map[string]interface{}{"err_code": 0}
+		case "set_overall_enable":
+			f.mu.Lock()
+			for _, child := range children {
+				f.enable[child] = int(arg["enable"].(float64))
+			}
+			f.mu.Unlock()
+			resp[cmd] = map[string]interface{}{"err_code": 0}
+		}
+	}
+	return resp
+}
+
+// strip is the state of a fake power strip, whose sockets have their
+// own schedule and countdown rules. A countdown that switches an off
+// socket on fires as soon as the strip is next asked for its status.
+type strip struct {
+	mu        sync.Mutex
+	states    []int
+	unarmed   int
+	schedule  *fakeRules
+	countdown *fakeRules
+}
+
+// childID names a socket of a fake strip.
+func childID(i int) string {
+	return fmt.Sprintf("S%d", i)
+}
+
+// armed reports whether a socket has a countdown to switch it on.
+func (s *strip) armed(i int) bool {
+	for _, r := range s.countdown.list(childID(i)) {
+		if r["enable"] == 1.0 && r["act"] == 1.0 {
+			return true
+		}
+	}
+	return false
+}
+
+// state returns the socket states, and how often a socket was
+// switched off without a countdown to switch it back on.
+func (s *strip) state() (states []int, unarmed int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int(nil), s.states...), s.unarmed
+}
+
+// fakeStrip serves a power strip with n sockets, all switched on.
+func fakeStrip(t *testing.T, n int) (string, *strip) {
+	s := &strip{schedule: newFakeRules(), countdown: newFakeRules()}
+	for i := 0; i < n; i++ {
+		s.states = append(s.states, 1)
+	}
+	addr := fakeDevice(t, func(req map[string]interface{}) interface{} {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		resp := make(map[string]interface{})
+		if r := s.schedule.serve(req, "schedule"); r != nil {
+			resp["schedule"] = r
+		}
+		if r := s.countdown.serve(req, "count_down"); r != nil {
+			resp["count_down"] = r
+		}
+		sys := module(req, "system")
+		if sys == nil {
+			return resp
+		}
+		out := make(map[string]interface{})
+		if set, ok := sys["set_relay_state"].(map[string]interface{}); ok {
+			ids, _ := module(req, "context")["child_ids"].([]interface{})
+			for i := range s.states {
+				for _, id := range ids {
+					if id != childID(i) {
+						continue
+					}
+					s.states[i] = int(set["state"].(float64))
+					if s.states[i] == 0 && !s.armed(i) {
+						s.unarmed++
+					}
+				}
+			}
+			out["set_relay_state"] = map[string]interface{}{"err_code": 0}
+		}
+		if _, ok := sys["get_sysinfo"]; ok {
+			var children []map[string]interface{}
+			for i := range s.states {
+				if s.states[i] == 0 && s.armed(i) {
+					s.states[i] = 1
+				}
+				children = append(children, map[string]interface{}{
+					"id":    childID(i),
+					"alias": fmt.Sprintf("socket %d", i),
+					"state": s.states[i],
+				})
+			}
+			out["get_sysinfo"] = map[string]interface{}{
+				"model":    "HS300(US)",
+				"mac":      "50:C7:BF:00:00:02",
+				"children": children,
+			}
+		}
+		resp["system"] = out
+		return resp
+	})
+	return addr, s
+}
@@ -0,0 +1,225 @@
+package tplinky
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrForbidden is returned for destructive commands when the
+	// Policy forbids them.
+	ErrForbidden = errors.New("destructive commands are forbidden by policy")
+
+	// ErrBadToken is returned for destructive commands given the
+	// wrong confirmation token. See ConfirmToken.
+	ErrBadToken = errors.New("confirmation token does not match device")
+
+	// ErrUnconfirmed is returned for destructive commands given no
+	// confirmation token, unless the Policy allows Unconfirmed
+	// commands.
+	ErrUnconfirmed = errors.New("destructive command needs a confirmation token")
+)
+
+// ConfirmToken returns the token that confirms a destructive command
+// is meant for the device with the MAC address. It is the last four
+// hex digits of the MAC, which a factory reset device also uses to
+// name its setup WiFi network.
+func ConfirmToken(mac string) string {
+	hex := strings.ToUpper(strings.NewReplacer(":", "", "-", "").Replace(mac))
+	if len(hex) < 4 {
+		return hex
+	}
+	return hex[len(hex)-4:]
+}
+
+// AuditRecord records a destructive command, whether or not it was
+// carried out.
+type AuditRecord struct {
+	When     time.Time `json:"t"`
+	Who      string    `json:"who"`
+	Device   string    `json:"device"`
+	Mac      string    `json:"mac,omitempty"`
+	DeviceID string    `json:"device_id,omitempty"`
+	Op       string    `json:"op"`
+	Arg      string    `json:"arg,omitempty"`
+	Err      string    `json:"err,omitempty"`
+}
+
+// String summarizes the record.
+func (r AuditRecord) String() string {
+	s := fmt.Sprintf("%s: %s %s", r.Device, r.Who, r.Op)
+	if r.Arg != "" {
+		s += fmt.Sprintf(" %q", r.Arg)
+	}
+	if r.Err != "" {
+		s += ": " + r.Err
+	} else {
+		s += ": done"
+	}
+	return s
+}
+
+// Policy controls the destructive commands: FactoryReset,
+// FactoryResetGuarded, SetMac, SetDeviceID and SetHWID.
+type Policy struct {
+	// Forbid refuses all destructive commands.
+	Forbid bool
+
+	// Unconfirmed allows destructive commands given no
+	// confirmation token, such as FactoryReset, for programs
+	// written before tokens were required.
+	Unconfirmed bool
+
+	// Who identifies the issuer of commands in the audit records.
+	// If empty, the local user and host names are used.
+	Who string
+
+	// Audit, if not nil, is called with a record of each
+	// destructive command, including refused ones.
+	Audit func(AuditRecord)
+}
+
+var (
+	policyMu sync.Mutex
+	policy   Policy
+)
+
+// SetPolicy sets the Policy for destructive commands of all
+// connections.
+func SetPolicy(p Policy) {
+	policyMu.Lock()
+	defer policyMu.Unlock()
+	policy = p
+}
+
+// who names the local user.
+func who() string {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	if host, err := os.Hostname(); err == nil {
+		name += "@" + host
+	}
+	return name
+}
+
+// guarded runs a destructive command, fn, after checking it against
+// the Policy and the confirmation token, and audits it. An empty
+// token is only accepted if the Policy allows Unconfirmed commands.
+func (c *Conn) guarded(op, arg, token string, fn func() error) error {
+	policyMu.Lock()
+	p := policy
+	policyMu.Unlock()
+	r := AuditRecord{
+		When:   time.Now(),
+		Who:    p.Who,
+		Device: strings.TrimSuffix(c.target, ":9999"),
+		Op:     op,
+		Arg:    arg,
+	}
+	if r.Who == "" {
+		r.Who = who()
+	}
+	err := ErrForbidden
+	if !p.Forbid {
+		var sys *Sysinfo
+		if sys, err = c.GetStatus(); err == nil {
+			r.Mac, r.DeviceID = sys.Mac, sys.DeviceID
+			if token == "" && !p.Unconfirmed {
+				err = ErrUnconfirmed
+			} else if token != "" && !strings.EqualFold(token, ConfirmToken(sys.Mac)) {
+				err = ErrBadToken
+			} else {
+				err = fn()
+			}
+		}
+	}
+	if err != nil {
+		r.Err = err.Error()
+	}
+	if p.Audit != nil {
+		p.Audit(r)
+	}
+	return err
+}
+
+// SetMac changes the MAC address of the device. The token must match
+// the device's current MAC address; see ConfirmToken.
+func (c *Conn) SetMac(mac, token string) error {
+	return c.guarded("set_mac_addr", mac, token, func() error {
+		_, err := c.Send(Control{
+			System: &SystemCommands{
+				SetMacAddr: &MacAddr{Mac: mac},
+			},
+		})
+		return err
+	})
+}
+
+// SetDeviceID changes the deviceId of the device. The token must
+// match the device's MAC address; see ConfirmToken.
+func (c *Conn) SetDeviceID(id, token string) error {
+	return c.guarded("set_device_id", id, token, func() error {
+		_, err := c.Send(Control{
+			System: &SystemCommands{
+				SetDeviceID: &DeviceID{DeviceID: id},
+			},
+		})
+		return err
+	})
+}
+
+// SetHWID changes the hardware ID of the device. The token must match
+// the device's MAC address; see ConfirmToken.
+func (c *Conn) SetHWID(id, token string) error {
+	return c.guarded("set_hw_id", id, token, func() error {
+		_, err := c.Send(Control{
+			System: &SystemCommands{
+				SetHWID: &HWID{HWID: id},
+			},
+		})
+		return err
+	})
+}
+
+// RecordAudit adds an audit record to the device's audit history,
+// which is kept apart from the other records.
+func (s *Store) RecordAudit(r AuditRecord) error {
+	path, err := s.path(r.Device, "audit")
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return appendJSON(path, r)
+}
+
+// AuditRecords returns the device's audit records in the window
+// [from, to).
+func (s *Store) AuditRecords(device string, from, to time.Time) ([]AuditRecord, error) {
+	path, err := s.path(device, "audit")
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var rs []AuditRecord
+	err = readJSON(path, func(line []byte) error {
+		var r AuditRecord
+		if err := json.Unmarshal(line, &r); err != nil {
+			return err
+		}
+		if inWindow(r.When, from, to) {
+			rs = append(rs, r)
+		}
+		return nil
+	})
+	return rs, err
+}
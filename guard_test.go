@@ -0,0 +1,82 @@
+package tplinky
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+// fakeResettable serves a plug that counts the factory resets it is
+// sent.
+func fakeResettable(t *testing.T) (addr string, resets func() int) {
+	var mu sync.Mutex
+	n := 0
+	addr = fakeDevice(t, func(req map[string]interface{}) interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		sys := module(req, "system")
+		resp := make(map[string]interface{})
+		if _, ok := sys["reset"]; ok {
+			n++
+			resp["reset"] = map[string]interface{}{"err_code": 0}
+		}
+		if _, ok := sys["get_sysinfo"]; ok {
+			resp["get_sysinfo"] = map[string]interface{}{
+				"mac":      "50:C7:BF:01:A2:3C",
+				"deviceId": "8006",
+			}
+		}
+		return map[string]interface{}{"system": resp}
+	})
+	return addr, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return n
+	}
+}
+
+func TestFactoryResetPolicy(t *testing.T) {
+	t.Cleanup(func() { SetPolicy(Policy{}) })
+	addr, resets := fakeResettable(t)
+	c, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var audit []AuditRecord
+	record := func(r AuditRecord) {
+		audit = append(audit, r)
+	}
+	tests := []struct {
+		policy Policy
+		reset  func() error
+		want   error
+	}{
+		{Policy{Forbid: true, Unconfirmed: true}, c.FactoryReset, ErrForbidden},
+		{Policy{Forbid: true}, func() error { return c.FactoryResetGuarded("A23C") }, ErrForbidden},
+		{Policy{}, c.FactoryReset, ErrUnconfirmed},
+		{Policy{}, func() error { return c.FactoryResetGuarded("1234") }, ErrBadToken},
+		{Policy{}, func() error { return c.FactoryResetGuarded("a23c") }, nil},
+		{Policy{Unconfirmed: true}, c.FactoryReset, nil},
+	}
+	for i, tc := range tests {
+		tc.policy.Who = "tester"
+		tc.policy.Audit = record
+		SetPolicy(tc.policy)
+		before := resets()
+		if err := tc.reset(); !errors.Is(err, tc.want) {
+			t.Errorf("%d: got %v, want %v", i, err, tc.want)
+		}
+		if sent := resets() - before; (sent == 1) != (tc.want == nil) {
+			t.Errorf("%d: %d resets sent, want one only if allowed", i, sent)
+		}
+		if len(audit) != i+1 {
+			t.Fatalf("%d: got %d audit records, want %d", i, len(audit), i+1)
+		}
+		r := audit[i]
+		if r.Op != "reset" || r.Who != "tester" || (r.Err == "") != (tc.want == nil) {
+			t.Errorf("%d: got audit record %+v", i, r)
+		}
+	}
+}
@@ -0,0 +1,635 @@
+package tplinky
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Record holds a single entry in a device's history. Only the
+// fields that were observed are present.
+type Record struct {
+	When      time.Time `json:"t"`
+	CurrentMA *int      `json:"current_ma,omitempty"`
+	VoltageMV *int      `json:"voltage_mv,omitempty"`
+	PowerMW   *int      `json:"power_mw,omitempty"`
+	TotalWH   *int      `json:"total_wh,omitempty"`
+	Relay     *int      `json:"relay,omitempty"`
+	RSSI      *int      `json:"rssi,omitempty"`
+	Reachable *bool     `json:"reachable,omitempty"`
+}
+
+// Rollup summarizes the history Records of a device over a window
+// of time, typically an hour or a day.
+type Rollup struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+
+	// E-Meter summary values. SumMW is the sum of the sampled
+	// power readings, see MeanMW.
+	Samples   int     `json:"samples,omitempty"`
+	MinMW     int     `json:"min_mw,omitempty"`
+	MaxMW     int     `json:"max_mw,omitempty"`
+	SumMW     int64   `json:"sum_mw,omitempty"`
+	MinMV     int     `json:"min_mv,omitempty"`
+	MaxMV     int     `json:"max_mv,omitempty"`
+	EnergyMWH float64 `json:"energy_mwh,omitempty"`
+
+	// Relay state summary values. Relay is the state at the End
+	// of the window, when known.
+	Transitions int  `json:"transitions,omitempty"`
+	OnSec       int  `json:"on_sec,omitempty"`
+	Relay       *int `json:"relay,omitempty"`
+
+	// Signal strength summary values.
+	RSSISamples int `json:"rssi_samples,omitempty"`
+	MinRSSI     int `json:"min_rssi,omitempty"`
+	MaxRSSI     int `json:"max_rssi,omitempty"`
+	SumRSSI     int `json:"sum_rssi,omitempty"`
+
+	// Reachability counts.
+	Reachable   int `json:"reachable,omitempty"`
+	Unreachable int `json:"unreachable,omitempty"`
+}
+
+// MeanMW returns the mean of the sampled power readings.
+func (r *Rollup) MeanMW() float64 {
+	if r.Samples == 0 {
+		return 0
+	}
+	return float64(r.SumMW) / float64(r.Samples)
+}
+
+// MeanRSSI returns the mean of the sampled RSSI readings.
+func (r *Rollup) MeanRSSI() float64 {
+	if r.RSSISamples == 0 {
+		return 0
+	}
+	return float64(r.SumRSSI) / float64(r.RSSISamples)
+}
+
+// merge folds the values of o into r.
+func (r *Rollup) merge(o *Rollup) {
+	if r.Start.IsZero() || o.Start.Before(r.Start) {
+		r.Start = o.Start
+	}
+	if o.End.After(r.End) {
+		r.End = o.End
+	}
+	if o.Samples != 0 {
+		if r.Samples == 0 || o.MinMW < r.MinMW {
+			r.MinMW = o.MinMW
+		}
+		if o.MaxMW > r.MaxMW {
+			r.MaxMW = o.MaxMW
+		}
+		if o.MinMV != 0 && (r.MinMV == 0 || o.MinMV < r.MinMV) {
+			r.MinMV = o.MinMV
+		}
+		if o.MaxMV > r.MaxMV {
+			r.MaxMV = o.MaxMV
+		}
+		r.Samples += o.Samples
+		r.SumMW += o.SumMW
+	}
+	r.EnergyMWH += o.EnergyMWH
+	r.Transitions += o.Transitions
+	r.OnSec += o.OnSec
+	if o.Relay != nil && !o.End.Before(r.End) {
+		r.Relay = o.Relay
+	}
+	if o.RSSISamples != 0 {
+		if r.RSSISamples == 0 || o.MinRSSI < r.MinRSSI {
+			r.MinRSSI = o.MinRSSI
+		}
+		if r.RSSISamples == 0 || o.MaxRSSI > r.MaxRSSI {
+			r.MaxRSSI = o.MaxRSSI
+		}
+		r.RSSISamples += o.RSSISamples
+		r.SumRSSI += o.SumRSSI
+	}
+	r.Reachable += o.Reachable
+	r.Unreachable += o.Unreachable
+}
+
+// Span selects the granularity of stored Rollups.
+type Span int
+
+const (
+	Hourly Span = iota
+	Daily
+)
+
+// Store is an append-only, file based, history of device
+// observations. Each device has its own file of raw Records, and
+// older Records are compacted into hourly and daily Rollups.
+type Store struct {
+	dir string
+
+	mu    sync.Mutex
+	relay map[string]int
+}
+
+// ErrBadDevice is returned when a Store device name is unusable.
+var ErrBadDevice = errors.New("invalid device name")
+
+// OpenStore opens, creating if needed, a history store in directory
+// dir.
+func OpenStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Store{
+		dir:   dir,
+		relay: make(map[string]int),
+	}, nil
+}
+
+// deviceName converts a device identifier, typically its MAC
+// address, into a name usable as a filename.
+func deviceName(device string) (string, error) {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		}
+		return '-'
+	}, device)
+	if name == "" || strings.Trim(name, ".") == "" {
+		return "", ErrBadDevice
+	}
+	return name, nil
+}
+
+// path returns the file used for the device's records (ext="log"),
+// rollups (ext="hourly" or "daily"), clock readings (ext="clock") or
+// audit records (ext="audit").
+func (s *Store) path(device, ext string) (string, error) {
+	name, err := deviceName(device)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.dir, name+"."+ext), nil
+}
+
+func spanExt(span Span) string {
+	if span == Daily {
+		return "daily"
+	}
+	return "hourly"
+}
+
+// Devices lists the devices that have history in the store.
+func (s *Store) Devices() ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(s.dir, "*.log"))
+	if err != nil {
+		return nil, err
+	}
+	var devices []string
+	for _, m := range matches {
+		devices = append(devices, strings.TrimSuffix(filepath.Base(m), ".log"))
+	}
+	return devices, nil
+}
+
+// appendJSON appends one JSON encoded line per value to a file.
+func appendJSON(path string, values ...interface{}) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, v := range values {
+		if err := enc.Encode(v); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeJSON atomically replaces a file with one JSON encoded line
+// per value.
+func writeJSON(path string, values ...interface{}) error {
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	if err := appendJSON(tmp, values...); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// readJSON reads a file of JSON encoded lines, calling fn to decode
+// each line. Undecodable lines, such as a partial line left by a
+// crash, are skipped. A missing file is not an error.
+func readJSON(path string, fn func([]byte) error) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		fn(sc.Bytes())
+	}
+	return sc.Err()
+}
+
+// Append adds a record to the device's history.
+func (s *Store) Append(device string, r Record) error {
+	path, err := s.path(device, "log")
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return appendJSON(path, r)
+}
+
+// RecordEMon adds an E-Meter reading to the device's history.
+func (s *Store) RecordEMon(device string, when time.Time, m *EMeterResponse) error {
+	return s.Append(device, Record{
+		When:      when,
+		CurrentMA: Int(m.CurrentMA),
+		VoltageMV: Int(m.VoltageMV),
+		PowerMW:   Int(m.PowerMW),
+		TotalWH:   Int(m.TotalWH),
+	})
+}
+
+// RecordStatus adds the result of a GetStatus call to the device's
+// history. A non-nil err records the device as unreachable. The
+// relay state is only recorded when it differs from the last
+// recorded value.
+func (s *Store) RecordStatus(device string, when time.Time, sys *Sysinfo, err error) error {
+	reachable := err == nil && sys != nil
+	r := Record{
+		When:      when,
+		Reachable: &reachable,
+	}
+	if reachable {
+		r.RSSI = Int(sys.RSSI)
+		last, err := s.lastRelay(device)
+		if err != nil {
+			return err
+		}
+		if last != sys.RelayState {
+			r.Relay = Int(sys.RelayState)
+		}
+	}
+	if err := s.Append(device, r); err != nil {
+		return err
+	}
+	if r.Relay != nil {
+		s.mu.Lock()
+		s.relay[device] = *r.Relay
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// lastRelay returns the most recently recorded relay state of the
+// device, or -1 if none is recorded.
+func (s *Store) lastRelay(device string) (int, error) {
+	s.mu.Lock()
+	state, ok := s.relay[device]
+	s.mu.Unlock()
+	if ok {
+		return state, nil
+	}
+	rs, err := s.Records(device, time.Time{}, time.Time{})
+	if err != nil {
+		return 0, err
+	}
+	hourly, err := s.Rollups(device, Hourly, time.Time{}, time.Time{})
+	if err != nil {
+		return 0, err
+	}
+	state = lastState(hourly)
+	for _, r := range rs {
+		if r.Relay != nil {
+			state = *r.Relay
+		}
+	}
+	s.mu.Lock()
+	s.relay[device] = state
+	s.mu.Unlock()
+	return state, nil
+}
+
+// inWindow confirms from <= t < to, where a zero from or to leaves
+// that end of the window unbounded.
+func inWindow(t, from, to time.Time) bool {
+	return (from.IsZero() || !t.Before(from)) && (to.IsZero() || t.Before(to))
+}
+
+// Records returns the uncompacted records of the device in the
+// window [from, to). A zero from or to leaves that end of the window
+// unbounded.
+func (s *Store) Records(device string, from, to time.Time) ([]Record, error) {
+	path, err := s.path(device, "log")
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return readRecords(path, from, to)
+}
+
+// readRecords reads the records in the window [from, to) from a log
+// file, in time order.
+func readRecords(path string, from, to time.Time) ([]Record, error) {
+	var rs []Record
+	err := readJSON(path, func(line []byte) error {
+		var r Record
+		if err := json.Unmarshal(line, &r); err != nil {
+			return err
+		}
+		if inWindow(r.When, from, to) {
+			rs = append(rs, r)
+		}
+		return nil
+	})
+	sort.SliceStable(rs, func(i, j int) bool { return rs[i].When.Before(rs[j].When) })
+	return rs, err
+}
+
+// Rollups returns the stored rollups of the device that start in the
+// window [from, to).
+func (s *Store) Rollups(device string, span Span, from, to time.Time) ([]Rollup, error) {
+	path, err := s.path(device, spanExt(span))
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return readRollups(path, from, to)
+}
+
+func readRollups(path string, from, to time.Time) ([]Rollup, error) {
+	var rs []Rollup
+	err := readJSON(path, func(line []byte) error {
+		var r Rollup
+		if err := json.Unmarshal(line, &r); err != nil {
+			return err
+		}
+		if inWindow(r.Start, from, to) {
+			rs = append(rs, r)
+		}
+		return nil
+	})
+	return rs, err
+}
+
+// lastState returns the relay state at the end of the last of the
+// rollups, in time order, or -1 if it is unknown.
+func lastState(rollups []Rollup) int {
+	if k := len(rollups) - 1; k >= 0 && rollups[k].Relay != nil {
+		return *rollups[k].Relay
+	}
+	return -1
+}
+
+// summarize computes rollups for each window of records. The windows
+// are given by the start times, and each ends at the following start
+// time. The records are assumed to be in time order. Since the relay
+// state is only recorded when it changes, state gives the state
+// before the first record, or -1 if it is unknown.
+func summarize(rs []Record, starts []time.Time, state int) []*Rollup {
+	// Gaps longer than this are assumed to be periods where the
+	// device was not being monitored.
+	g := &Integrator{MaxGap: 15 * time.Minute}
+	for _, r := range rs {
+		if r.PowerMW != nil {
+			m := EMeterResponse{PowerMW: *r.PowerMW}
+			if r.TotalWH != nil {
+				m.TotalWH = *r.TotalWH
+			}
+			g.Add(r.When, &m)
+		}
+	}
+	var rollups []*Rollup
+	var since time.Time
+	j := 0
+	for i := 0; i+1 < len(starts); i++ {
+		from, to := starts[i], starts[i+1]
+		ru := &Rollup{Start: from, End: to}
+		if state == 1 {
+			since = from
+		}
+		for ; j < len(rs) && rs[j].When.Before(to); j++ {
+			r := rs[j]
+			if r.When.Before(from) {
+				continue
+			}
+			if r.PowerMW != nil {
+				ru.merge(&Rollup{
+					Start:   from,
+					Samples: 1,
+					MinMW:   *r.PowerMW,
+					MaxMW:   *r.PowerMW,
+					SumMW:   int64(*r.PowerMW),
+				})
+				if r.VoltageMV != nil {
+					if ru.MinMV == 0 || *r.VoltageMV < ru.MinMV {
+						ru.MinMV = *r.VoltageMV
+					}
+					if *r.VoltageMV > ru.MaxMV {
+						ru.MaxMV = *r.VoltageMV
+					}
+				}
+			}
+			if r.Relay != nil && *r.Relay != state {
+				if state == 1 {
+					ru.OnSec += int(r.When.Sub(since) / time.Second)
+				}
+				if state != -1 {
+					ru.Transitions++
+				}
+				state = *r.Relay
+				since = r.When
+			}
+			if r.RSSI != nil {
+				ru.merge(&Rollup{
+					Start:       from,
+					RSSISamples: 1,
+					MinRSSI:     *r.RSSI,
+					MaxRSSI:     *r.RSSI,
+					SumRSSI:     *r.RSSI,
+				})
+			}
+			if r.Reachable != nil {
+				if *r.Reachable {
+					ru.Reachable++
+				} else {
+					ru.Unreachable++
+				}
+			}
+		}
+		if state == 1 {
+			ru.OnSec += int(to.Sub(since) / time.Second)
+		}
+		if state != -1 {
+			ru.Relay = Int(state)
+		}
+		ru.EnergyMWH = g.Summary(from, to).EnergyMWH
+		rollups = append(rollups, ru)
+	}
+	return rollups
+}
+
+// startOfDay returns local midnight of the day containing t.
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// hours returns the hour boundaries spanning the window [from, to].
+func hours(from, to time.Time) []time.Time {
+	var starts []time.Time
+	for t := from.Truncate(time.Hour); !t.After(to); t = t.Add(time.Hour) {
+		starts = append(starts, t)
+	}
+	return append(starts, starts[len(starts)-1].Add(time.Hour))
+}
+
+// Aggregate summarizes all of the history of a device in the window
+// [from, to). Compacted hourly rollups that start in the window are
+// combined with the uncompacted records that fall in it.
+func (s *Store) Aggregate(device string, from, to time.Time) (*Rollup, error) {
+	earlier, err := s.Rollups(device, Hourly, time.Time{}, to)
+	if err != nil {
+		return nil, err
+	}
+	var hourly []Rollup
+	for _, ru := range earlier {
+		if inWindow(ru.Start, from, to) {
+			hourly = append(hourly, ru)
+		}
+	}
+	rs, err := s.Records(device, from, to)
+	if err != nil {
+		return nil, err
+	}
+	total := &Rollup{}
+	for i := range hourly {
+		total.merge(&hourly[i])
+	}
+	if len(rs) != 0 {
+		start, end := rs[0].When, rs[len(rs)-1].When.Add(time.Nanosecond)
+		for _, ru := range summarize(rs, []time.Time{start, end}, lastState(earlier)) {
+			total.merge(ru)
+		}
+	}
+	if !from.IsZero() {
+		total.Start = from
+	}
+	if !to.IsZero() {
+		total.End = to
+	}
+	return total, nil
+}
+
+// dailyRollups folds hourly rollups, in time order, into daily
+// rollups.
+func dailyRollups(hourly []Rollup) []Rollup {
+	var daily []Rollup
+	for i := range hourly {
+		day := startOfDay(hourly[i].Start)
+		if k := len(daily) - 1; k < 0 || !daily[k].Start.Equal(day) {
+			daily = append(daily, Rollup{Start: day})
+		}
+		daily[len(daily)-1].merge(&hourly[i])
+	}
+	for i := range daily {
+		daily[i].End = daily[i].Start.AddDate(0, 0, 1)
+	}
+	return daily
+}
+
+// Compact replaces the device records from hours that ended before
+// the given time with hourly rollups, and folds those into the daily
+// rollups.
+//
+// The hourly rollups are appended first, and the end of the last one
+// marks how far the records have been compacted. The daily rollups
+// are then rebuilt from the hourly ones, and the log is rewritten
+// last. Should Compact be interrupted, records before the mark are
+// not compacted again, so the next call completes the work without
+// counting anything twice.
+func (s *Store) Compact(device string, before time.Time) error {
+	before = before.Truncate(time.Hour)
+	path, err := s.path(device, "log")
+	if err != nil {
+		return err
+	}
+	hourlyPath, _ := s.path(device, spanExt(Hourly))
+	dailyPath, _ := s.path(device, spanExt(Daily))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rs, err := readRecords(path, time.Time{}, time.Time{})
+	if err != nil || len(rs) == 0 {
+		return err
+	}
+	stored, err := readRollups(hourlyPath, time.Time{}, time.Time{})
+	if err != nil {
+		return err
+	}
+	var mark time.Time
+	if k := len(stored) - 1; k >= 0 {
+		mark = stored[k].End
+	}
+	m := sort.Search(len(rs), func(i int) bool { return !rs[i].When.Before(mark) })
+	n := sort.Search(len(rs), func(i int) bool { return !rs[i].When.Before(before) })
+	if n == 0 {
+		return nil
+	}
+	if m < n {
+		old, keep := rs[m:n], rs[n:]
+		// Include the first kept record so the energy consumed
+		// up to the compaction boundary is integrated.
+		upto := n
+		if len(keep) != 0 {
+			upto++
+		}
+		var hv []interface{}
+		for _, ru := range summarize(rs[m:upto], hours(old[0].When, old[len(old)-1].When), lastState(stored)) {
+			if ru.Samples == 0 && ru.RSSISamples == 0 && ru.Transitions == 0 && ru.OnSec == 0 && ru.Reachable == 0 && ru.Unreachable == 0 {
+				continue
+			}
+			hv = append(hv, ru)
+			stored = append(stored, *ru)
+		}
+		if err := appendJSON(hourlyPath, hv...); err != nil {
+			return err
+		}
+	}
+	var dv []interface{}
+	daily := dailyRollups(stored)
+	for i := range daily {
+		dv = append(dv, &daily[i])
+	}
+	if err := writeJSON(dailyPath, dv...); err != nil {
+		return err
+	}
+	var kv []interface{}
+	for _, r := range rs[n:] {
+		kv = append(kv, r)
+	}
+	return writeJSON(path, kv...)
+}
@@ -0,0 +1,176 @@
+package tplinky
+
+import (
+	"io/ioutil"
+	"math"
+	"testing"
+	"time"
+)
+
+// fillStore records a steady 100W draw, once a minute, from start
+// for the given number of minutes.
+func fillStore(t *testing.T, s *Store, device string, start time.Time, minutes int) {
+	for i := 0; i <= minutes; i++ {
+		if err := s.RecordEMon(device, start.Add(time.Duration(i)*time.Minute), &EMeterResponse{
+			PowerMW:   100000,
+			VoltageMV: 230000,
+		}); err != nil {
+			t.Fatalf("unable to record: %v", err)
+		}
+	}
+}
+
+// checkCompacted confirms the hourly and daily rollups, and the
+// number of uncompacted records, of a store.
+func checkCompacted(t *testing.T, s *Store, device string, hours, samples, records int, energyMWH float64) {
+	t.Helper()
+	hourly, err := s.Rollups(device, Hourly, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("unable to read hourly rollups: %v", err)
+	}
+	if len(hourly) != hours {
+		t.Errorf("got %d hourly rollups, want %d", len(hourly), hours)
+	}
+	daily, err := s.Rollups(device, Daily, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("unable to read daily rollups: %v", err)
+	}
+	if len(daily) != 1 {
+		t.Fatalf("got %d daily rollups, want 1", len(daily))
+	}
+	d := daily[0]
+	if d.Samples != samples {
+		t.Errorf("daily rollup has %d samples, want %d", d.Samples, samples)
+	}
+	if math.Abs(d.EnergyMWH-energyMWH) > 1 {
+		t.Errorf("daily rollup energy = %.1f mWh, want %.1f", d.EnergyMWH, energyMWH)
+	}
+	if d.MinMV != 230000 || d.MaxMV != 230000 || d.MeanMW() != 100000 {
+		t.Errorf("daily rollup values: got %+v", d)
+	}
+	rs, err := s.Records(device, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("unable to read records: %v", err)
+	}
+	if len(rs) != records {
+		t.Errorf("got %d uncompacted records, want %d", len(rs), records)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	s, err := OpenStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("unable to open store: %v", err)
+	}
+	const device = "plug"
+	start := time.Date(2025, time.July, 15, 0, 0, 0, 0, time.UTC)
+	fillStore(t, s, device, start, 210)
+
+	if err := s.Compact(device, start.Add(150*time.Minute)); err != nil {
+		t.Fatalf("unable to compact: %v", err)
+	}
+	checkCompacted(t, s, device, 2, 120, 91, 200000)
+	hourly, _ := s.Rollups(device, Hourly, time.Time{}, time.Time{})
+	for i, ru := range hourly {
+		if want := start.Add(time.Duration(i) * time.Hour); !ru.Start.Equal(want) || !ru.End.Equal(want.Add(time.Hour)) {
+			t.Errorf("hourly rollup %d spans %v to %v, want from %v", i, ru.Start, ru.End, want)
+		}
+		if ru.Samples != 60 || math.Abs(ru.EnergyMWH-100000) > 1 {
+			t.Errorf("hourly rollup %d: got %d samples and %.1f mWh", i, ru.Samples, ru.EnergyMWH)
+		}
+	}
+
+	// Compacting again to the same time changes nothing.
+	if err := s.Compact(device, start.Add(150*time.Minute)); err != nil {
+		t.Fatalf("unable to compact again: %v", err)
+	}
+	checkCompacted(t, s, device, 2, 120, 91, 200000)
+
+	if err := s.Compact(device, start.Add(5*time.Hour)); err != nil {
+		t.Fatalf("unable to compact the rest: %v", err)
+	}
+	checkCompacted(t, s, device, 4, 211, 0, 350000)
+}
+
+func TestCompactInterrupted(t *testing.T) {
+	s, err := OpenStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("unable to open store: %v", err)
+	}
+	const device = "plug"
+	start := time.Date(2025, time.July, 15, 0, 0, 0, 0, time.UTC)
+	fillStore(t, s, device, start, 210)
+	logPath, _ := s.path(device, "log")
+	dailyPath, _ := s.path(device, "daily")
+	log, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("unable to read log: %v", err)
+	}
+
+	if err := s.Compact(device, start.Add(150*time.Minute)); err != nil {
+		t.Fatalf("unable to compact: %v", err)
+	}
+	// Undo the daily and log rewrites, as if Compact stopped
+	// just after appending the hourly rollups.
+	if err := ioutil.WriteFile(logPath, log, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dailyPath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Compact(device, start.Add(150*time.Minute)); err != nil {
+		t.Fatalf("unable to resume compaction: %v", err)
+	}
+	checkCompacted(t, s, device, 2, 120, 91, 200000)
+}
+
+func TestCompactRelayCarried(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenStore(dir)
+	if err != nil {
+		t.Fatalf("unable to open store: %v", err)
+	}
+	const device = "plug"
+	start := time.Date(2025, time.July, 15, 0, 0, 0, 0, time.UTC)
+	// The relay is switched on at 00:30 and stays on, so it is
+	// recorded only once.
+	for i := 0; i <= 180; i += 10 {
+		sys := &Sysinfo{RelayState: 0}
+		if i >= 30 {
+			sys.RelayState = 1
+		}
+		if err := s.RecordStatus(device, start.Add(time.Duration(i)*time.Minute), sys, nil); err != nil {
+			t.Fatalf("unable to record: %v", err)
+		}
+	}
+	if err := s.Compact(device, start.Add(90*time.Minute)); err != nil {
+		t.Fatalf("unable to compact: %v", err)
+	}
+	// A fresh store has no cached relay state to go by.
+	if s, err = OpenStore(dir); err != nil {
+		t.Fatalf("unable to reopen store: %v", err)
+	}
+	if err := s.RecordStatus(device, start.Add(185*time.Minute), &Sysinfo{RelayState: 1}, nil); err != nil {
+		t.Fatalf("unable to record: %v", err)
+	}
+	rs, _ := s.Records(device, start.Add(185*time.Minute), time.Time{})
+	if len(rs) != 1 || rs[0].Relay != nil {
+		t.Errorf("got records %+v, want the unchanged relay state left out", rs)
+	}
+	if err := s.Compact(device, start.Add(4*time.Hour)); err != nil {
+		t.Fatalf("unable to compact the rest: %v", err)
+	}
+	hourly, err := s.Rollups(device, Hourly, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("unable to read hourly rollups: %v", err)
+	}
+	want := []int{1800, 3600, 3600, 3600}
+	if len(hourly) != len(want) {
+		t.Fatalf("got %d hourly rollups, want %d", len(hourly), len(want))
+	}
+	for i, ru := range hourly {
+		if ru.OnSec != want[i] || ru.Relay == nil || *ru.Relay != 1 {
+			t.Errorf("hourly rollup %d: got %d seconds on, relay %v, want %d", i, ru.OnSec, ru.Relay, want[i])
+		}
+	}
+}
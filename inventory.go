@@ -0,0 +1,119 @@
+package tplinky
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// InventoryDevice describes a device recorded in an Inventory.
+type InventoryDevice struct {
+	Addr   string   `json:"addr"`
+	Mac    string   `json:"mac,omitempty"`
+	Alias  string   `json:"alias,omitempty"`
+	Model  string   `json:"model,omitempty"`
+	Labels []string `json:"labels,omitempty"`
+}
+
+// HasLabel confirms the device carries the specified label.
+func (d *InventoryDevice) HasLabel(label string) bool {
+	for _, l := range d.Labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+// Inventory is a list of known devices. It is stored as a JSON
+// file, and is used to group devices by label.
+type Inventory struct {
+	Devices []*InventoryDevice `json:"devices"`
+}
+
+// LoadInventory reads an inventory file. A missing file is treated
+// as an empty inventory.
+func LoadInventory(path string) (*Inventory, error) {
+	inv := &Inventory{}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return inv, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, inv); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// Save writes the inventory to a file.
+func (inv *Inventory) Save(path string) error {
+	data, err := json.MarshalIndent(inv, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Find looks up a device by its address, MAC address or alias.
+func (inv *Inventory) Find(key string) *InventoryDevice {
+	if key == "" {
+		return nil
+	}
+	for _, d := range inv.Devices {
+		if d.Addr == key || strings.EqualFold(d.Mac, key) || (d.Alias != "" && d.Alias == key) {
+			return d
+		}
+	}
+	return nil
+}
+
+// Labeled returns the devices that carry the specified label.
+func (inv *Inventory) Labeled(label string) []*InventoryDevice {
+	var ds []*InventoryDevice
+	for _, d := range inv.Devices {
+		if d.HasLabel(label) {
+			ds = append(ds, d)
+		}
+	}
+	return ds
+}
+
+// Labels returns the sorted list of labels used in the inventory.
+func (inv *Inventory) Labels() []string {
+	seen := make(map[string]bool)
+	var labels []string
+	for _, d := range inv.Devices {
+		for _, l := range d.Labels {
+			if !seen[l] {
+				seen[l] = true
+				labels = append(labels, l)
+			}
+		}
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+// Update records the current status of a device found at addr. The
+// device is matched by MAC address, so a device that has moved to a
+// new address is updated rather than duplicated.
+func (inv *Inventory) Update(addr string, sys *Sysinfo) *InventoryDevice {
+	d := inv.Find(sys.Mac)
+	if d == nil {
+		d = &InventoryDevice{Mac: sys.Mac}
+		inv.Devices = append(inv.Devices, d)
+	}
+	d.Addr = addr
+	d.Alias = sys.Alias
+	d.Model = sys.Model
+	return d
+}
@@ -0,0 +1,162 @@
+package tplinky
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// SetLED switches the status LED of the device on or off. The relay
+// is not affected.
+func (c *Conn) SetLED(on bool) error {
+	off := 1
+	if on {
+		off = 0
+	}
+	_, err := c.Send(Control{
+		System: &SystemCommands{
+			SetLEDOff: &SystemCommandParameters{
+				Off: &off,
+			},
+		},
+	})
+	return err
+}
+
+// LED reports whether the status LED of the device is on.
+func (c *Conn) LED() (bool, error) {
+	sys, err := c.GetStatus()
+	if err != nil {
+		return false, err
+	}
+	return sys.LEDOff == 0, nil
+}
+
+// NightEvent records a NightMode change to the LED of a device.
+type NightEvent struct {
+	When   time.Time
+	Device string
+	LED    bool
+	Err    error
+}
+
+// String summarizes the event.
+func (e NightEvent) String() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: night mode error: %v", e.Device, e.Err)
+	}
+	state := "off"
+	if e.LED {
+		state = "on"
+	}
+	return fmt.Sprintf("%s: LED %s", e.Device, state)
+}
+
+// NightMode keeps the status LEDs of a set of devices off overnight.
+// The LEDs are switched off at the Off time and back on at the On
+// time. Each Check sets every LED to the state for the time of day,
+// so devices that restart, or are switched by hand, are brought back
+// in line.
+type NightMode struct {
+	// Devices lists the addresses of the devices.
+	Devices []string
+
+	// Off and On are the "HH:MM" local times at which the night
+	// starts and ends. The night may span midnight.
+	Off, On string
+
+	// Timeout is used to connect to the devices. If zero,
+	// DefaultTimeout is used.
+	Timeout time.Duration
+
+	// Log, if not nil, is called with each change and error.
+	Log func(NightEvent)
+}
+
+func (n *NightMode) timeout() time.Duration {
+	if n.Timeout == 0 {
+		return DefaultTimeout
+	}
+	return n.Timeout
+}
+
+// Night confirms that t falls within the night.
+func (n *NightMode) Night(t time.Time) (bool, error) {
+	off, err := parseClock(n.Off)
+	if err != nil {
+		return false, err
+	}
+	on, err := parseClock(n.On)
+	if err != nil {
+		return false, err
+	}
+	if off == on {
+		return false, fmt.Errorf("night mode starts and ends at %s", n.Off)
+	}
+	m := t.Hour()*60 + t.Minute()
+	if off < on {
+		return m >= off && m < on, nil
+	}
+	return m >= off || m < on, nil
+}
+
+// check brings the LED of one device in line.
+func (n *NightMode) check(device string, led bool, now time.Time) *NightEvent {
+	e := &NightEvent{When: now, Device: device, LED: led}
+	c, err := DialTimeout(device, n.timeout())
+	if err != nil {
+		e.Err = err
+		return e
+	}
+	defer c.Close()
+	on, err := c.LED()
+	if err != nil {
+		e.Err = err
+		return e
+	}
+	if on == led {
+		return nil
+	}
+	e.Err = c.SetLED(led)
+	return e
+}
+
+// Check sets the LEDs of all of the devices, in parallel, to the
+// state for the time now.
+func (n *NightMode) Check(now time.Time) error {
+	night, err := n.Night(now)
+	if err != nil {
+		return err
+	}
+	events := make([]*NightEvent, len(n.Devices))
+	var wg sync.WaitGroup
+	for i, d := range n.Devices {
+		wg.Add(1)
+		go func(i int, d string) {
+			defer wg.Done()
+			events[i] = n.check(d, !night, now)
+		}(i, d)
+	}
+	wg.Wait()
+	for _, e := range events {
+		if e != nil && n.Log != nil {
+			n.Log(*e)
+		}
+	}
+	return nil
+}
+
+// Run calls Check every interval until done is closed. The Off and
+// On times should be validated, with Night, beforehand.
+func (n *NightMode) Run(every time.Duration, done <-chan struct{}) {
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+	for {
+		n.Check(time.Now())
+		select {
+		case <-done:
+			return
+		case <-tick.C:
+		}
+	}
+}
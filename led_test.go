@@ -0,0 +1,100 @@
+package tplinky
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNightModeNight(t *testing.T) {
+	day := time.Date(2025, time.March, 30, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		off, on string
+		at      string
+		want    bool
+	}{
+		{"22:30", "06:00", "22:29", false},
+		{"22:30", "06:00", "22:30", true},
+		{"22:30", "06:00", "23:59", true},
+		{"22:30", "06:00", "00:00", true},
+		{"22:30", "06:00", "05:59", true},
+		{"22:30", "06:00", "06:00", false},
+		{"22:30", "06:00", "12:00", false},
+		{"01:00", "05:00", "00:59", false},
+		{"01:00", "05:00", "03:00", true},
+		{"01:00", "05:00", "05:00", false},
+		{"00:00", "07:00", "00:00", true},
+		{"20:00", "24:00", "23:59", true},
+		{"20:00", "24:00", "00:00", false},
+	}
+	for _, tc := range tests {
+		n := &NightMode{Off: tc.off, On: tc.on}
+		at, err := time.Parse("15:04", tc.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		when := day.Add(time.Duration(at.Hour())*time.Hour + time.Duration(at.Minute())*time.Minute)
+		if got, err := n.Night(when); err != nil || got != tc.want {
+			t.Errorf("night %s-%s at %s: got %v, %v, want %v", tc.off, tc.on, tc.at, got, err, tc.want)
+		}
+	}
+	for _, bad := range []NightMode{{Off: "22:00", On: "22:00"}, {Off: "10pm", On: "06:00"}, {Off: "22:00", On: "6"}} {
+		if _, err := bad.Night(day); err == nil {
+			t.Errorf("night %s-%s accepted", bad.Off, bad.On)
+		}
+	}
+}
+
+func TestNightModeCheck(t *testing.T) {
+	var mu sync.Mutex
+	ledOff := 0
+	sets := 0
+	addr := fakeDevice(t, func(req map[string]interface{}) interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		sys := module(req, "system")
+		resp := make(map[string]interface{})
+		if set, ok := sys["set_led_off"].(map[string]interface{}); ok {
+			ledOff = int(set["off"].(float64))
+			sets++
+			resp["set_led_off"] = map[string]interface{}{"err_code": 0}
+		}
+		if _, ok := sys["get_sysinfo"]; ok {
+			resp["get_sysinfo"] = map[string]interface{}{"led_off": ledOff}
+		}
+		return map[string]interface{}{"system": resp}
+	})
+	var events []NightEvent
+	n := &NightMode{
+		Devices: []string{addr},
+		Off:     "23:00",
+		On:      "06:30",
+		Log: func(e NightEvent) {
+			events = append(events, e)
+		},
+	}
+	day := time.Date(2025, time.March, 30, 0, 0, 0, 0, time.Local)
+	for _, s := range []struct {
+		hour, min int
+		off, sets int
+	}{
+		{22, 59, 0, 0},
+		{23, 0, 1, 1},
+		{2, 0, 1, 1},
+		{6, 30, 0, 2},
+		{12, 0, 0, 2},
+	} {
+		now := day.Add(time.Duration(s.hour)*time.Hour + time.Duration(s.min)*time.Minute)
+		if err := n.Check(now); err != nil {
+			t.Fatalf("Check failed: %v", err)
+		}
+		mu.Lock()
+		if ledOff != s.off || sets != s.sets {
+			t.Errorf("at %02d:%02d: got led_off=%d after %d sets, want %d after %d", s.hour, s.min, ledOff, sets, s.off, s.sets)
+		}
+		mu.Unlock()
+	}
+	if len(events) != 2 || events[0].LED || !events[1].LED || events[0].Err != nil || events[1].Err != nil {
+		t.Errorf("got events %v, want the LED switched off then on", events)
+	}
+}
@@ -0,0 +1,51 @@
+package tplinky
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSun(t *testing.T) {
+	// The expected times are those of the NOAA solar calculator.
+	// The Fairbanks equinox case is sensitive to the declination.
+	tests := []struct {
+		name                  string
+		zone                  string
+		date                  string
+		lat, lon              float64
+		sunrise, noon, sunset string
+	}{
+		{"Washington", "America/New_York", "2024-06-20", 38.8977, -77.0365, "05:42:56", "13:09:54", "20:36:52"},
+		{"New York", "America/New_York", "2024-12-21", 40.7128, -74.0060, "07:16:49", "11:54:26", "16:32:04"},
+		{"Greenwich", "Europe/London", "2024-06-21", 51.4779, 0, "04:42:50", "13:01:55", "21:20:59"},
+		{"Sydney", "Australia/Sydney", "2024-03-20", -33.8688, 151.2093, "06:58:19", "13:02:34", "19:06:17"},
+		{"Fairbanks", "America/Anchorage", "2024-09-22", 64.8378, -147.7164, "07:35:57", "13:43:17", "19:48:56"},
+	}
+	for _, tc := range tests {
+		loc, err := time.LoadLocation(tc.zone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		day, err := time.ParseInLocation("2006-01-02", tc.date, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := Sun(day.Add(15*time.Hour), tc.lat, tc.lon)
+		for _, e := range []struct {
+			what string
+			got  time.Time
+			want string
+		}{{"sunrise", s.Sunrise, tc.sunrise}, {"noon", s.Noon, tc.noon}, {"sunset", s.Sunset, tc.sunset}} {
+			want, err := time.ParseInLocation("2006-01-02 15:04:05", tc.date+" "+e.want, loc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := e.got.Sub(want); d < -time.Minute || d > time.Minute {
+				t.Errorf("%s %s: got %v, want %v", tc.name, e.what, e.got, want)
+			}
+		}
+		if !s.Dawn.Before(s.Sunrise) || !s.Dusk.After(s.Sunset) {
+			t.Errorf("%s: twilight %v to %v does not surround the day", tc.name, s.Dawn, s.Dusk)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package tplinky
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrStillOff is returned by PowerCycle when the device did not come
+// back on.
+var ErrStillOff = errors.New("device did not switch back on")
+
+// isOn confirms that the device, or all of the specified sockets of a
+// power strip, are switched on.
+func (c *Conn) isOn(sockets []int) (bool, error) {
+	sys, err := c.GetStatus()
+	if err != nil {
+		return false, err
+	}
+	if len(sockets) == 0 {
+		if len(sys.Children) == 0 {
+			return sys.RelayState != 0, nil
+		}
+		// The RelayState of a power strip is set if any
+		// socket is on, so check all of them.
+		for _, ch := range sys.Children {
+			if ch.State == 0 {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+	for _, i := range sockets {
+		if i < 0 || i >= len(sys.Children) || sys.Children[i].State == 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// redial replaces the connection to the device with a new one, as the
+// device may drop idle connections.
+func (c *Conn) redial() error {
+	timeout := c.timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	n, err := DialTimeout(c.target, timeout)
+	if err != nil {
+		return err
+	}
+	c.conn.Close()
+	c.conn = n.conn
+	return nil
+}
+
+// PowerCycle switches the device, or the specified sockets of a power
+// strip, off for the specified time and then back on. Before
+// switching off, an on-device countdown is armed to switch back on,
+// so the device comes back on even if the caller goes away. Any
+// existing countdown is replaced. PowerCycle waits for the device to
+// come back on, switching it on directly if the countdown did not,
+// and then removes the countdown. For a power strip with no sockets
+// specified, every socket is cycled, each with its own countdown.
+func (c *Conn) PowerCycle(off time.Duration, sockets ...int) error {
+	if len(sockets) == 0 {
+		sys, err := c.GetStatus()
+		if err != nil {
+			return err
+		}
+		for i := range sys.Children {
+			sockets = append(sockets, i)
+		}
+	}
+	var err error
+	if len(sockets) == 0 {
+		_, err = c.Countdown(true, off)
+	}
+	for _, i := range sockets {
+		if _, err = c.Countdown(true, off, i); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		if len(sockets) != 0 {
+			err = c.EnableSocket(false, sockets...)
+		} else {
+			err = c.Enable(false)
+		}
+	}
+	if err != nil {
+		c.disarm(sockets)
+		return err
+	}
+	time.Sleep(off)
+
+	// Allow the device a little while to act on the countdown.
+	on := false
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if err = c.redial(); err == nil {
+			if on, err = c.isOn(sockets); on {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	if err != nil {
+		return err
+	}
+	if !on {
+		if len(sockets) != 0 {
+			err = c.EnableSocket(true, sockets...)
+		} else {
+			err = c.Enable(true)
+		}
+		if err != nil {
+			return err
+		}
+		if on, err = c.isOn(sockets); err != nil {
+			return err
+		} else if !on {
+			return ErrStillOff
+		}
+	}
+	return c.disarm(sockets)
+}
+
+// disarm removes the countdowns PowerCycle armed on the device, or on
+// each of the sockets.
+func (c *Conn) disarm(sockets []int) error {
+	if len(sockets) == 0 {
+		return c.DeleteAllCountdownRules()
+	}
+	var err error
+	for _, i := range sockets {
+		if e := c.DeleteAllCountdownRules(i); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
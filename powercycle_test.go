@@ -0,0 +1,79 @@
+package tplinky
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIsOnStrip(t *testing.T) {
+	var mu sync.Mutex
+	var states []int
+	addr := fakeDevice(t, func(req map[string]interface{}) interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		var children []map[string]interface{}
+		for i, s := range states {
+			children = append(children, map[string]interface{}{"id": string(rune('0' + i)), "state": s})
+		}
+		return map[string]interface{}{
+			"system": map[string]interface{}{
+				"get_sysinfo": map[string]interface{}{"children": children},
+			},
+		}
+	})
+	c, err := Dial(addr)
+	if err != nil {
+		t.Fatalf("unable to dial fake strip: %v", err)
+	}
+	defer c.Close()
+	tests := []struct {
+		states  []int
+		sockets []int
+		on      bool
+	}{
+		{[]int{1, 0}, nil, false},
+		{[]int{1, 1}, nil, true},
+		{[]int{0, 0}, nil, false},
+		{[]int{1, 0}, []int{0}, true},
+		{[]int{1, 0}, []int{0, 1}, false},
+	}
+	for _, tc := range tests {
+		mu.Lock()
+		states = tc.states
+		mu.Unlock()
+		on, err := c.isOn(tc.sockets)
+		if err != nil {
+			t.Fatalf("isOn failed: %v", err)
+		}
+		if on != tc.on {
+			t.Errorf("states %v, sockets %v: got on=%v, want %v", tc.states, tc.sockets, on, tc.on)
+		}
+	}
+}
+
+func TestPowerCycleStrip(t *testing.T) {
+	addr, s := fakeStrip(t, 3)
+	c, err := DialTimeout(addr, 500*time.Millisecond)
+	if err != nil {
+		t.Fatalf("unable to dial fake strip: %v", err)
+	}
+	defer c.Close()
+	for _, sockets := range [][]int{nil, {1}} {
+		if err := c.PowerCycle(10*time.Millisecond, sockets...); err != nil {
+			t.Fatalf("sockets %v: PowerCycle failed: %v", sockets, err)
+		}
+		states, unarmed := s.state()
+		if unarmed != 0 {
+			t.Errorf("sockets %v: %d sockets switched off without a countdown", sockets, unarmed)
+		}
+		for i, st := range states {
+			if st != 1 {
+				t.Errorf("sockets %v: socket %d left off", sockets, i)
+			}
+			if rs := s.countdown.list(childID(i)); len(rs) != 0 {
+				t.Errorf("sockets %v: socket %d countdown left armed: %v", sockets, i, rs)
+			}
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package tplinky
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PricePoint is the price of electricity from Start until the Start
+// of the next PricePoint. Utilities typically publish hourly prices.
+type PricePoint struct {
+	Start time.Time `json:"start"`
+	Price float64   `json:"price"`
+}
+
+// priceLayouts are the time formats accepted in price series.
+var priceLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+}
+
+// parsePriceTime parses a time in one of the priceLayouts, in the loc
+// timezone if it does not include one.
+func parsePriceTime(s string, loc *time.Location) (time.Time, error) {
+	for _, layout := range priceLayouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized time %q", s)
+}
+
+// LoadPricesCSV reads a price series from CSV data with lines of the
+// form "<start time>,<price>". A header line is skipped. Times
+// without a timezone are interpreted in loc.
+func LoadPricesCSV(r io.Reader, loc *time.Location) ([]PricePoint, error) {
+	rd := csv.NewReader(r)
+	rd.FieldsPerRecord = -1
+	rd.TrimLeadingSpace = true
+	rd.Comment = '#'
+	var ps []PricePoint
+	for line := 1; ; line++ {
+		rec, err := rd.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(rec) < 2 {
+			return nil, fmt.Errorf("line %d: want <time>,<price>", line)
+		}
+		t, err := parsePriceTime(rec[0], loc)
+		if err != nil {
+			if line == 1 {
+				continue
+			}
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		p, err := strconv.ParseFloat(rec[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		ps = append(ps, PricePoint{Start: t, Price: p})
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].Start.Before(ps[j].Start) })
+	return ps, nil
+}
+
+// FetchPrices reads a price series from a URL. The response may be
+// CSV (see LoadPricesCSV) or a JSON array of PricePoint values.
+func FetchPrices(url string, loc *time.Location) ([]PricePoint, error) {
+	client := &http.Client{Timeout: 10 * DefaultTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if t := strings.TrimSpace(string(data)); !strings.HasPrefix(t, "[") {
+		return LoadPricesCSV(strings.NewReader(t), loc)
+	}
+	var ps []PricePoint
+	if err := json.Unmarshal(data, &ps); err != nil {
+		return nil, err
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].Start.Before(ps[j].Start) })
+	return ps, nil
+}
+
+// DailyWindow returns the window of time on the day containing t
+// that starts and ends at the "HH:MM" times of day. A window whose
+// end is not after its start ends on the following day.
+func DailyWindow(t time.Time, start, end string) (from, to time.Time, err error) {
+	s, err := parseClock(start)
+	if err != nil {
+		return
+	}
+	e, err := parseClock(end)
+	if err != nil {
+		return
+	}
+	y, m, d := t.Date()
+	from = time.Date(y, m, d, s/60, s%60, 0, 0, t.Location())
+	to = time.Date(y, m, d, e/60, e%60, 0, 0, t.Location())
+	if !to.After(from) {
+		to = time.Date(y, m, d+1, e/60, e%60, 0, 0, t.Location())
+	}
+	return
+}
+
+// PlanSlot is a period of time during which a plan has the outlet
+// switched on.
+type PlanSlot struct {
+	Start time.Time
+	End   time.Time
+	Price float64
+}
+
+// PricePlan holds the cheapest times to run an appliance.
+type PricePlan struct {
+	From, To time.Time
+	Slots    []PlanSlot
+}
+
+// ErrNotEnoughPrices is returned when the price series does not
+// cover enough of the planning window.
+var ErrNotEnoughPrices = errors.New("not enough prices to plan")
+
+// PlanCheapest picks the cheapest price periods, totaling at least
+// run, that lie within the window [from, to). Each price period is
+// used in its entirety. Prices are assumed to last one hour when
+// there is no following price.
+func PlanCheapest(prices []PricePoint, run time.Duration, from, to time.Time) (*PricePlan, error) {
+	var slots []PlanSlot
+	for i, p := range prices {
+		end := p.Start.Add(time.Hour)
+		if i+1 < len(prices) {
+			end = prices[i+1].Start
+		}
+		if p.Start.Before(from) || end.After(to) || !end.After(p.Start) {
+			continue
+		}
+		slots = append(slots, PlanSlot{Start: p.Start, End: end, Price: p.Price})
+	}
+	sort.SliceStable(slots, func(i, j int) bool { return slots[i].Price < slots[j].Price })
+	plan := &PricePlan{From: from, To: to}
+	var total time.Duration
+	for _, s := range slots {
+		if total >= run {
+			break
+		}
+		plan.Slots = append(plan.Slots, s)
+		total += s.End.Sub(s.Start)
+	}
+	if total < run {
+		return nil, ErrNotEnoughPrices
+	}
+	sort.Slice(plan.Slots, func(i, j int) bool { return plan.Slots[i].Start.Before(plan.Slots[j].Start) })
+	return plan, nil
+}
+
+// On indicates whether the plan has the outlet on at time t.
+func (p *PricePlan) On(t time.Time) bool {
+	for _, s := range p.Slots {
+		if !t.Before(s.Start) && t.Before(s.End) {
+			return true
+		}
+	}
+	return false
+}
+
+// Blocks merges adjacent slots of the plan into continuous periods
+// of time. The Price of each block is the mean price of its slots.
+func (p *PricePlan) Blocks() []PlanSlot {
+	var bs []PlanSlot
+	var sum time.Duration
+	for _, s := range p.Slots {
+		d := s.End.Sub(s.Start)
+		if n := len(bs) - 1; n >= 0 && bs[n].End.Equal(s.Start) {
+			b := &bs[n]
+			b.Price = (b.Price*float64(sum) + s.Price*float64(d)) / float64(sum+d)
+			b.End = s.End
+			sum += d
+			continue
+		}
+		bs = append(bs, s)
+		sum = d
+	}
+	return bs
+}
+
+// Cost returns the cost of running a load of powerW Watts according
+// to the plan, with prices per kWh.
+func (p *PricePlan) Cost(powerW float64) float64 {
+	var c float64
+	for _, s := range p.Slots {
+		c += powerW / 1e3 * s.End.Sub(s.Start).Hours() * s.Price
+	}
+	return c
+}
+
+// ScheduleRules converts the plan into non-repeating on-device
+// schedule rules that switch the outlet on and off at the start and
+// end of each block. The rules are given the specified name, so they
+// can be recognized later. The times are given in loc, which should
+// be the timezone of the device.
+func (p *PricePlan) ScheduleRules(name string, loc *time.Location) []*ScheduleRule {
+	at := func(t time.Time, act int) *ScheduleRule {
+		t = t.In(loc)
+		r := &ScheduleRule{
+			Name:     name,
+			Enable:   1,
+			WDay:     make([]int, 7),
+			SMin:     t.Hour()*60 + t.Minute(),
+			SAct:     act,
+			ETimeOpt: -1,
+			EAct:     -1,
+			Year:     t.Year(),
+			Month:    int(t.Month()),
+			Day:      t.Day(),
+		}
+		// Dated rules still name their day of the week, as
+		// parseRuleDays does.
+		r.WDay[t.Weekday()] = 1
+		return r
+	}
+	var rules []*ScheduleRule
+	for _, b := range p.Blocks() {
+		rules = append(rules, at(b.Start, 1), at(b.End, 0))
+	}
+	return rules
+}
+
+// WritePlan replaces the device's schedule rules with the specified
+// name by the rules of the plan, in the device's timezone. This
+// allows the device to follow the plan even if the controller stops
+// running. For a power strip, the plan can be written for specific
+// sockets.
+func (c *Conn) WritePlan(p *PricePlan, name string, sockets ...int) error {
+	loc, err := c.GetTimeZone()
+	if err != nil {
+		return fmt.Errorf("unable to read device timezone: %w", err)
+	}
+	rules, err := c.ScheduleRules(sockets...)
+	if err != nil {
+		return err
+	}
+	for _, r := range rules {
+		if r.Name == name {
+			if err := c.DeleteScheduleRule(r.ID, sockets...); err != nil {
+				return err
+			}
+		}
+	}
+	for _, r := range p.ScheduleRules(name, loc) {
+		if _, err := c.AddScheduleRule(r, sockets...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PlanEvent describes something a PlanRunner did.
+type PlanEvent struct {
+	When   time.Time
+	Outlet Outlet
+	On     bool
+	Err    error
+}
+
+// String summarizes the event.
+func (e PlanEvent) String() string {
+	state := "off"
+	if e.On {
+		state = "on"
+	}
+	if e.Err != nil {
+		return fmt.Sprintf("%s: failed to switch %s: %v", e.Outlet, state, e.Err)
+	}
+	return fmt.Sprintf("%s: switched %s", e.Outlet, state)
+}
+
+// PlanRunner switches outlets on and off according to a PricePlan.
+type PlanRunner struct {
+	Plan    *PricePlan
+	Outlets []Outlet
+
+	// Timeout is used to connect to the devices. If zero,
+	// DefaultTimeout is used.
+	Timeout time.Duration
+
+	// Log, if not nil, is called with each event.
+	Log func(PlanEvent)
+
+	state map[string]bool
+}
+
+// Check switches any outlets whose state differs from that planned
+// for now.
+func (r *PlanRunner) Check(now time.Time) {
+	if r.state == nil {
+		r.state = make(map[string]bool)
+	}
+	on := r.Plan.On(now)
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	for _, o := range r.Outlets {
+		if last, ok := r.state[o.String()]; ok && last == on {
+			continue
+		}
+		err := o.Enable(on, timeout)
+		if err == nil {
+			r.state[o.String()] = on
+		}
+		if r.Log != nil {
+			r.Log(PlanEvent{When: now, Outlet: o, On: on, Err: err})
+		}
+	}
+}
+
+// Run calls Check every interval until the end of the plan, or until
+// done is closed.
+func (r *PlanRunner) Run(every time.Duration, done <-chan struct{}) {
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+	for {
+		now := time.Now()
+		r.Check(now)
+		if !now.Before(r.Plan.To) {
+			return
+		}
+		select {
+		case <-done:
+			return
+		case <-tick.C:
+		}
+	}
+}
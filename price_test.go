@@ -0,0 +1,123 @@
+package tplinky
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// hourlyPrices returns a price for each hour starting at start.
+func hourlyPrices(start time.Time, prices ...float64) []PricePoint {
+	var ps []PricePoint
+	for i, p := range prices {
+		ps = append(ps, PricePoint{Start: start.Add(time.Duration(i) * time.Hour), Price: p})
+	}
+	return ps
+}
+
+func TestPlanCheapest(t *testing.T) {
+	t0 := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+	prices := hourlyPrices(t0, 0.30, 0.10, 0.20, 0.40, 0.15, 0.05)
+	plan, err := PlanCheapest(prices, 2*time.Hour+time.Minute, t0, t0.Add(5*time.Hour))
+	if err != nil {
+		t.Fatalf("PlanCheapest failed: %v", err)
+	}
+	// The 05:00 price lies outside the window, and a part hour
+	// needs a whole slot.
+	var got []int
+	for _, s := range plan.Slots {
+		got = append(got, s.Start.Hour())
+	}
+	if len(got) != 3 || got[0] != 1 || got[1] != 2 || got[2] != 4 {
+		t.Errorf("got slots starting at hours %v, want [1 2 4]", got)
+	}
+	if !plan.On(t0.Add(90*time.Minute)) || plan.On(t0.Add(3*time.Hour)) {
+		t.Errorf("plan is on at the wrong times: %+v", plan.Slots)
+	}
+	if c := plan.Cost(1000); math.Abs(c-0.45) > 1e-9 {
+		t.Errorf("got cost %g for 1kW, want 0.45", c)
+	}
+	if _, err := PlanCheapest(prices, 6*time.Hour, t0, t0.Add(5*time.Hour)); !errors.Is(err, ErrNotEnoughPrices) {
+		t.Errorf("got %v for too long a run, want ErrNotEnoughPrices", err)
+	}
+}
+
+func TestPlanBlocks(t *testing.T) {
+	t0 := time.Date(2024, 1, 10, 22, 0, 0, 0, time.UTC)
+	plan := &PricePlan{Slots: []PlanSlot{
+		{Start: t0, End: t0.Add(time.Hour), Price: 0.10},
+		{Start: t0.Add(time.Hour), End: t0.Add(3 * time.Hour), Price: 0.40},
+		{Start: t0.Add(4 * time.Hour), End: t0.Add(5 * time.Hour), Price: 0.20},
+	}}
+	bs := plan.Blocks()
+	if len(bs) != 2 {
+		t.Fatalf("got blocks %+v, want 2", bs)
+	}
+	if !bs[0].Start.Equal(t0) || !bs[0].End.Equal(t0.Add(3*time.Hour)) || math.Abs(bs[0].Price-0.30) > 1e-9 {
+		t.Errorf("got first block %+v, want 3 hours at a mean of 0.30", bs[0])
+	}
+	if !bs[1].Start.Equal(t0.Add(4*time.Hour)) || bs[1].Price != 0.20 {
+		t.Errorf("got second block %+v, want the last slot", bs[1])
+	}
+
+	rules := plan.ScheduleRules("tple:plan", time.UTC)
+	var got []string
+	for i, r := range rules {
+		day := time.Date(r.Year, time.Month(r.Month), r.Day, 0, r.SMin, 0, 0, time.UTC)
+		got = append(got, day.Format("Jan 2 15:04"))
+		if r.SAct != 1-i%2 || r.Name != "tple:plan" {
+			t.Errorf("got rule %d %+v, want alternate on and off rules", i, r)
+		}
+		for d, on := range r.WDay {
+			if (on == 1) != (time.Weekday(d) == day.Weekday()) {
+				t.Errorf("rule %d on %s has weekdays %v", i, day.Weekday(), r.WDay)
+				break
+			}
+		}
+	}
+	if want := "Jan 10 22:00,Jan 11 01:00,Jan 11 02:00,Jan 11 03:00"; strings.Join(got, ",") != want {
+		t.Errorf("got rules at %v, want %s", got, want)
+	}
+}
+
+func TestWritePlan(t *testing.T) {
+	sched := newFakeRules()
+	keep := sched.add("", map[string]interface{}{"name": "porch", "smin": 600})
+	sched.add("", map[string]interface{}{"name": "tple:plan", "smin": 60})
+	addr := fakeDevice(t, func(req map[string]interface{}) interface{} {
+		if module(req, "time") != nil {
+			return map[string]interface{}{
+				"time": map[string]interface{}{"get_timezone": map[string]interface{}{"index": 18}},
+			}
+		}
+		return map[string]interface{}{"schedule": sched.serve(req, "schedule")}
+	})
+	c, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// 03:00 to 05:00 UTC on a Saturday is 22:00 to 00:00 on the
+	// Friday night in New York, in winter.
+	t0 := time.Date(2024, 1, 13, 3, 0, 0, 0, time.UTC)
+	plan := &PricePlan{Slots: []PlanSlot{{Start: t0, End: t0.Add(2 * time.Hour)}}}
+	if err := c.WritePlan(plan, "tple:plan"); err != nil {
+		t.Fatalf("WritePlan failed: %v", err)
+	}
+	rs := sched.list("")
+	if len(rs) != 3 || rs[0]["id"] != keep {
+		t.Fatalf("got rules %v, want the other rule and two plan rules", rs)
+	}
+	for i, want := range []struct {
+		day, smin, wday float64
+	}{{12, 22 * 60, 5}, {13, 0, 6}} {
+		r := rs[i+1]
+		wday := r["wday"].([]interface{})
+		if r["day"] != want.day || r["smin"] != want.smin || wday[int(want.wday)] != 1.0 {
+			t.Errorf("got rule %v, want day %v at minute %v", r, want.day, want.smin)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package tplinky
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Outlet identifies a device by its address and, for power strips,
+// optionally some of its sockets. With no Sockets, the whole device
+// is addressed.
+type Outlet struct {
+	Addr    string `json:"addr"`
+	Sockets []int  `json:"sockets,omitempty"`
+}
+
+// String returns a readable name for the outlet.
+func (o Outlet) String() string {
+	if len(o.Sockets) == 0 {
+		return o.Addr
+	}
+	return fmt.Sprintf("%s%v", o.Addr, o.Sockets)
+}
+
+// Enable connects to the outlet's device and sets the power state
+// of the outlet.
+func (o Outlet) Enable(on bool, timeout time.Duration) error {
+	c, err := DialTimeout(o.Addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if len(o.Sockets) != 0 {
+		return c.EnableSocket(on, o.Sockets...)
+	}
+	return c.Enable(on)
+}
+
+// EMonState connects to the outlet's device and reads its E-Meter.
+// The reading is for the whole device, even if the outlet only
+// includes some of its sockets.
+func (o Outlet) EMonState(timeout time.Duration) (*EMeterResponse, error) {
+	c, err := DialTimeout(o.Addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return c.EMonState()
+}
+
+// Limit holds the over-power protection limits of an outlet. A zero
+// MaxMA or MaxMW is not checked. A limit is breached when a reading
+// exceeds it, and the outlet is switched off once the limit has been
+// breached continuously for For.
+type Limit struct {
+	Outlet
+	MaxMA int
+	MaxMW int
+	For   time.Duration
+}
+
+// ProtectEvent describes something a Protector observed or did.
+type ProtectEvent struct {
+	When   time.Time
+	Outlet Outlet
+	Kind   string
+	*EMeterResponse
+	Err error
+}
+
+// String summarizes the event.
+func (e ProtectEvent) String() string {
+	s := fmt.Sprintf("%s %s", e.Outlet, e.Kind)
+	if e.EMeterResponse != nil {
+		s += fmt.Sprintf(" %.3fA %.3fW", float64(e.CurrentMA)/1e3, float64(e.PowerMW)/1e3)
+	}
+	if e.Err != nil {
+		s += fmt.Sprintf(": %v", e.Err)
+	}
+	return s
+}
+
+// The kinds of ProtectEvent.
+const (
+	ProtectBreach  = "breach"
+	ProtectTrip    = "trip"
+	ProtectDryRun  = "would trip"
+	ProtectLocked  = "locked out"
+	ProtectReset   = "reset"
+	ProtectCleared = "cleared"
+	ProtectError   = "error"
+)
+
+type protectState struct {
+	over   time.Time
+	locked bool
+}
+
+// Protector watches the E-Meter readings of outlets and switches them
+// off when their Limits are exceeded. A tripped outlet is locked out:
+// it is kept off until Reset is called for it.
+type Protector struct {
+	Limits []*Limit
+
+	// DryRun reports what the Protector would do, but never
+	// switches an outlet off.
+	DryRun bool
+
+	// Timeout is used to connect to the devices. If zero,
+	// DefaultTimeout is used.
+	Timeout time.Duration
+
+	// Log, if not nil, is called with each event.
+	Log func(ProtectEvent)
+
+	mu    sync.Mutex
+	state map[string]*protectState
+}
+
+func (p *Protector) log(e ProtectEvent) {
+	if p.Log != nil {
+		p.Log(e)
+	}
+}
+
+func (p *Protector) timeout() time.Duration {
+	if p.Timeout == 0 {
+		return DefaultTimeout
+	}
+	return p.Timeout
+}
+
+// Locked indicates whether the outlet has been tripped and is
+// locked out.
+func (p *Protector) Locked(o Outlet) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st := p.state[o.String()]
+	return st != nil && st.locked
+}
+
+// Reset clears the lockout of an outlet. It is not switched back on.
+func (p *Protector) Reset(o Outlet) {
+	p.mu.Lock()
+	st := p.state[o.String()]
+	wasLocked := st != nil && st.locked
+	delete(p.state, o.String())
+	p.mu.Unlock()
+	if wasLocked {
+		p.log(ProtectEvent{When: time.Now(), Outlet: o, Kind: ProtectReset})
+	}
+}
+
+// Check reads each limited outlet once, and trips any whose limits
+// have been breached for long enough.
+func (p *Protector) Check(now time.Time) {
+	for _, l := range p.Limits {
+		p.check(now, l)
+	}
+}
+
+func (p *Protector) check(now time.Time, l *Limit) {
+	key := l.Outlet.String()
+	p.mu.Lock()
+	if p.state == nil {
+		p.state = make(map[string]*protectState)
+	}
+	st := p.state[key]
+	if st == nil {
+		st = &protectState{}
+		p.state[key] = st
+	}
+	locked := st.locked
+	p.mu.Unlock()
+
+	if locked {
+		// Keep enforcing the lockout, in case something else
+		// switched the outlet back on.
+		if !p.DryRun {
+			if err := l.Enable(false, p.timeout()); err != nil {
+				p.log(ProtectEvent{When: now, Outlet: l.Outlet, Kind: ProtectError, Err: err})
+			}
+		}
+		return
+	}
+
+	s, err := l.EMonState(p.timeout())
+	if err != nil {
+		p.log(ProtectEvent{When: now, Outlet: l.Outlet, Kind: ProtectError, Err: err})
+		return
+	}
+	over := (l.MaxMA != 0 && s.CurrentMA > l.MaxMA) || (l.MaxMW != 0 && s.PowerMW > l.MaxMW)
+	p.mu.Lock()
+	kind := ""
+	switch {
+	case !over:
+		if !st.over.IsZero() {
+			kind = ProtectCleared
+		}
+		st.over = time.Time{}
+	case st.over.IsZero():
+		st.over = now
+		kind = ProtectBreach
+	}
+	trip := over && now.Sub(st.over) >= l.For
+	if trip {
+		if p.DryRun {
+			st.over = time.Time{}
+		} else {
+			st.locked = true
+		}
+	}
+	p.mu.Unlock()
+
+	if kind != "" {
+		p.log(ProtectEvent{When: now, Outlet: l.Outlet, Kind: kind, EMeterResponse: s})
+	}
+	if !trip {
+		return
+	}
+	if p.DryRun {
+		p.log(ProtectEvent{When: now, Outlet: l.Outlet, Kind: ProtectDryRun, EMeterResponse: s})
+		return
+	}
+	if err := l.Enable(false, p.timeout()); err != nil {
+		p.log(ProtectEvent{When: now, Outlet: l.Outlet, Kind: ProtectError, EMeterResponse: s, Err: err})
+		return
+	}
+	p.log(ProtectEvent{When: now, Outlet: l.Outlet, Kind: ProtectTrip, EMeterResponse: s})
+	p.log(ProtectEvent{When: now, Outlet: l.Outlet, Kind: ProtectLocked})
+}
+
+// Run calls Check every interval until done is closed.
+func (p *Protector) Run(every time.Duration, done <-chan struct{}) {
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+	for {
+		p.Check(time.Now())
+		select {
+		case <-done:
+			return
+		case <-tick.C:
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package tplinky
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestProtectorLockout(t *testing.T) {
+	addr, p := fakePlug(t)
+	var kinds []string
+	pr := &Protector{
+		Limits: []*Limit{{Outlet: Outlet{Addr: addr}, MaxMA: 1500, For: time.Minute}},
+		Log: func(e ProtectEvent) {
+			kinds = append(kinds, e.Kind)
+		},
+	}
+	o := pr.Limits[0].Outlet
+	t0 := time.Date(2025, time.January, 20, 18, 0, 0, 0, time.UTC)
+	at := func(sec int) time.Time { return t0.Add(time.Duration(sec) * time.Second) }
+	expect := func(step string, want ...string) {
+		t.Helper()
+		if !reflect.DeepEqual(kinds, want) {
+			t.Errorf("%s: got events %q, want %q", step, kinds, want)
+		}
+		kinds = nil
+	}
+
+	// A breach that clears before For does not trip.
+	p.set(true, 2000)
+	pr.Check(at(0))
+	p.set(true, 1000)
+	pr.Check(at(30))
+	expect("short breach", ProtectBreach, ProtectCleared)
+
+	p.set(true, 2000)
+	pr.Check(at(60))
+	pr.Check(at(90))
+	expect("breach", ProtectBreach)
+	pr.Check(at(120))
+	expect("trip", ProtectTrip, ProtectLocked)
+	if on, _ := p.state(); on || !pr.Locked(o) {
+		t.Fatalf("after trip: on=%v locked=%v, want off and locked", on, pr.Locked(o))
+	}
+
+	// The lockout is enforced if something switches it back on.
+	p.set(true, 500)
+	pr.Check(at(150))
+	expect("locked")
+	if on, _ := p.state(); on {
+		t.Error("locked out plug was left on")
+	}
+
+	pr.Reset(o)
+	expect("reset", ProtectReset)
+	if pr.Locked(o) {
+		t.Error("still locked after Reset")
+	}
+	pr.Reset(o)
+	expect("second reset")
+	p.set(true, 500)
+	pr.Check(at(180))
+	expect("after reset")
+	if on, _ := p.state(); !on {
+		t.Error("plug switched off after Reset")
+	}
+}
+
+func TestProtectorDryRun(t *testing.T) {
+	addr, p := fakePlug(t)
+	var kinds []string
+	pr := &Protector{
+		Limits: []*Limit{{Outlet: Outlet{Addr: addr}, MaxMW: 100000}},
+		DryRun: true,
+		Log: func(e ProtectEvent) {
+			kinds = append(kinds, e.Kind)
+		},
+	}
+	p.set(true, 1000)
+	now := time.Now()
+	pr.Check(now)
+	pr.Check(now.Add(time.Second))
+	if want := []string{ProtectBreach, ProtectDryRun, ProtectBreach, ProtectDryRun}; !reflect.DeepEqual(kinds, want) {
+		t.Errorf("got events %q, want %q", kinds, want)
+	}
+	if on, switches := p.state(); !on || switches != 0 || pr.Locked(pr.Limits[0].Outlet) {
+		t.Errorf("dry run switched the plug: on=%v switches=%d", on, switches)
+	}
+}
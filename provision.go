@@ -0,0 +1,451 @@
+package tplinky
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrNoPlan is returned when a provisioning plan has no entry for a
+// device.
+var ErrNoPlan = errors.New("no provisioning plan entry for device")
+
+// ProvisionPrefix starts the names of the schedule rules written by
+// a Provisioner.
+const ProvisionPrefix = "plan:"
+
+// DevicePlan describes the configuration of a new device. An entry
+// with a Mac applies to that device; one without applies to the next
+// device provisioned that has no entry of its own. Unset fields are
+// left as they are on the device.
+type DevicePlan struct {
+	Mac       string         `json:"mac,omitempty"`
+	Alias     string         `json:"alias"`
+	Latitude  *float64       `json:"latitude,omitempty"`
+	Longitude *float64       `json:"longitude,omitempty"`
+	TimeZone  string         `json:"timezone,omitempty"`
+	LED       *bool          `json:"led,omitempty"`
+	Schedule  []*ControlRule `json:"schedule,omitempty"`
+	Labels    []string       `json:"labels,omitempty"`
+	SSID      string         `json:"ssid,omitempty"`
+	Password  string         `json:"password,omitempty"`
+}
+
+// ProvisionPlan lists the configuration of a batch of new devices.
+// The SSID and Password apply to the devices that do not give their
+// own. Network is the CIDR subnet on which devices are looked for
+// once they have joined the WiFi network. It is stored as a JSON
+// file.
+type ProvisionPlan struct {
+	SSID     string        `json:"ssid,omitempty"`
+	Password string        `json:"password,omitempty"`
+	Network  string        `json:"network,omitempty"`
+	Devices  []*DevicePlan `json:"devices"`
+}
+
+// LoadProvisionPlan reads a provisioning plan file.
+func LoadProvisionPlan(path string) (*ProvisionPlan, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &ProvisionPlan{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, err
+	}
+	for i, d := range p.Devices {
+		if d.Alias == "" {
+			// The devices do not act on new WiFi settings
+			// until they have an alias.
+			return nil, fmt.Errorf("plan entry %d: no alias", i)
+		}
+		if (d.Latitude == nil) != (d.Longitude == nil) {
+			return nil, fmt.Errorf("plan entry %d: latitude and longitude go together", i)
+		}
+		for _, r := range d.Schedule {
+			if _, err := r.Compile(); err != nil {
+				return nil, fmt.Errorf("plan entry %d: %v", i, err)
+			}
+		}
+		if p.Network == "" && (d.SSID != "" || p.SSID != "") {
+			return nil, fmt.Errorf("plan entry %d: joining WiFi needs the plan network", i)
+		}
+	}
+	return p, nil
+}
+
+// The steps of provisioning a device, in the order they are taken.
+// ProvisionWiFi is journaled just before the WiFi settings are sent,
+// as the device leaves setup mode on taking them, and ProvisionJoined
+// once it is found on the plan network.
+const (
+	ProvisionTime      = "time"
+	ProvisionAlias     = "alias"
+	ProvisionLocation  = "location"
+	ProvisionLED       = "led"
+	ProvisionSchedule  = "schedule"
+	ProvisionWiFi      = "wifi"
+	ProvisionJoined    = "joined"
+	ProvisionInventory = "inventory"
+)
+
+// ProvisionRecord records the progress of provisioning a device.
+// Entry is the index of the device's entry in the plan, and Addr is
+// its address after joining the WiFi network.
+type ProvisionRecord struct {
+	Mac   string   `json:"mac"`
+	Entry int      `json:"entry"`
+	Done  []string `json:"done,omitempty"`
+	Addr  string   `json:"addr,omitempty"`
+}
+
+// done confirms the step has been completed.
+func (r *ProvisionRecord) done(step string) bool {
+	for _, s := range r.Done {
+		if s == step {
+			return true
+		}
+	}
+	return false
+}
+
+// ProvisionJournal records the progress of provisioning, so that an
+// interrupted run can be resumed. It is stored as a JSON file, which
+// is rewritten after each step.
+type ProvisionJournal struct {
+	Devices []*ProvisionRecord `json:"devices"`
+
+	path string
+}
+
+// LoadProvisionJournal reads a journal file. A missing file is
+// treated as an empty journal.
+func LoadProvisionJournal(path string) (*ProvisionJournal, error) {
+	j := &ProvisionJournal{path: path}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Save writes the journal back to its file.
+func (j *ProvisionJournal) Save() error {
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := j.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.path)
+}
+
+// ProvisionEvent describes a step taken by a Provisioner.
+type ProvisionEvent struct {
+	Mac     string
+	Step    string
+	Skipped bool
+	Err     error
+}
+
+// String summarizes the event.
+func (e ProvisionEvent) String() string {
+	switch {
+	case e.Err != nil:
+		return fmt.Sprintf("%s: %s failed: %v", e.Mac, e.Step, e.Err)
+	case e.Skipped:
+		return fmt.Sprintf("%s: %s already done", e.Mac, e.Step)
+	}
+	return fmt.Sprintf("%s: %s done", e.Mac, e.Step)
+}
+
+// Provisioner applies a ProvisionPlan to new devices, in setup mode,
+// one at a time. Progress is kept in the Journal, and steps already
+// taken for a device are skipped, so an interrupted device can be
+// provisioned again.
+type Provisioner struct {
+	Plan    *ProvisionPlan
+	Journal *ProvisionJournal
+
+	// Inventory, if not nil, records the provisioned devices. It is
+	// saved to InventoryPath.
+	Inventory     *Inventory
+	InventoryPath string
+
+	// Wait is how long to wait for a device to appear on the plan
+	// network after it is given its WiFi settings. If zero, 2
+	// minutes is used.
+	Wait time.Duration
+
+	// Timeout is used to connect to the devices once they have
+	// joined the WiFi network. If zero, DefaultTimeout is used.
+	Timeout time.Duration
+
+	// Log, if not nil, is called with each step.
+	Log func(ProvisionEvent)
+}
+
+func (p *Provisioner) timeout() time.Duration {
+	if p.Timeout == 0 {
+		return DefaultTimeout
+	}
+	return p.Timeout
+}
+
+// record finds, or assigns, the journal record of a device.
+func (p *Provisioner) record(mac string) (*ProvisionRecord, error) {
+	used := make(map[int]bool)
+	for _, r := range p.Journal.Devices {
+		if strings.EqualFold(r.Mac, mac) {
+			if r.Entry < 0 || r.Entry >= len(p.Plan.Devices) {
+				return nil, fmt.Errorf("%s: journal entry %d: %w", mac, r.Entry, ErrNoPlan)
+			}
+			return r, nil
+		}
+		used[r.Entry] = true
+	}
+	entry := -1
+	for i, d := range p.Plan.Devices {
+		if strings.EqualFold(d.Mac, mac) {
+			entry = i
+			break
+		}
+		if d.Mac == "" && !used[i] && entry < 0 {
+			entry = i
+		}
+	}
+	if entry < 0 {
+		return nil, fmt.Errorf("%s: %w", mac, ErrNoPlan)
+	}
+	r := &ProvisionRecord{Mac: mac, Entry: entry}
+	p.Journal.Devices = append(p.Journal.Devices, r)
+	return r, p.Journal.Save()
+}
+
+// step takes one step for the device, unless it has already been
+// taken, and journals it.
+func (p *Provisioner) step(r *ProvisionRecord, step string, fn func() error) error {
+	e := ProvisionEvent{Mac: r.Mac, Step: step}
+	if r.done(step) {
+		e.Skipped = true
+	} else if e.Err = fn(); e.Err == nil {
+		r.Done = append(r.Done, step)
+		e.Err = p.Journal.Save()
+	}
+	if p.Log != nil {
+		p.Log(e)
+	}
+	return e.Err
+}
+
+// Provision applies the device's plan entry to the device c is
+// connected to. The device's settings are made in the order: time,
+// alias, location, LED, schedule, WiFi. Sending the WiFi settings is
+// journaled before they are sent, so a device that switches networks
+// without replying, or is not found on the plan network in time, can
+// be found later by Resume. A device that is still in setup mode is
+// sent them again. Once the device has joined the WiFi network, it is
+// recorded in the Inventory.
+func (p *Provisioner) Provision(c *Conn) (*ProvisionRecord, error) {
+	sys, err := c.GetStatus()
+	if err != nil {
+		return nil, err
+	}
+	r, err := p.record(sys.Mac)
+	if err != nil {
+		return nil, err
+	}
+	d := p.Plan.Devices[r.Entry]
+	if err := p.step(r, ProvisionTime, func() error {
+		if d.TimeZone == "" {
+			return c.SetTime(time.Now())
+		}
+		loc, err := time.LoadLocation(d.TimeZone)
+		if err != nil {
+			return err
+		}
+		return c.SetTimeZone(loc)
+	}); err != nil {
+		return r, err
+	}
+	if err := p.step(r, ProvisionAlias, func() error {
+		return c.SetAlias(d.Alias)
+	}); err != nil {
+		return r, err
+	}
+	if d.Latitude != nil {
+		if err := p.step(r, ProvisionLocation, func() error {
+			return c.SetLocation(*d.Latitude, *d.Longitude)
+		}); err != nil {
+			return r, err
+		}
+	}
+	if d.LED != nil {
+		if err := p.step(r, ProvisionLED, func() error {
+			return c.SetLED(*d.LED)
+		}); err != nil {
+			return r, err
+		}
+	}
+	if len(d.Schedule) != 0 {
+		if err := p.step(r, ProvisionSchedule, func() error {
+			return p.schedule(c, d)
+		}); err != nil {
+			return r, err
+		}
+	}
+	ssid, password := d.SSID, d.Password
+	if ssid == "" {
+		ssid, password = p.Plan.SSID, p.Plan.Password
+	}
+	if ssid == "" {
+		r.Addr = strings.TrimSuffix(c.target, ":9999")
+	} else {
+		if !r.done(ProvisionJoined) {
+			if err := p.sendWiFi(c, r, ssid, password); err != nil {
+				return r, err
+			}
+		}
+		if err := p.joined(r); err != nil {
+			return r, err
+		}
+	}
+	return r, p.inventory(r, d)
+}
+
+// sendWiFi journals the WiFi step, then sends the WiFi settings to
+// the device. The device often drops the connection as it switches
+// networks, before it replies, so an error sending the settings is
+// only logged, and the device is looked for on the plan network all
+// the same. The error returned is from saving the Journal.
+func (p *Provisioner) sendWiFi(c *Conn, r *ProvisionRecord, ssid, password string) error {
+	if !r.done(ProvisionWiFi) {
+		r.Done = append(r.Done, ProvisionWiFi)
+		if err := p.Journal.Save(); err != nil {
+			return err
+		}
+	}
+	// Networks the device cannot see are assumed to use WPA2, as
+	// SetWiFi does.
+	_, err := c.SendWiFi(ssid, password, 3)
+	if p.Log != nil {
+		p.Log(ProvisionEvent{Mac: r.Mac, Step: ProvisionWiFi, Err: err})
+	}
+	return nil
+}
+
+// joined waits for a device that has been sent its WiFi settings to
+// appear on the plan network, and journals its address.
+func (p *Provisioner) joined(r *ProvisionRecord) error {
+	return p.step(r, ProvisionJoined, func() error {
+		wait := p.Wait
+		if wait == 0 {
+			wait = 2 * time.Minute
+		}
+		addr, _, err := waitForMac(p.Plan.Network, r.Mac, p.timeout(), wait)
+		if err != nil {
+			return err
+		}
+		r.Addr = addr
+		return nil
+	})
+}
+
+// schedule writes the device's schedule rules.
+func (p *Provisioner) schedule(c *Conn, d *DevicePlan) error {
+	want := make(map[ScheduleTarget][]*ScheduleRule)
+	for _, cr := range d.Schedule {
+		rules, err := cr.Compile()
+		if err != nil {
+			return err
+		}
+		sockets := cr.Sockets
+		if len(sockets) == 0 {
+			sockets = []int{-1}
+		}
+		for _, s := range sockets {
+			t := ScheduleTarget{Addr: c.target, Socket: s}
+			want[t] = append(want[t], rules...)
+		}
+	}
+	for _, t := range ScheduleTargets(want) {
+		if _, err := c.SyncSchedule(t, want[t], ProvisionPrefix, false); err != nil {
+			return err
+		}
+		if err := c.EnableSchedule(true, t.Sockets()...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inventory records a provisioned device in the Inventory.
+func (p *Provisioner) inventory(r *ProvisionRecord, d *DevicePlan) error {
+	if p.Inventory == nil {
+		return nil
+	}
+	return p.step(r, ProvisionInventory, func() error {
+		var sys *Sysinfo
+		if r.Addr != "" {
+			if c, err := DialTimeout(r.Addr, p.timeout()); err == nil {
+				sys, err = c.GetStatus()
+				c.Close()
+			}
+		}
+		if sys == nil {
+			// The device may have moved since it joined the
+			// network in an earlier, interrupted, run.
+			addr := ""
+			if p.Plan.Network != "" {
+				addr, sys = FindMac(p.Plan.Network, r.Mac, p.timeout())
+			}
+			if addr == "" {
+				return fmt.Errorf("%s: %w", r.Mac, ErrNotJoined)
+			}
+			r.Addr = addr
+		}
+		dev := p.Inventory.Update(r.Addr, sys)
+		dev.Labels = d.Labels
+		return p.Inventory.Save(p.InventoryPath)
+	})
+}
+
+// Resume completes the provisioning of the devices in the Journal
+// that were interrupted after being sent their WiFi settings, so are
+// no longer reachable in setup mode. Devices not yet found on the plan
+// network are looked for by their MAC address, and those found are
+// recorded in the Inventory, if there is one.
+func (p *Provisioner) Resume() ([]*ProvisionRecord, error) {
+	var rs []*ProvisionRecord
+	for _, r := range p.Journal.Devices {
+		if !r.done(ProvisionWiFi) {
+			continue
+		}
+		if r.done(ProvisionJoined) && (p.Inventory == nil || r.done(ProvisionInventory)) {
+			continue
+		}
+		if r.Entry < 0 || r.Entry >= len(p.Plan.Devices) {
+			return rs, fmt.Errorf("%s: journal entry %d: %w", r.Mac, r.Entry, ErrNoPlan)
+		}
+		if err := p.joined(r); err != nil {
+			return rs, err
+		}
+		if err := p.inventory(r, p.Plan.Devices[r.Entry]); err != nil {
+			return rs, err
+		}
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
@@ -0,0 +1,86 @@
+package tplinky
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestProvisionWiFiHangup(t *testing.T) {
+	var mu sync.Mutex
+	sent := 0
+	addr := fakeDevice(t, func(req map[string]interface{}) interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		if netif := module(req, "netif"); netif != nil {
+			if _, ok := netif["set_stainfo"]; ok {
+				sent++
+				return hangup{}
+			}
+			return map[string]interface{}{"netif": map[string]interface{}{
+				"get_scaninfo": map[string]interface{}{"ap_list": []interface{}{}},
+			}}
+		}
+		return map[string]interface{}{
+			"system": map[string]interface{}{
+				"get_sysinfo":   map[string]interface{}{"mac": "50:C7:BF:00:00:03"},
+				"set_dev_alias": map[string]interface{}{},
+			},
+			"time": map[string]interface{}{
+				"get_timezone": map[string]interface{}{"index": 6},
+				"set_timezone": map[string]interface{}{},
+			},
+		}
+	})
+	path := filepath.Join(t.TempDir(), "plan.journal")
+	j, err := LoadProvisionJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Provisioner{
+		Plan: &ProvisionPlan{
+			SSID:    "Home",
+			Network: "127.0.0.1/32",
+			Devices: []*DevicePlan{{Alias: "lamp"}},
+		},
+		Journal: j,
+		Wait:    1,
+	}
+	for run := 1; run <= 2; run++ {
+		c, err := Dial(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = p.Provision(c)
+		c.Close()
+		if !errors.Is(err, ErrNotJoined) {
+			t.Fatalf("run %d: got %v, want ErrNotJoined", run, err)
+		}
+		// The journal on disk must show the settings as sent,
+		// though the device never replied.
+		saved, err := LoadProvisionJournal(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := saved.Devices[0]
+		if len(saved.Devices) != 1 || !r.done(ProvisionWiFi) || r.done(ProvisionJoined) {
+			t.Fatalf("run %d: journal %+v, want wifi sent but not joined", run, r)
+		}
+		mu.Lock()
+		if sent != run {
+			t.Errorf("run %d: WiFi settings sent %d times, want %d", run, sent, run)
+		}
+		mu.Unlock()
+	}
+
+	// Resume looks for the device, rather than sending again.
+	if _, err := p.Resume(); !errors.Is(err, ErrNotJoined) {
+		t.Errorf("Resume: got %v, want ErrNotJoined", err)
+	}
+	mu.Lock()
+	if sent != 2 {
+		t.Errorf("Resume sent the WiFi settings again")
+	}
+	mu.Unlock()
+}
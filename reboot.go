@@ -0,0 +1,135 @@
+package tplinky
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+var (
+	// ErrNoReboot is returned by Reboot when the device never
+	// became unreachable.
+	ErrNoReboot = errors.New("device did not reboot")
+
+	// ErrNotBack is returned by Reboot when the device did not come
+	// back online.
+	ErrNotBack = errors.New("device did not come back online")
+
+	// ErrDeviceChanged is returned by Reboot when a different device
+	// answers at the address after the reboot.
+	ErrDeviceChanged = errors.New("a different device answered after reboot")
+)
+
+// The limits on how long Reboot waits for the device to go down and
+// come back, and how often it checks.
+const (
+	rebootDown  = 30 * time.Second
+	rebootUp    = 2 * time.Minute
+	rebootProbe = 250 * time.Millisecond
+)
+
+// probe connects to the device afresh and reads its status.
+func (c *Conn) probe() (*Conn, *Sysinfo, error) {
+	n, err := DialTimeout(c.target, time.Second)
+	if err != nil {
+		return nil, nil, err
+	}
+	sys, err := n.GetStatus()
+	if err != nil {
+		n.Close()
+		return nil, nil, err
+	}
+	return n, sys, nil
+}
+
+// moved looks for the device with the MAC address on the /24 subnet
+// of the old address, as when DHCP gives a rebooted device another
+// address. It returns a connection to the device if it is found.
+func (c *Conn) moved(mac string) *Conn {
+	host, _, err := net.SplitHostPort(c.target)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		return nil
+	}
+	network := fmt.Sprintf("%v/24", ip.Mask(net.CIDRMask(24, 32)))
+	addr, _ := FindMac(network, mac, time.Second)
+	if addr == "" {
+		return nil
+	}
+	n, err := DialTimeout(addr, time.Second)
+	if err != nil {
+		return nil
+	}
+	return n
+}
+
+// Reboot reboots the device after the delay, which is rounded up to
+// whole seconds, and waits for it to drop off the network and come
+// back. Once the same device, by deviceId, answers again, c is
+// reconnected to it. Should nothing answer at the old address, the
+// /24 subnet of that address is scanned for the device's MAC, and c
+// is reconnected to the device at its new address, see Addr. A
+// device that moves to another subnet is not found. Reboot returns
+// how long the device was unreachable, to within a fraction of a
+// second.
+func (c *Conn) Reboot(delay time.Duration) (time.Duration, error) {
+	sys, err := c.GetStatus()
+	if err != nil {
+		return 0, err
+	}
+	secs := int((delay + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	if _, err := c.Send(Control{
+		System: &SystemCommands{
+			Reboot: &SystemCommandParameters{
+				Delay: &secs,
+			},
+		},
+	}); err != nil {
+		return 0, err
+	}
+
+	var down time.Time
+	for deadline := time.Now().Add(time.Duration(secs)*time.Second + rebootDown); ; {
+		time.Sleep(rebootProbe)
+		n, _, err := c.probe()
+		if err != nil {
+			down = time.Now()
+			break
+		}
+		n.Close()
+		if time.Now().After(deadline) {
+			return 0, ErrNoReboot
+		}
+	}
+
+	for deadline := down.Add(rebootUp); ; {
+		n, got, err := c.probe()
+		if err == nil {
+			downtime := time.Since(down)
+			if got.DeviceID != sys.DeviceID {
+				n.Close()
+				return downtime, fmt.Errorf("%w: %s", ErrDeviceChanged, got.DeviceID)
+			}
+			c.conn.Close()
+			c.conn = n.conn
+			return downtime, nil
+		}
+		if time.Now().After(deadline) {
+			downtime := time.Since(down)
+			if n := c.moved(sys.Mac); n != nil {
+				c.conn.Close()
+				c.conn, c.target = n.conn, n.target
+				return downtime, nil
+			}
+			return downtime, ErrNotBack
+		}
+		time.Sleep(rebootProbe)
+	}
+}
@@ -0,0 +1,95 @@
+package tplinky
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRebooter serves a plug that, when told to reboot, stops
+// listening after the requested delay and listens again, as the
+// device with deviceId after, once it has been off for the given
+// time.
+func fakeRebooter(t *testing.T, off time.Duration, after string) string {
+	var mu sync.Mutex
+	id := "8006"
+	var l net.Listener
+	var handle func(req map[string]interface{}) interface{}
+	handle = func(req map[string]interface{}) interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		sys := module(req, "system")
+		resp := make(map[string]interface{})
+		if r, ok := sys["reboot"].(map[string]interface{}); ok {
+			delay := time.Duration(r["delay"].(float64)) * time.Second
+			go func() {
+				time.Sleep(delay)
+				mu.Lock()
+				addr := l.Addr().String()
+				l.Close()
+				mu.Unlock()
+				time.Sleep(off)
+				mu.Lock()
+				defer mu.Unlock()
+				n, err := net.Listen("tcp", addr)
+				if err != nil {
+					return
+				}
+				l, id = n, after
+				serveDevice(l, handle)
+			}()
+			resp["reboot"] = map[string]interface{}{"err_code": 0}
+		}
+		if _, ok := sys["get_sysinfo"]; ok {
+			resp["get_sysinfo"] = map[string]interface{}{
+				"mac":      "50:C7:BF:00:00:02",
+				"deviceId": id,
+			}
+		}
+		return map[string]interface{}{"system": resp}
+	}
+	var err error
+	if l, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	t.Cleanup(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		l.Close()
+	})
+	serveDevice(l, handle)
+	return l.Addr().String()
+}
+
+func TestRebootWait(t *testing.T) {
+	const off = time.Second
+	tests := []struct {
+		after string
+		want  error
+	}{
+		{"8006", nil},
+		{"8007", ErrDeviceChanged},
+	}
+	for _, tc := range tests {
+		addr := fakeRebooter(t, off, tc.after)
+		c, err := DialTimeout(addr, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		down, err := c.Reboot(0)
+		if !errors.Is(err, tc.want) {
+			t.Errorf("rebooting to %s: got %v, want %v", tc.after, err, tc.want)
+		}
+		if down < off-rebootProbe || down > off+2*rebootProbe {
+			t.Errorf("rebooting to %s: unreachable for %v, want about %v", tc.after, down, off)
+		}
+		if err == nil {
+			if sys, err := c.GetStatus(); err != nil || sys.DeviceID != tc.after {
+				t.Errorf("after reboot got %+v, %v, want the rebooted device", sys, err)
+			}
+		}
+		c.Close()
+	}
+}
@@ -0,0 +1,375 @@
+package tplinky
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNoSchedule is returned if the target device failed to perform
+// schedule commands.
+var ErrNoSchedule = errors.New("no schedule responded")
+
+// The ScheduleRule time options, selecting how SMin and EMin are
+// interpreted.
+const (
+	TimeFixed   = 0
+	TimeSunrise = 1
+	TimeSunset  = 2
+)
+
+// ruleError converts the error code of a rule command result into an
+// error.
+func ruleError(module string, code int, msg string) error {
+	if code == 0 {
+		return nil
+	}
+	if msg != "" {
+		return fmt.Errorf("%s error %d: %s", module, code, msg)
+	}
+	return fmt.Errorf("%s error %d", module, code)
+}
+
+// childContext returns the control context that selects the
+// specified sockets of a power strip, or nil if no sockets are
+// specified.
+func (c *Conn) childContext(sockets []int) (*ControlContext, error) {
+	if len(sockets) == 0 {
+		return nil, nil
+	}
+	current, err := c.GetStatus()
+	if err != nil {
+		return nil, err
+	}
+	ctx := &ControlContext{}
+	for _, i := range sockets {
+		if i < 0 || i >= len(current.Children) {
+			return nil, fmt.Errorf("socket=%d not found in %d sockets", i, len(current.Children))
+		}
+		ctx.ChildIDs = append(ctx.ChildIDs, current.Children[i].ID)
+	}
+	return ctx, nil
+}
+
+// sendSchedule sends a schedule command to the device, for the
+// specified sockets of a power strip.
+func (c *Conn) sendSchedule(cmd *Schedule, sockets []int) (*ScheduleResponse, error) {
+	ctx, err := c.childContext(sockets)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.Send(Control{
+		Context:  ctx,
+		Schedule: cmd,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Schedule == nil {
+		return nil, ErrNoSchedule
+	}
+	return resp.Schedule, nil
+}
+
+// ScheduleRules lists the device's schedule rules. For a power
+// strip, the rules of specific sockets can be selected.
+func (c *Conn) ScheduleRules(sockets ...int) ([]*ScheduleRule, error) {
+	rules, _, err := c.scheduleRules(sockets)
+	return rules, err
+}
+
+// ScheduleEnabled indicates whether the device's schedule as a whole
+// is enabled.
+func (c *Conn) ScheduleEnabled(sockets ...int) (bool, error) {
+	_, on, err := c.scheduleRules(sockets)
+	return on, err
+}
+
+func (c *Conn) scheduleRules(sockets []int) ([]*ScheduleRule, bool, error) {
+	resp, err := c.sendSchedule(&Schedule{
+		GetRules: &RuleList{},
+	}, sockets)
+	if err != nil {
+		return nil, false, err
+	}
+	r := resp.GetRules
+	if r == nil {
+		return nil, false, ErrNoSchedule
+	}
+	if err := ruleError("schedule", r.ErrCode, r.ErrMsg); err != nil {
+		return nil, false, err
+	}
+	var rules []*ScheduleRule
+	if len(r.RuleList) != 0 {
+		if err := json.Unmarshal(r.RuleList, &rules); err != nil {
+			return nil, false, err
+		}
+	}
+	return rules, r.Enable != 0, nil
+}
+
+// AddScheduleRule adds a rule to the device's schedule, returning
+// the identifier the device assigned to it.
+func (c *Conn) AddScheduleRule(rule *ScheduleRule, sockets ...int) (string, error) {
+	r := *rule
+	r.ID = ""
+	resp, err := c.sendSchedule(&Schedule{
+		AddRule: &r,
+	}, sockets)
+	if err != nil {
+		return "", err
+	}
+	if resp.AddRule == nil {
+		return "", ErrNoSchedule
+	}
+	if err := ruleError("schedule", resp.AddRule.ErrCode, resp.AddRule.ErrMsg); err != nil {
+		return "", err
+	}
+	return resp.AddRule.ID, nil
+}
+
+// EditScheduleRule replaces the device's schedule rule that has the
+// same ID as rule.
+func (c *Conn) EditScheduleRule(rule *ScheduleRule, sockets ...int) error {
+	if rule.ID == "" {
+		return errors.New("schedule rule has no id")
+	}
+	resp, err := c.sendSchedule(&Schedule{
+		EditRule: rule,
+	}, sockets)
+	if err != nil {
+		return err
+	}
+	if resp.EditRule == nil {
+		return ErrNoSchedule
+	}
+	return ruleError("schedule", resp.EditRule.ErrCode, resp.EditRule.ErrMsg)
+}
+
+// DeleteScheduleRule deletes a rule from the device's schedule.
+func (c *Conn) DeleteScheduleRule(id string, sockets ...int) error {
+	resp, err := c.sendSchedule(&Schedule{
+		DeleteRule: &RuleResult{ID: id},
+	}, sockets)
+	if err != nil {
+		return err
+	}
+	if resp.DeleteRule == nil {
+		return ErrNoSchedule
+	}
+	return ruleError("schedule", resp.DeleteRule.ErrCode, resp.DeleteRule.ErrMsg)
+}
+
+// DeleteAllScheduleRules deletes all of the rules from the device's
+// schedule.
+func (c *Conn) DeleteAllScheduleRules(sockets ...int) error {
+	resp, err := c.sendSchedule(&Schedule{
+		DeleteAllRules: &RuleResult{},
+	}, sockets)
+	if err != nil {
+		return err
+	}
+	if resp.DeleteAllRules == nil {
+		return ErrNoSchedule
+	}
+	return ruleError("schedule", resp.DeleteAllRules.ErrCode, resp.DeleteAllRules.ErrMsg)
+}
+
+// EnableSchedule enables or disables the device's schedule as a
+// whole. The rules themselves are left unchanged.
+func (c *Conn) EnableSchedule(on bool, sockets ...int) error {
+	en := 0
+	if on {
+		en = 1
+	}
+	resp, err := c.sendSchedule(&Schedule{
+		SetOverallEnable: &RuleResult{Enable: &en},
+	}, sockets)
+	if err != nil {
+		return err
+	}
+	if resp.SetOverallEnable == nil {
+		return ErrNoSchedule
+	}
+	return ruleError("schedule", resp.SetOverallEnable.ErrCode, resp.SetOverallEnable.ErrMsg)
+}
+
+// weekdays holds the abbreviated day names used in rule specs, in
+// ScheduleRule.WDay order.
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// parseRuleTime parses a rule spec time: "HH:MM", "sunrise" or
+// "sunset", the latter two optionally followed by a signed offset in
+// minutes, as in "sunset+15".
+func parseRuleTime(s string) (opt, min, offset int, err error) {
+	for _, sun := range []struct {
+		name string
+		opt  int
+	}{{"sunrise", TimeSunrise}, {"sunset", TimeSunset}} {
+		if !strings.HasPrefix(s, sun.name) {
+			continue
+		}
+		if rest := s[len(sun.name):]; rest != "" {
+			if offset, err = strconv.Atoi(rest); err != nil || (rest[0] != '+' && rest[0] != '-') {
+				return 0, 0, 0, fmt.Errorf("invalid offset in %q", s)
+			}
+		}
+		return sun.opt, 0, offset, nil
+	}
+	min, err = parseClock(s)
+	if min == 24*60 {
+		min = 0
+	}
+	return TimeFixed, min, 0, err
+}
+
+// formatRuleTime is the inverse of parseRuleTime.
+func formatRuleTime(opt, min, offset int) string {
+	var s string
+	switch opt {
+	case TimeSunrise:
+		s = "sunrise"
+	case TimeSunset:
+		s = "sunset"
+	default:
+		return fmt.Sprintf("%02d:%02d", min/60, min%60)
+	}
+	if offset != 0 {
+		s += fmt.Sprintf("%+d", offset)
+	}
+	return s
+}
+
+// parseRuleDays parses the days of a rule spec: "daily", "weekdays",
+// "weekends", a comma separated list of "sun", "mon", etc, or a
+// "YYYY-MM-DD" date for a rule that fires once.
+func parseRuleDays(f string, wday *[]int, repeat, year, month, day *int) error {
+	switch f {
+	case "daily":
+		*wday = []int{1, 1, 1, 1, 1, 1, 1}
+		return nil
+	case "weekdays":
+		*wday = []int{0, 1, 1, 1, 1, 1, 0}
+		return nil
+	case "weekends":
+		*wday = []int{1, 0, 0, 0, 0, 0, 1}
+		return nil
+	}
+	if t, err := time.Parse("2006-01-02", f); err == nil {
+		*repeat = 0
+		*wday = make([]int, 7)
+		(*wday)[t.Weekday()] = 1
+		*year, *month, *day = t.Year(), int(t.Month()), t.Day()
+		return nil
+	}
+	ds := make([]int, 7)
+	for _, d := range strings.Split(f, ",") {
+		found := false
+		for i, w := range weekdays {
+			if d == w {
+				ds[i] = 1
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("unrecognized %q", d)
+		}
+	}
+	*wday = ds
+	return nil
+}
+
+// formatRuleDays is the inverse of parseRuleDays.
+func formatRuleDays(wday []int, repeat, year, month, day int) string {
+	switch days := fmt.Sprint(wday); {
+	case repeat == 0:
+		return fmt.Sprintf("%04d-%02d-%02d", year, month, day)
+	case days == "[1 1 1 1 1 1 1]":
+		return "daily"
+	case days == "[0 1 1 1 1 1 0]":
+		return "weekdays"
+	case days == "[1 0 0 0 0 0 1]":
+		return "weekends"
+	}
+	var ds []string
+	for i, on := range wday {
+		if on != 0 && i < len(weekdays) {
+			ds = append(ds, weekdays[i])
+		}
+	}
+	return strings.Join(ds, ",")
+}
+
+// ParseScheduleRule parses a rule spec of the form
+//
+//	<on|off> <time> [<on|off> <time>] [<days>] [disabled]
+//
+// where each time is "HH:MM", "sunrise" or "sunset", with an optional
+// offset in minutes such as "sunset-30", and days is "daily",
+// "weekdays", "weekends", a comma separated list of "sun", "mon",
+// etc, or a "YYYY-MM-DD" date for a rule that fires once. Rules
+// repeat daily by default. For example, "on sunset+15 off 23:00
+// weekdays".
+func ParseScheduleRule(spec string) (*ScheduleRule, error) {
+	fields := strings.Fields(strings.ToLower(spec))
+	r := &ScheduleRule{
+		Enable:   1,
+		Repeat:   1,
+		WDay:     []int{1, 1, 1, 1, 1, 1, 1},
+		ETimeOpt: -1,
+		EAct:     -1,
+	}
+	actions := 0
+	for len(fields) > 1 && (fields[0] == "on" || fields[0] == "off") && actions < 2 {
+		act := 0
+		if fields[0] == "on" {
+			act = 1
+		}
+		opt, min, offset, err := parseRuleTime(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("bad rule %q: %v", spec, err)
+		}
+		if actions == 0 {
+			r.SAct, r.STimeOpt, r.SMin, r.SOffset = act, opt, min, offset
+		} else {
+			r.EAct, r.ETimeOpt, r.EMin, r.EOffset = act, opt, min, offset
+		}
+		actions++
+		fields = fields[2:]
+	}
+	if actions == 0 {
+		return nil, fmt.Errorf("bad rule %q: want <on|off> <time>", spec)
+	}
+	for _, f := range fields {
+		if f == "disabled" {
+			r.Enable = 0
+			continue
+		}
+		if err := parseRuleDays(f, &r.WDay, &r.Repeat, &r.Year, &r.Month, &r.Day); err != nil {
+			return nil, fmt.Errorf("bad rule %q: %v", spec, err)
+		}
+	}
+	return r, nil
+}
+
+// String formats the rule in the form accepted by ParseScheduleRule.
+func (r *ScheduleRule) String() string {
+	act := func(a int) string {
+		if a == 0 {
+			return "off"
+		}
+		return "on"
+	}
+	s := act(r.SAct) + " " + formatRuleTime(r.STimeOpt, r.SMin, r.SOffset)
+	if r.EAct >= 0 && r.ETimeOpt >= 0 {
+		s += " " + act(r.EAct) + " " + formatRuleTime(r.ETimeOpt, r.EMin, r.EOffset)
+	}
+	s += " " + formatRuleDays(r.WDay, r.Repeat, r.Year, r.Month, r.Day)
+	if r.Enable == 0 {
+		s += " disabled"
+	}
+	return s
+}
@@ -0,0 +1,216 @@
+package tplinky
+
+import (
+	"fmt"
+	"time"
+)
+
+// ShedEvent describes something a Circuit observed or did.
+type ShedEvent struct {
+	When    time.Time
+	Circuit string
+	Outlet  Outlet
+	Kind    string
+	TotalMA int
+	Err     error
+}
+
+// String summarizes the event.
+func (e ShedEvent) String() string {
+	s := fmt.Sprintf("%s: %s %s (total %.3fA)", e.Circuit, e.Kind, e.Outlet, float64(e.TotalMA)/1e3)
+	if e.Err != nil {
+		s += fmt.Sprintf(": %v", e.Err)
+	}
+	return s
+}
+
+// The kinds of ShedEvent.
+const (
+	ShedOff     = "shed"
+	ShedOn      = "restore"
+	ShedDryOff  = "would shed"
+	ShedDryOn   = "would restore"
+	ShedError   = "error"
+	ShedOverrun = "over budget"
+)
+
+type shedLoad struct {
+	Outlet
+	at time.Time
+	ma int
+}
+
+// Circuit is a group of outlets that share a breaker. When their
+// combined current draw exceeds the budget, loads are switched off
+// one at a time in priority order, and they are restored, in
+// reverse order, once there is enough headroom to do so.
+type Circuit struct {
+	Name string
+
+	// BudgetMA is the combined current draw allowed on the
+	// circuit.
+	BudgetMA int
+
+	// A shed load is only restored once the circuit's current
+	// draw plus the draw of the load when it was shed is at
+	// least MarginMA below the budget, and has stayed so for
+	// Hold. A shed load stays off for at least MinOff.
+	MarginMA int
+	Hold     time.Duration
+	MinOff   time.Duration
+
+	// Loads lists the outlets on the circuit in the order they
+	// are shed.
+	Loads []Outlet
+
+	// DryRun reports what the Circuit would do, but never
+	// switches an outlet.
+	DryRun bool
+
+	// Timeout is used to connect to the devices. If zero,
+	// DefaultTimeout is used.
+	Timeout time.Duration
+
+	// Log, if not nil, is called with each event.
+	Log func(ShedEvent)
+
+	shed     []shedLoad
+	headroom time.Time
+}
+
+// CircuitFromInventory creates a Circuit from the inventory devices
+// that carry the label. Devices listed in order, by address, MAC
+// address or alias, are shed first and in that sequence. The other
+// labeled devices follow in inventory order.
+func CircuitFromInventory(inv *Inventory, label string, budgetMA int, order ...string) *Circuit {
+	c := &Circuit{
+		Name:     label,
+		BudgetMA: budgetMA,
+	}
+	labeled := inv.Labeled(label)
+	used := make(map[*InventoryDevice]bool)
+	for _, key := range order {
+		if d := inv.Find(key); d != nil && d.HasLabel(label) && !used[d] {
+			used[d] = true
+			c.Loads = append(c.Loads, Outlet{Addr: d.Addr})
+		}
+	}
+	for _, d := range labeled {
+		if !used[d] {
+			c.Loads = append(c.Loads, Outlet{Addr: d.Addr})
+		}
+	}
+	return c
+}
+
+func (c *Circuit) log(e ShedEvent) {
+	e.Circuit = c.Name
+	if c.Log != nil {
+		c.Log(e)
+	}
+}
+
+func (c *Circuit) timeout() time.Duration {
+	if c.Timeout == 0 {
+		return DefaultTimeout
+	}
+	return c.Timeout
+}
+
+// Shed returns the outlets that are currently shed.
+func (c *Circuit) Shed() []Outlet {
+	var outs []Outlet
+	for _, l := range c.shed {
+		outs = append(outs, l.Outlet)
+	}
+	return outs
+}
+
+// isShed confirms the outlet is currently shed.
+func (c *Circuit) isShed(o Outlet) bool {
+	for _, l := range c.shed {
+		if l.String() == o.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// Check reads all of the loads on the circuit once, and sheds or
+// restores at most one load. It returns the combined current draw of
+// the circuit. Unreachable loads are treated as drawing no current.
+func (c *Circuit) Check(now time.Time) int {
+	total := 0
+	draw := make(map[string]int)
+	for _, o := range c.Loads {
+		s, err := o.EMonState(c.timeout())
+		if err != nil {
+			c.log(ShedEvent{When: now, Outlet: o, Kind: ShedError, Err: err})
+			continue
+		}
+		total += s.CurrentMA
+		draw[o.String()] = s.CurrentMA
+	}
+
+	if total > c.BudgetMA {
+		c.headroom = time.Time{}
+		for _, o := range c.Loads {
+			if c.isShed(o) || draw[o.String()] == 0 {
+				continue
+			}
+			kind := ShedOff
+			if c.DryRun {
+				kind = ShedDryOff
+			} else if err := o.Enable(false, c.timeout()); err != nil {
+				c.log(ShedEvent{When: now, Outlet: o, Kind: ShedError, TotalMA: total, Err: err})
+				continue
+			}
+			c.shed = append(c.shed, shedLoad{Outlet: o, at: now, ma: draw[o.String()]})
+			c.log(ShedEvent{When: now, Outlet: o, Kind: kind, TotalMA: total})
+			return total
+		}
+		c.log(ShedEvent{When: now, Kind: ShedOverrun, TotalMA: total})
+		return total
+	}
+
+	n := len(c.shed)
+	if n == 0 {
+		return total
+	}
+	last := c.shed[n-1]
+	if now.Sub(last.at) < c.MinOff || total+last.ma > c.BudgetMA-c.MarginMA {
+		c.headroom = time.Time{}
+		return total
+	}
+	if c.headroom.IsZero() {
+		c.headroom = now
+	}
+	if now.Sub(c.headroom) < c.Hold {
+		return total
+	}
+	kind := ShedOn
+	if c.DryRun {
+		kind = ShedDryOn
+	} else if err := last.Enable(true, c.timeout()); err != nil {
+		c.log(ShedEvent{When: now, Outlet: last.Outlet, Kind: ShedError, TotalMA: total, Err: err})
+		return total
+	}
+	c.shed = c.shed[:n-1]
+	c.headroom = time.Time{}
+	c.log(ShedEvent{When: now, Outlet: last.Outlet, Kind: kind, TotalMA: total})
+	return total
+}
+
+// Run calls Check every interval until done is closed.
+func (c *Circuit) Run(every time.Duration, done <-chan struct{}) {
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+	for {
+		c.Check(time.Now())
+		select {
+		case <-done:
+			return
+		case <-tick.C:
+		}
+	}
+}
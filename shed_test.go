@@ -0,0 +1,77 @@
+package tplinky
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCircuitShedRestore(t *testing.T) {
+	var addrs []string
+	var plugs []*plug
+	for i := 0; i < 3; i++ {
+		addr, p := fakePlug(t)
+		addrs = append(addrs, addr)
+		plugs = append(plugs, p)
+	}
+	name := map[string]string{addrs[0]: "a", addrs[1]: "b", addrs[2]: "c"}
+	var got []string
+	c := &Circuit{
+		Name:     "kitchen",
+		BudgetMA: 3000,
+		MarginMA: 200,
+		Hold:     time.Minute,
+		MinOff:   2 * time.Minute,
+		Loads:    []Outlet{{Addr: addrs[0]}, {Addr: addrs[1]}, {Addr: addrs[2]}},
+		Log: func(e ShedEvent) {
+			got = append(got, e.Kind+" "+name[e.Outlet.Addr])
+		},
+	}
+	t0 := time.Date(2025, time.February, 1, 7, 0, 0, 0, time.UTC)
+	steps := []struct {
+		sec   int
+		ma    [3]int
+		total int
+		want  []string
+	}{
+		{0, [3]int{1000, 1500, 1500}, 4000, []string{"shed a"}},
+		{30, [3]int{1000, 1500, 2000}, 3500, []string{"shed b"}},
+		// Within MinOff of the last load shed, nothing is
+		// restored.
+		{60, [3]int{1000, 1500, 500}, 500, nil},
+		{150, [3]int{1000, 1500, 500}, 500, nil},
+		{180, [3]int{1000, 1500, 500}, 500, nil},
+		// The last load shed is restored first, once there has
+		// been headroom for Hold.
+		{210, [3]int{1000, 1500, 500}, 500, []string{"restore b"}},
+		// Restoring a would leave less than MarginMA.
+		{240, [3]int{1000, 1500, 500}, 2000, nil},
+		{270, [3]int{1000, 1000, 500}, 1500, nil},
+		{330, [3]int{1000, 1000, 500}, 1500, []string{"restore a"}},
+		{360, [3]int{1000, 1000, 500}, 2500, nil},
+	}
+	for _, s := range steps {
+		for i, p := range plugs {
+			on, _ := p.state()
+			if s.sec == 0 {
+				on = true
+			}
+			p.set(on, s.ma[i])
+		}
+		got = nil
+		if total := c.Check(t0.Add(time.Duration(s.sec) * time.Second)); total != s.total {
+			t.Errorf("at %ds: got total %dmA, want %d", s.sec, total, s.total)
+		}
+		if !reflect.DeepEqual(got, s.want) {
+			t.Errorf("at %ds: got events %q, want %q", s.sec, got, s.want)
+		}
+	}
+	if shed := c.Shed(); len(shed) != 0 {
+		t.Errorf("got loads %v still shed", shed)
+	}
+	for i, want := range []int{2, 2, 0} {
+		if on, switches := plugs[i].state(); !on || switches != want {
+			t.Errorf("plug %d: on=%v after %d switches, want on after %d", i, on, switches, want)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package tplinky
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signal is a source of a numeric value, such as the power a solar
+// inverter is exporting, that can be used to drive outlets.
+type Signal interface {
+	Value() (float64, error)
+}
+
+// parseSignal extracts a number from data. With an empty field, the
+// whole of data is expected to be a number. Otherwise, data is a JSON
+// document and field is a dot separated path to a number within it.
+// Elements of a JSON array are selected by numerical index.
+func parseSignal(data []byte, field string) (float64, error) {
+	if field == "" {
+		return strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+	}
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return 0, err
+	}
+	for _, key := range strings.Split(field, ".") {
+		switch x := v.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if v, ok = x[key]; !ok {
+				return 0, fmt.Errorf("field %q not found", field)
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(x) {
+				return 0, fmt.Errorf("field %q not found", field)
+			}
+			v = x[i]
+		default:
+			return 0, fmt.Errorf("field %q not found", field)
+		}
+	}
+	switch x := v.(type) {
+	case float64:
+		return x, nil
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(x), 64)
+	}
+	return 0, fmt.Errorf("field %q is not a number", field)
+}
+
+// HTTPSignal reads a number from a document served over HTTP. See
+// FileSignal for the meaning of Field.
+type HTTPSignal struct {
+	URL   string
+	Field string
+
+	// Client, if not nil, is used to make the request.
+	Client *http.Client
+}
+
+// Value fetches the URL and extracts the number.
+func (s *HTTPSignal) Value() (float64, error) {
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: DefaultTimeout}
+	}
+	resp, err := client.Get(s.URL)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s: %s", s.URL, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	return parseSignal(data, s.Field)
+}
+
+// FileSignal reads a number from a file. If Field is empty, the file
+// holds just the number. Otherwise, the file is a JSON document and
+// Field is a dot separated path to the number, for example
+// "site.grid.export_w".
+type FileSignal struct {
+	Path  string
+	Field string
+}
+
+// Value reads the file and extracts the number.
+func (s *FileSignal) Value() (float64, error) {
+	data, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		return 0, err
+	}
+	return parseSignal(data, s.Field)
+}
+
+// CommandSignal runs a command and reads a number from its output.
+// See FileSignal for the meaning of Field.
+type CommandSignal struct {
+	Args  []string
+	Field string
+}
+
+// Value runs the command and extracts the number.
+func (s *CommandSignal) Value() (float64, error) {
+	if len(s.Args) == 0 {
+		return 0, fmt.Errorf("no command")
+	}
+	data, err := exec.Command(s.Args[0], s.Args[1:]...).Output()
+	if err != nil {
+		return 0, err
+	}
+	return parseSignal(data, s.Field)
+}
+
+// SignalEvent describes something a SignalSwitch observed or did.
+type SignalEvent struct {
+	When  time.Time
+	Value float64
+	On    bool
+	Err   error
+}
+
+// String summarizes the event.
+func (e SignalEvent) String() string {
+	if e.Err != nil {
+		return fmt.Sprintf("signal error: %v", e.Err)
+	}
+	state := "off"
+	if e.On {
+		state = "on"
+	}
+	return fmt.Sprintf("signal=%g: switched %s", e.Value, state)
+}
+
+// SignalSwitch switches outlets on while a Signal is high. The
+// outlets are switched on when the signal rises above OnAbove, and
+// switched off when it falls below OffBelow, which should be lower
+// to avoid flapping. Once switched, the outlets stay on for at least
+// MinOn, or off for at least MinOff.
+type SignalSwitch struct {
+	Signal  Signal
+	Outlets []Outlet
+
+	OnAbove  float64
+	OffBelow float64
+	MinOn    time.Duration
+	MinOff   time.Duration
+
+	// FailOff switches the outlets off when the signal cannot be
+	// read. Otherwise, they are left as they are.
+	FailOff bool
+
+	// Timeout is used to connect to the devices. If zero,
+	// DefaultTimeout is used.
+	Timeout time.Duration
+
+	// Log, if not nil, is called with each event.
+	Log func(SignalEvent)
+
+	known   bool
+	on      bool
+	changed time.Time
+}
+
+func (s *SignalSwitch) log(e SignalEvent) {
+	if s.Log != nil {
+		s.Log(e)
+	}
+}
+
+func (s *SignalSwitch) timeout() time.Duration {
+	if s.Timeout == 0 {
+		return DefaultTimeout
+	}
+	return s.Timeout
+}
+
+// On indicates whether the outlets were last switched on.
+func (s *SignalSwitch) On() bool {
+	return s.on
+}
+
+// set switches all of the outlets on or off.
+func (s *SignalSwitch) set(now time.Time, on bool, value float64) error {
+	var err error
+	for _, o := range s.Outlets {
+		if e := o.Enable(on, s.timeout()); e != nil {
+			err = e
+			s.log(SignalEvent{When: now, Value: value, On: on, Err: fmt.Errorf("%s: %v", o, e)})
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if !s.known || s.on != on {
+		s.changed = now
+	}
+	s.known = true
+	s.on = on
+	s.log(SignalEvent{When: now, Value: value, On: on})
+	return nil
+}
+
+// Check reads the signal once and switches the outlets if needed.
+func (s *SignalSwitch) Check(now time.Time) error {
+	v, err := s.Signal.Value()
+	if err != nil {
+		s.log(SignalEvent{When: now, Err: err})
+		if s.FailOff && (!s.known || s.on) {
+			return s.set(now, false, 0)
+		}
+		return err
+	}
+	if !s.known {
+		return s.set(now, v > s.OnAbove, v)
+	}
+	if s.on {
+		if v < s.OffBelow && now.Sub(s.changed) >= s.MinOn {
+			return s.set(now, false, v)
+		}
+	} else if v > s.OnAbove && now.Sub(s.changed) >= s.MinOff {
+		return s.set(now, true, v)
+	}
+	return nil
+}
+
+// Run calls Check every interval until done is closed.
+func (s *SignalSwitch) Run(every time.Duration, done <-chan struct{}) {
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+	for {
+		s.Check(time.Now())
+		select {
+		case <-done:
+			return
+		case <-tick.C:
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package tplinky
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSignalSwitchHTTP(t *testing.T) {
+	var mu sync.Mutex
+	value := ""
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if value == "" {
+			http.Error(w, "inverter offline", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, `{"site":{"grid":[{"export_w":%s}]}}`, value)
+	}))
+	defer srv.Close()
+	addr, p := fakePlug(t)
+
+	s := &SignalSwitch{
+		Signal:   &HTTPSignal{URL: srv.URL, Field: "site.grid.0.export_w"},
+		Outlets:  []Outlet{{Addr: addr}},
+		OnAbove:  1000,
+		OffBelow: 200,
+		MinOn:    10 * time.Minute,
+		MinOff:   5 * time.Minute,
+		FailOff:  true,
+	}
+	start := time.Date(2025, time.July, 5, 11, 0, 0, 0, time.UTC)
+	steps := []struct {
+		at       time.Duration
+		value    string
+		on       bool
+		switches int
+	}{
+		{0, "500", false, 0},               // First reading sets the state.
+		{time.Minute, "1500", false, 0},    // Off for less than MinOff.
+		{6 * time.Minute, "1500", true, 1}, // Switched on.
+		{7 * time.Minute, "500", true, 1},  // Above OffBelow.
+		{8 * time.Minute, "100", true, 1},  // On for less than MinOn.
+		{16 * time.Minute, "100", false, 2},
+		{17 * time.Minute, "900", false, 2}, // Below OnAbove.
+		{22 * time.Minute, "1200", true, 3},
+		{23 * time.Minute, "", false, 4}, // FailOff.
+	}
+	for _, step := range steps {
+		mu.Lock()
+		value = step.value
+		mu.Unlock()
+		now := start.Add(step.at)
+		s.Check(now)
+		on, switches := p.state()
+		if on != step.on || s.On() != step.on || switches != step.switches {
+			t.Errorf("at %v, signal %q: got on=%v (switch says %v) after %d switches, want on=%v after %d", step.at, step.value, on, s.On(), switches, step.on, step.switches)
+		}
+	}
+}
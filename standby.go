@@ -0,0 +1,280 @@
+package tplinky
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ErrNoStandbyHistory is returned when there are too few readings
+// to learn a standby baseline.
+var ErrNoStandbyHistory = errors.New("not enough power readings to learn standby")
+
+// LearnStandby estimates the standby power draw of an appliance from
+// a history of its power readings. Zero readings, when the plug was
+// off, are ignored. The baseline is the 10th percentile of the
+// remaining readings, and the returned threshold is halfway again
+// above it, but at least one watt above it.
+func LearnStandby(powerMW []int) (baselineMW, thresholdMW int, err error) {
+	var ps []int
+	for _, p := range powerMW {
+		if p > 0 {
+			ps = append(ps, p)
+		}
+	}
+	if len(ps) < 10 {
+		return 0, 0, ErrNoStandbyHistory
+	}
+	sort.Ints(ps)
+	baselineMW = ps[len(ps)/10]
+	margin := baselineMW / 2
+	if margin < 1000 {
+		margin = 1000
+	}
+	return baselineMW, baselineMW + margin, nil
+}
+
+// StandbyEvent describes something a Standby controller observed or
+// did.
+type StandbyEvent struct {
+	When    time.Time
+	Outlet  Outlet
+	Kind    string
+	PowerMW int
+	Err     error
+}
+
+// String summarizes the event.
+func (e StandbyEvent) String() string {
+	s := fmt.Sprintf("%s %s", e.Outlet, e.Kind)
+	if e.PowerMW != 0 {
+		s += fmt.Sprintf(" %.3fW", float64(e.PowerMW)/1e3)
+	}
+	if e.Err != nil {
+		s += fmt.Sprintf(": %v", e.Err)
+	}
+	return s
+}
+
+// The kinds of StandbyEvent.
+const (
+	StandbyDetected = "in standby"
+	StandbyOff      = "switched off"
+	StandbyWake     = "switched on"
+	StandbyManual   = "switched on externally"
+	StandbyError    = "error"
+)
+
+// Standby switches off an outlet whose appliance has been drawing
+// only standby power for a while, and switches it back on at the
+// configured wake times or when Wake is called.
+type Standby struct {
+	Outlet
+
+	// ThresholdMW is the power draw below which the appliance is
+	// considered to be in standby. See Learn.
+	ThresholdMW int
+
+	// After is how long the appliance must be in standby before
+	// it is switched off.
+	After time.Duration
+
+	// WakeAt lists "HH:MM" times of day at which a switched off
+	// outlet is switched back on.
+	WakeAt []string
+
+	// Timeout is used to connect to the devices. If zero,
+	// DefaultTimeout is used.
+	Timeout time.Duration
+
+	// Log, if not nil, is called with each event.
+	Log func(StandbyEvent)
+
+	below time.Time
+	off   time.Time
+}
+
+func (s *Standby) log(e StandbyEvent) {
+	e.Outlet = s.Outlet
+	if s.Log != nil {
+		s.Log(e)
+	}
+}
+
+func (s *Standby) timeout() time.Duration {
+	if s.Timeout == 0 {
+		return DefaultTimeout
+	}
+	return s.Timeout
+}
+
+// Learn sets the ThresholdMW from the power readings recorded in a
+// Store for the device in the window [from, to).
+func (s *Standby) Learn(store *Store, device string, from, to time.Time) (baselineMW int, err error) {
+	rs, err := store.Records(device, from, to)
+	if err != nil {
+		return 0, err
+	}
+	var ps []int
+	for _, r := range rs {
+		if r.PowerMW != nil {
+			ps = append(ps, *r.PowerMW)
+		}
+	}
+	baselineMW, s.ThresholdMW, err = LearnStandby(ps)
+	return baselineMW, err
+}
+
+// Off indicates whether the controller has switched the outlet off.
+func (s *Standby) Off() bool {
+	return !s.off.IsZero()
+}
+
+// Wake switches the outlet back on if the controller switched it
+// off.
+func (s *Standby) Wake() error {
+	if s.off.IsZero() {
+		return nil
+	}
+	if err := s.Enable(true, s.timeout()); err != nil {
+		return err
+	}
+	s.off = time.Time{}
+	s.below = time.Time{}
+	s.log(StandbyEvent{When: time.Now(), Kind: StandbyWake})
+	return nil
+}
+
+// Validate checks the WakeAt times. An invalid time would otherwise
+// only be noticed once the outlet had been switched off, leaving it
+// off.
+func (s *Standby) Validate() error {
+	for _, at := range s.WakeAt {
+		if _, err := parseClock(at); err != nil {
+			return fmt.Errorf("wake time: %v", err)
+		}
+	}
+	return nil
+}
+
+// nextClock returns the first time after t that is minutes past
+// local midnight.
+func nextClock(t time.Time, minutes int) time.Time {
+	y, m, d := t.Date()
+	next := time.Date(y, m, d, minutes/60, minutes%60, 0, 0, t.Location())
+	if !next.After(t) {
+		next = time.Date(y, m, d+1, minutes/60, minutes%60, 0, 0, t.Location())
+	}
+	return next
+}
+
+// wakeDue confirms that one of the WakeAt times has passed since the
+// outlet was switched off.
+func (s *Standby) wakeDue(now time.Time) (bool, error) {
+	for _, at := range s.WakeAt {
+		m, err := parseClock(at)
+		if err != nil {
+			return false, err
+		}
+		if !nextClock(s.off, m).After(now) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Check reads the outlet once, and switches it off or on as needed.
+// An outlet with invalid WakeAt times is never switched off.
+func (s *Standby) Check(now time.Time) error {
+	if err := s.Validate(); err != nil {
+		s.log(StandbyEvent{When: now, Kind: StandbyError, Err: err})
+		return err
+	}
+	c, err := DialTimeout(s.Addr, s.timeout())
+	if err != nil {
+		s.log(StandbyEvent{When: now, Kind: StandbyError, Err: err})
+		return err
+	}
+	defer c.Close()
+
+	if !s.off.IsZero() {
+		due, err := s.wakeDue(now)
+		if err != nil {
+			s.log(StandbyEvent{When: now, Kind: StandbyError, Err: err})
+			return err
+		}
+		if due {
+			return s.Wake()
+		}
+		sys, err := c.GetStatus()
+		if err != nil {
+			s.log(StandbyEvent{When: now, Kind: StandbyError, Err: err})
+			return err
+		}
+		on := sys.RelayState != 0
+		if len(s.Sockets) != 0 {
+			on = false
+			for _, i := range s.Sockets {
+				if i >= 0 && i < len(sys.Children) && sys.Children[i].State != 0 {
+					on = true
+				}
+			}
+		}
+		if on {
+			s.off = time.Time{}
+			s.below = time.Time{}
+			s.log(StandbyEvent{When: now, Kind: StandbyManual})
+		}
+		return nil
+	}
+
+	m, err := c.EMonState()
+	if err != nil {
+		s.log(StandbyEvent{When: now, Kind: StandbyError, Err: err})
+		return err
+	}
+	if m.PowerMW == 0 || m.PowerMW >= s.ThresholdMW {
+		// A zero reading means the outlet is already off.
+		s.below = time.Time{}
+		return nil
+	}
+	if s.below.IsZero() {
+		s.below = now
+		s.log(StandbyEvent{When: now, Kind: StandbyDetected, PowerMW: m.PowerMW})
+	}
+	if now.Sub(s.below) < s.After {
+		return nil
+	}
+	if len(s.Sockets) != 0 {
+		err = c.EnableSocket(false, s.Sockets...)
+	} else {
+		err = c.Enable(false)
+	}
+	if err != nil {
+		s.log(StandbyEvent{When: now, Kind: StandbyError, Err: err})
+		return err
+	}
+	s.off = now
+	s.log(StandbyEvent{When: now, Kind: StandbyOff, PowerMW: m.PowerMW})
+	return nil
+}
+
+// Run calls Check every interval until done is closed. Calls to Wake
+// should be made via the wake channel, which may be nil.
+func (s *Standby) Run(every time.Duration, wake <-chan struct{}, done <-chan struct{}) {
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+	for {
+		s.Check(time.Now())
+		select {
+		case <-done:
+			return
+		case <-wake:
+			if err := s.Wake(); err != nil {
+				s.log(StandbyEvent{When: time.Now(), Kind: StandbyError, Err: err})
+			}
+		case <-tick.C:
+		}
+	}
+}
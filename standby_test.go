@@ -0,0 +1,30 @@
+package tplinky
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStandbyBadWakeTime(t *testing.T) {
+	var events []StandbyEvent
+	s := &Standby{
+		Outlet: Outlet{Addr: "127.0.0.1:1"},
+		WakeAt: []string{"07:00", "7pm"},
+		Log: func(e StandbyEvent) {
+			events = append(events, e)
+		},
+	}
+	if err := s.Validate(); err == nil {
+		t.Fatal("Validate accepted a bad wake time")
+	}
+	if err := s.Check(time.Now()); err == nil {
+		t.Fatal("Check accepted a bad wake time")
+	}
+	if len(events) != 1 || events[0].Kind != StandbyError || events[0].Err == nil {
+		t.Errorf("got events %v, want one error", events)
+	}
+	s.WakeAt = []string{"07:00", "19:00"}
+	if err := s.Validate(); err != nil {
+		t.Errorf("Validate failed: %v", err)
+	}
+}
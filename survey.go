@@ -0,0 +1,334 @@
+package tplinky
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SurveySample holds one reading of a device's WiFi signal, and
+// optionally the access points it could see. Err is set when the
+// device could not be read, and ScanErr when only its scan for access
+// points failed, in which case RSSI is still valid.
+type SurveySample struct {
+	When    time.Time  `json:"t"`
+	Device  string     `json:"device"`
+	Alias   string     `json:"alias,omitempty"`
+	RSSI    int        `json:"rssi,omitempty"`
+	APs     []*APEntry `json:"aps,omitempty"`
+	Err     string     `json:"err,omitempty"`
+	ScanErr string     `json:"scan_err,omitempty"`
+}
+
+// String summarizes the sample.
+func (s SurveySample) String() string {
+	if s.Err != "" {
+		return fmt.Sprintf("%s: survey error: %s", s.Device, s.Err)
+	}
+	if s.ScanErr != "" {
+		return fmt.Sprintf("%s: RSSI=%ddBm, scan error: %s", s.Device, s.RSSI, s.ScanErr)
+	}
+	return fmt.Sprintf("%s: RSSI=%ddBm, %d APs visible", s.Device, s.RSSI, len(s.APs))
+}
+
+// SignalStats summarizes the signal strength of a device over a
+// survey. Weak is set when the mean RSSI is below the survey
+// threshold, and Unstable when it varies more than the survey allows.
+type SignalStats struct {
+	Device   string  `json:"device"`
+	Alias    string  `json:"alias,omitempty"`
+	Samples  int     `json:"samples"`
+	Failed   int     `json:"failed"`
+	MinRSSI  int     `json:"min_rssi"`
+	MaxRSSI  int     `json:"max_rssi"`
+	MeanRSSI float64 `json:"mean_rssi"`
+	StdDev   float64 `json:"stddev"`
+	Weak     bool    `json:"weak,omitempty"`
+	Unstable bool    `json:"unstable,omitempty"`
+}
+
+// String summarizes the statistics.
+func (s SignalStats) String() string {
+	r := fmt.Sprintf("%s %q: RSSI mean=%.1fdBm min=%d max=%d stddev=%.1f (%d samples, %d failed)",
+		s.Device, s.Alias, s.MeanRSSI, s.MinRSSI, s.MaxRSSI, s.StdDev, s.Samples, s.Failed)
+	if s.Weak {
+		r += " WEAK"
+	}
+	if s.Unstable {
+		r += " UNSTABLE"
+	}
+	return r
+}
+
+// APStats summarizes how one device saw one access point over a
+// survey.
+type APStats struct {
+	Device   string  `json:"device"`
+	SSID     string  `json:"ssid"`
+	KeyType  int     `json:"key_type"`
+	Seen     int     `json:"seen"`
+	MinRSSI  int     `json:"min_rssi"`
+	MaxRSSI  int     `json:"max_rssi"`
+	MeanRSSI float64 `json:"mean_rssi"`
+}
+
+// Survey repeatedly samples the WiFi signal strength of a set of
+// devices, to help decide where to put devices or access points.
+type Survey struct {
+	// Devices lists the addresses of the devices.
+	Devices []string
+
+	// ScanAPs also records the access points visible to each
+	// device. A WiFi scan takes the device a few seconds.
+	ScanAPs bool
+
+	// Threshold is the mean RSSI, in dBm, below which a device is
+	// flagged as Weak. If zero, WeakRSSI is used.
+	Threshold int
+
+	// MaxStdDev is the standard deviation of RSSI, in dB, above
+	// which a device is flagged as Unstable. If zero, 5 is used.
+	MaxStdDev float64
+
+	// Timeout is used to connect to the devices. If zero,
+	// DefaultTimeout is used.
+	Timeout time.Duration
+
+	// Log, if not nil, is called with each sample.
+	Log func(SurveySample)
+
+	mu      sync.Mutex
+	samples []SurveySample
+}
+
+func (s *Survey) timeout() time.Duration {
+	if s.Timeout == 0 {
+		return DefaultTimeout
+	}
+	return s.Timeout
+}
+
+// sample reads one device.
+func (s *Survey) sample(device string, now time.Time) SurveySample {
+	r := SurveySample{When: now, Device: device}
+	c, err := DialTimeout(device, s.timeout())
+	if err != nil {
+		r.Err = err.Error()
+		return r
+	}
+	defer c.Close()
+	sys, err := c.GetStatus()
+	if err != nil {
+		r.Err = err.Error()
+		return r
+	}
+	r.Alias, r.RSSI = sys.Alias, sys.RSSI
+	if s.ScanAPs {
+		scan, err := c.ListWiFi()
+		if err != nil {
+			r.ScanErr = err.Error()
+			return r
+		}
+		r.APs = scan.APList
+	}
+	return r
+}
+
+// Sample reads all of the devices, in parallel, once.
+func (s *Survey) Sample(now time.Time) []SurveySample {
+	samples := make([]SurveySample, len(s.Devices))
+	var wg sync.WaitGroup
+	for i, d := range s.Devices {
+		wg.Add(1)
+		go func(i int, d string) {
+			defer wg.Done()
+			samples[i] = s.sample(d, now)
+		}(i, d)
+	}
+	wg.Wait()
+	s.mu.Lock()
+	s.samples = append(s.samples, samples...)
+	s.mu.Unlock()
+	if s.Log != nil {
+		for _, r := range samples {
+			s.Log(r)
+		}
+	}
+	return samples
+}
+
+// Run calls Sample every interval, count times, or until done is
+// closed. If count is zero, Run only stops when done is closed.
+func (s *Survey) Run(every time.Duration, count int, done <-chan struct{}) {
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+	for i := 0; count == 0 || i < count; i++ {
+		s.Sample(time.Now())
+		if i+1 == count {
+			return
+		}
+		select {
+		case <-done:
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// Samples returns the samples taken so far.
+func (s *Survey) Samples() []SurveySample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]SurveySample(nil), s.samples...)
+}
+
+// rssiStats summarizes a list of RSSI readings.
+func rssiStats(rs []int) (min, max int, mean, stddev float64) {
+	if len(rs) == 0 {
+		return
+	}
+	min, max = rs[0], rs[0]
+	for _, r := range rs {
+		if r < min {
+			min = r
+		}
+		if r > max {
+			max = r
+		}
+		mean += float64(r)
+	}
+	mean /= float64(len(rs))
+	for _, r := range rs {
+		stddev += (float64(r) - mean) * (float64(r) - mean)
+	}
+	stddev = math.Sqrt(stddev / float64(len(rs)))
+	return
+}
+
+// Stats summarizes the signal strength of each device, in the order
+// of Devices.
+func (s *Survey) Stats() []SignalStats {
+	threshold := s.Threshold
+	if threshold == 0 {
+		threshold = WeakRSSI
+	}
+	maxSD := s.MaxStdDev
+	if maxSD == 0 {
+		maxSD = 5
+	}
+	samples := s.Samples()
+	var stats []SignalStats
+	for _, d := range s.Devices {
+		st := SignalStats{Device: d}
+		var rs []int
+		for _, r := range samples {
+			if r.Device != d {
+				continue
+			}
+			st.Samples++
+			if r.Alias != "" {
+				st.Alias = r.Alias
+			}
+			if r.Err != "" || r.RSSI == 0 {
+				st.Failed++
+				continue
+			}
+			rs = append(rs, r.RSSI)
+		}
+		if len(rs) != 0 {
+			st.MinRSSI, st.MaxRSSI, st.MeanRSSI, st.StdDev = rssiStats(rs)
+			st.Weak = st.MeanRSSI < float64(threshold)
+			st.Unstable = st.StdDev > maxSD
+		}
+		stats = append(stats, st)
+	}
+	return stats
+}
+
+// APStats summarizes the access points seen by each device, ordered
+// by device and then strongest first. Access points whose RSSI was
+// never reported come last.
+func (s *Survey) APStats() []APStats {
+	type key struct{ device, ssid string }
+	found := make(map[key]*APStats)
+	rssis := make(map[key][]int)
+	var stats []APStats
+	var keys []key
+	for _, r := range s.Samples() {
+		for _, ap := range r.APs {
+			k := key{r.Device, ap.SSID}
+			st := found[k]
+			if st == nil {
+				st = &APStats{Device: k.device, SSID: k.ssid, KeyType: ap.KeyType}
+				found[k] = st
+				keys = append(keys, k)
+			}
+			st.Seen++
+			// Some firmware does not report the RSSI of
+			// access points.
+			if ap.RSSI != 0 {
+				rssis[k] = append(rssis[k], ap.RSSI)
+			}
+		}
+	}
+	for _, k := range keys {
+		st := found[k]
+		st.MinRSSI, st.MaxRSSI, st.MeanRSSI, _ = rssiStats(rssis[k])
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.device != b.device {
+			return a.device < b.device
+		}
+		if len(rssis[a]) == 0 || len(rssis[b]) == 0 {
+			return len(rssis[b]) == 0 && len(rssis[a]) != 0
+		}
+		return found[a].MeanRSSI > found[b].MeanRSSI
+	})
+	for _, k := range keys {
+		stats = append(stats, *found[k])
+	}
+	return stats
+}
+
+// WriteCSV exports the samples as CSV, with one row per device
+// reading and one per access point seen.
+func (s *Survey) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"time", "device", "alias", "ssid", "key_type", "rssi", "error"})
+	for _, r := range s.Samples() {
+		t := r.When.Format(time.RFC3339)
+		rssi := ""
+		if r.Err == "" {
+			rssi = strconv.Itoa(r.RSSI)
+		}
+		msg := r.Err
+		if r.ScanErr != "" {
+			msg = "scan: " + r.ScanErr
+		}
+		cw.Write([]string{t, r.Device, r.Alias, "", "", rssi, msg})
+		for _, ap := range r.APs {
+			cw.Write([]string{t, r.Device, r.Alias, ap.SSID, strconv.Itoa(ap.KeyType), strconv.Itoa(ap.RSSI), ""})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteJSON exports the device and access point summaries, and the
+// samples, as a JSON document.
+func (s *Survey) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		Devices []SignalStats  `json:"devices"`
+		APs     []APStats      `json:"aps,omitempty"`
+		Samples []SurveySample `json:"samples"`
+	}{s.Stats(), s.APStats(), s.Samples()})
+}
@@ -0,0 +1,90 @@
+package tplinky
+
+import (
+	"bytes"
+	"encoding/csv"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRSSIStats(t *testing.T) {
+	min, max, mean, sd := rssiStats([]int{-60, -70, -50, -60})
+	if min != -70 || max != -50 || mean != -60 || math.Abs(sd-math.Sqrt(50)) > 1e-9 {
+		t.Errorf("got min=%d max=%d mean=%g sd=%g, want -70 -50 -60 %g", min, max, mean, sd, math.Sqrt(50))
+	}
+	if min, max, mean, sd := rssiStats(nil); min != 0 || max != 0 || mean != 0 || sd != 0 {
+		t.Errorf("got %d %d %g %g for no readings, want zeros", min, max, mean, sd)
+	}
+}
+
+func TestSurveyStats(t *testing.T) {
+	now := time.Now()
+	s := &Survey{Devices: []string{"a", "b"}, Threshold: -65, MaxStdDev: 4}
+	s.samples = []SurveySample{
+		{When: now, Device: "a", Alias: "den", RSSI: -60},
+		{When: now, Device: "b", RSSI: -80},
+		{When: now, Device: "a", Err: "timeout"},
+		{When: now, Device: "b", RSSI: -60, ScanErr: "no scan"},
+		{When: now, Device: "a", RSSI: -62},
+	}
+	want := []SignalStats{
+		{Device: "a", Alias: "den", Samples: 3, Failed: 1, MinRSSI: -62, MaxRSSI: -60, MeanRSSI: -61, StdDev: 1},
+		{Device: "b", Samples: 2, MinRSSI: -80, MaxRSSI: -60, MeanRSSI: -70, StdDev: 10, Weak: true, Unstable: true},
+	}
+	if got := s.Stats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got stats\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestSurveyAPStats(t *testing.T) {
+	s := &Survey{}
+	s.samples = []SurveySample{
+		{Device: "b", APs: []*APEntry{{SSID: "quiet", KeyType: 3}, {SSID: "home", KeyType: 3, RSSI: -50}}},
+		{Device: "a", APs: []*APEntry{{SSID: "far", RSSI: -80}, {SSID: "near", RSSI: -40}}},
+		{Device: "b", APs: []*APEntry{{SSID: "home", KeyType: 3, RSSI: -60}, {SSID: "guest", RSSI: -70}}},
+	}
+	want := []APStats{
+		{Device: "a", SSID: "near", Seen: 1, MinRSSI: -40, MaxRSSI: -40, MeanRSSI: -40},
+		{Device: "a", SSID: "far", Seen: 1, MinRSSI: -80, MaxRSSI: -80, MeanRSSI: -80},
+		{Device: "b", SSID: "home", KeyType: 3, Seen: 2, MinRSSI: -60, MaxRSSI: -50, MeanRSSI: -55},
+		{Device: "b", SSID: "guest", Seen: 1, MinRSSI: -70, MaxRSSI: -70, MeanRSSI: -70},
+		{Device: "b", SSID: "quiet", KeyType: 3, Seen: 1},
+	}
+	if got := s.APStats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got AP stats\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestSurveyScanError(t *testing.T) {
+	addr := fakeDevice(t, func(req map[string]interface{}) interface{} {
+		if module(req, "netif") != nil {
+			return map[string]interface{}{"netif": map[string]interface{}{}}
+		}
+		return map[string]interface{}{
+			"system": map[string]interface{}{
+				"get_sysinfo": map[string]interface{}{"alias": "den", "rssi": -58},
+			},
+		}
+	})
+	s := &Survey{Devices: []string{addr}, ScanAPs: true, Timeout: time.Second}
+	r := s.Sample(time.Now())[0]
+	if r.Err != "" || r.ScanErr == "" || r.RSSI != -58 {
+		t.Fatalf("got sample %+v, want RSSI -58 with only a scan error", r)
+	}
+	if st := s.Stats()[0]; st.Failed != 0 || st.MeanRSSI != -58 {
+		t.Errorf("got stats %+v, want the RSSI counted", st)
+	}
+	var buf bytes.Buffer
+	if err := s.WriteCSV(&buf); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[1][5] != "-58" || rows[1][6] == "" {
+		t.Errorf("got CSV rows %q, want the RSSI and the scan error", rows)
+	}
+}
@@ -0,0 +1,375 @@
+package tplinky
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Usage is an amount of energy consumed over an interval of time.
+type Usage struct {
+	Start    time.Time
+	End      time.Time
+	EnergyWH float64
+}
+
+// Usage returns the energy consumed between each pair of retained
+// samples. Gaps longer than the Integrator's MaxGap are skipped.
+func (g *Integrator) Usage() []Usage {
+	var us []Usage
+	for i := 1; i < len(g.samples); i++ {
+		a, b := g.samples[i-1], g.samples[i]
+		if gap := g.maxGap(); gap > 0 && b.When.Sub(a.When) > gap {
+			continue
+		}
+		us = append(us, Usage{
+			Start:    a.When,
+			End:      b.When,
+			EnergyWH: float64(a.PowerMW+b.PowerMW) / 2e3 * b.When.Sub(a.When).Hours(),
+		})
+	}
+	return us
+}
+
+// UsageFromDayStats converts E-Meter daily statistics into Usage
+// spanning each of the days in the loc timezone. The device does not
+// report when in the day the energy was consumed, so time-of-use
+// tariffs treat it as having been consumed at an even rate.
+func UsageFromDayStats(stats []DayStat, loc *time.Location) []Usage {
+	var us []Usage
+	for _, s := range stats {
+		wh := float64(s.EnergyWH)
+		if wh == 0 {
+			wh = s.Energy * 1e3
+		}
+		start := time.Date(s.Year, time.Month(s.Month), s.Day, 0, 0, 0, 0, loc)
+		us = append(us, Usage{
+			Start:    start,
+			End:      start.AddDate(0, 0, 1),
+			EnergyWH: wh,
+		})
+	}
+	return us
+}
+
+// TariffTier is one step of a tiered tariff. Tiers apply to the
+// energy consumed in a calendar month. The price applies until the
+// month's consumption reaches UpToKWH. The last tier conventionally
+// has UpToKWH of zero, meaning it has no limit.
+type TariffTier struct {
+	UpToKWH float64 `json:"up_to_kwh,omitempty"`
+	Price   float64 `json:"price"`
+}
+
+// TariffPeriod is a time-of-use period of a tariff.
+type TariffPeriod struct {
+	Name string `json:"name"`
+
+	// Days is one of "weekday", "weekend" or empty for every day.
+	Days string `json:"days,omitempty"`
+
+	// Months lists the months (1=January) of a seasonal period.
+	// Empty means every month.
+	Months []int `json:"months,omitempty"`
+
+	// Start and End are "HH:MM" times of day. The period wraps
+	// past midnight when End is not after Start, and an empty
+	// Start and End covers the whole day.
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+
+	Price float64 `json:"price"`
+
+	start, end int
+}
+
+// Tariff holds an electricity pricing model. Prices are per kWh. A
+// Tariff with time-of-use Periods prices energy at the first period
+// that matches when it was consumed. Energy that matches no period is
+// priced using the Tiers, or, if there are none, the Flat price.
+type Tariff struct {
+	Name     string         `json:"name,omitempty"`
+	Currency string         `json:"currency,omitempty"`
+	Zone     string         `json:"zone,omitempty"`
+	Flat     float64        `json:"flat,omitempty"`
+	Tiers    []TariffTier   `json:"tiers,omitempty"`
+	Periods  []TariffPeriod `json:"periods,omitempty"`
+
+	loc *time.Location
+}
+
+// parseClock parses an "HH:MM" time of day into minutes. The hour
+// may be a single digit, and "24:00" is accepted as the end of a
+// day.
+func parseClock(hhmm string) (int, error) {
+	parts := strings.Split(hhmm, ":")
+	if len(parts) == 2 && len(parts[0]) >= 1 && len(parts[0]) <= 2 && len(parts[1]) == 2 && digits(parts[0]) && digits(parts[1]) {
+		h, _ := strconv.Atoi(parts[0])
+		m, _ := strconv.Atoi(parts[1])
+		if m <= 59 && h*60+m <= 24*60 {
+			return h*60 + m, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid time of day %q", hhmm)
+}
+
+// digits confirms s consists only of decimal digits.
+func digits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// LoadTariff reads a tariff from a file. Files named *.yaml or *.yml
+// are read as YAML, with the same field names, and others as JSON.
+func LoadTariff(path string) (*Tariff, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if data, err = yamlToJSON(data); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	t := &Tariff{}
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, err
+	}
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Validate checks the tariff for errors and prepares it for use.
+func (t *Tariff) Validate() error {
+	t.loc = time.Local
+	if t.Zone != "" {
+		loc, err := time.LoadLocation(t.Zone)
+		if err != nil {
+			return err
+		}
+		t.loc = loc
+	}
+	for i := range t.Periods {
+		p := &t.Periods[i]
+		switch p.Days {
+		case "", "weekday", "weekend":
+		default:
+			return fmt.Errorf("period %q: unrecognized days %q", p.Name, p.Days)
+		}
+		for _, m := range p.Months {
+			if m < 1 || m > 12 {
+				return fmt.Errorf("period %q: invalid month %d", p.Name, m)
+			}
+		}
+		if p.Start == "" && p.End == "" {
+			p.start, p.end = 0, 24*60
+			continue
+		}
+		var err error
+		if p.start, err = parseClock(p.Start); err != nil {
+			return fmt.Errorf("period %q: %v", p.Name, err)
+		}
+		if p.end, err = parseClock(p.End); err != nil {
+			return fmt.Errorf("period %q: %v", p.Name, err)
+		}
+	}
+	for i, tier := range t.Tiers {
+		if tier.UpToKWH == 0 && i != len(t.Tiers)-1 {
+			return fmt.Errorf("tier %d: only the last tier may be unlimited", i+1)
+		}
+		if i != 0 && tier.UpToKWH != 0 && tier.UpToKWH <= t.Tiers[i-1].UpToKWH {
+			return fmt.Errorf("tier %d: limits must increase", i+1)
+		}
+	}
+	return nil
+}
+
+// matches confirms the period includes the time t.
+func (p *TariffPeriod) matches(t time.Time) bool {
+	switch wd := t.Weekday(); p.Days {
+	case "weekday":
+		if wd == time.Saturday || wd == time.Sunday {
+			return false
+		}
+	case "weekend":
+		if wd != time.Saturday && wd != time.Sunday {
+			return false
+		}
+	}
+	if len(p.Months) != 0 {
+		found := false
+		for _, m := range p.Months {
+			if time.Month(m) == t.Month() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	m := t.Hour()*60 + t.Minute()
+	if p.start < p.end {
+		return m >= p.start && m < p.end
+	}
+	return m >= p.start || m < p.end
+}
+
+// Cost holds the cost of some energy usage.
+type Cost struct {
+	EnergyWH float64
+	Cost     float64
+
+	// The cost and energy broken down by tariff period name.
+	// Tiered energy uses the names "tier 1", "tier 2" etc, and
+	// flat rate energy uses "flat".
+	ByPeriod       map[string]float64
+	EnergyByPeriod map[string]float64
+}
+
+func (c *Cost) add(name string, wh, price float64) {
+	c.EnergyWH += wh
+	c.Cost += wh / 1e3 * price
+	c.ByPeriod[name] += wh / 1e3 * price
+	c.EnergyByPeriod[name] += wh
+}
+
+// costChunk is the granularity used to split Usage across time-of-use
+// periods.
+const costChunk = 15 * time.Minute
+
+// Cost computes the cost of the given usage. Usage that spans
+// several time-of-use periods is split between them in proportion to
+// time. Tiers are applied to the combined usage of each calendar
+// month.
+func (t *Tariff) Cost(usage []Usage) (*Cost, error) {
+	if t.loc == nil {
+		if err := t.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	us := append([]Usage(nil), usage...)
+	sort.Slice(us, func(i, j int) bool { return us[i].Start.Before(us[j].Start) })
+	c := &Cost{
+		ByPeriod:       make(map[string]float64),
+		EnergyByPeriod: make(map[string]float64),
+	}
+	monthly := make(map[int]float64)
+	for _, u := range us {
+		span := u.End.Sub(u.Start)
+		if span <= 0 {
+			continue
+		}
+		for from := u.Start; from.Before(u.End); {
+			to := from.Truncate(costChunk).Add(costChunk)
+			if to.After(u.End) {
+				to = u.End
+			}
+			wh := u.EnergyWH * float64(to.Sub(from)) / float64(span)
+			at := from.Add(to.Sub(from) / 2).In(t.loc)
+			from = to
+			priced := false
+			for i := range t.Periods {
+				if p := &t.Periods[i]; p.matches(at) {
+					c.add(p.Name, wh, p.Price)
+					priced = true
+					break
+				}
+			}
+			if priced {
+				continue
+			}
+			if len(t.Tiers) == 0 {
+				c.add("flat", wh, t.Flat)
+				continue
+			}
+			month := at.Year()*12 + int(at.Month())
+			for i, tier := range t.Tiers {
+				if wh <= 0 {
+					break
+				}
+				part := wh
+				if tier.UpToKWH != 0 {
+					room := tier.UpToKWH*1e3 - monthly[month]
+					if room <= 0 {
+						continue
+					}
+					if part > room {
+						part = room
+					}
+				}
+				c.add(fmt.Sprintf("tier %d", i+1), part, tier.Price)
+				monthly[month] += part
+				wh -= part
+			}
+			if wh > 0 {
+				// No unlimited last tier, so use the last price.
+				c.add(fmt.Sprintf("tier %d", len(t.Tiers)), wh, t.Tiers[len(t.Tiers)-1].Price)
+			}
+		}
+	}
+	return c, nil
+}
+
+// CostLine is one line of a CostReport. Device lines have an empty
+// Label, and label lines have an empty Device.
+type CostLine struct {
+	Device string
+	Label  string
+	*Cost
+}
+
+// CostReport computes the cost of the usage of each device, and the
+// combined cost of the devices carrying each label in the inventory.
+// The usage map is indexed by the device address, MAC address or
+// alias, and inv may be nil. Tiers are applied to each line
+// separately.
+func CostReport(t *Tariff, usage map[string][]Usage, inv *Inventory) ([]CostLine, error) {
+	var devices []string
+	for d := range usage {
+		devices = append(devices, d)
+	}
+	sort.Strings(devices)
+	var lines []CostLine
+	labeled := make(map[string][]Usage)
+	for _, d := range devices {
+		c, err := t.Cost(usage[d])
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, CostLine{Device: d, Cost: c})
+		if inv == nil {
+			continue
+		}
+		if dev := inv.Find(d); dev != nil {
+			for _, l := range dev.Labels {
+				labeled[l] = append(labeled[l], usage[d]...)
+			}
+		}
+	}
+	if inv != nil {
+		for _, l := range inv.Labels() {
+			if _, ok := labeled[l]; !ok {
+				continue
+			}
+			c, err := t.Cost(labeled[l])
+			if err != nil {
+				return nil, err
+			}
+			lines = append(lines, CostLine{Label: l, Cost: c})
+		}
+	}
+	return lines, nil
+}
@@ -0,0 +1,85 @@
+package tplinky
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const jsonTariff = `{
+  "currency": "USD",
+  "zone": "America/Los_Angeles",
+  "flat": 0.31,
+  "tiers": [{"up_to_kwh": 300, "price": 0.25}, {"price": 0.35}],
+  "periods": [
+    {"name": "summer peak", "days": "weekday", "months": [6,7,8,9], "start": "16:00", "end": "21:00", "price": 0.55},
+    {"name": "off peak", "start": "21:00", "end": "16:00", "price": 0.29}
+  ]
+}`
+
+const yamlTariff = `# Example tariff.
+currency: USD
+zone: "America/Los_Angeles"
+flat: 0.31
+tiers:
+- up_to_kwh: 300
+  price: 0.25
+- price: 0.35
+periods:
+  - name: summer peak   # Weekdays only.
+    days: weekday
+    months: [6, 7, 8, 9]
+    start: "16:00"
+    end: '21:00'
+    price: 0.55
+  - name: off peak
+    start: "21:00"
+    end: "16:00"
+    price: 0.29
+`
+
+func TestLoadTariffYAML(t *testing.T) {
+	dir := t.TempDir()
+	jsonPath := filepath.Join(dir, "tariff.json")
+	yamlPath := filepath.Join(dir, "tariff.yaml")
+	if err := ioutil.WriteFile(jsonPath, []byte(jsonTariff), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(yamlPath, []byte(yamlTariff), 0644); err != nil {
+		t.Fatal(err)
+	}
+	want, err := LoadTariff(jsonPath)
+	if err != nil {
+		t.Fatalf("unable to load JSON tariff: %v", err)
+	}
+	got, err := LoadTariff(yamlPath)
+	if err != nil {
+		t.Fatalf("unable to load YAML tariff: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("YAML tariff differs:\n got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestParseClock(t *testing.T) {
+	tests := []struct {
+		hhmm string
+		want int
+	}{
+		{"00:00", 0},
+		{"7:05", 425},
+		{"21:30", 1290},
+		{"24:00", 1440},
+	}
+	for _, tc := range tests {
+		if got, err := parseClock(tc.hhmm); err != nil || got != tc.want {
+			t.Errorf("parseClock(%q) = %d, %v, want %d", tc.hhmm, got, err, tc.want)
+		}
+	}
+	for _, bad := range []string{"", "21", "21:30x", "7:5pm", "7:5", "24:01", "25:00", "12:60", "-1:00", "+7:00", "7:00:00", " 7:00", "123:00"} {
+		if got, err := parseClock(bad); err == nil {
+			t.Errorf("parseClock(%q) = %d, want an error", bad, got)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package tplinky
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ClockReading records the offset of a device's clock from local
+// time. Offset is positive when the device clock is ahead.
+type ClockReading struct {
+	Device string        `json:"-"`
+	When   time.Time     `json:"t"`
+	Offset time.Duration `json:"offset"`
+	RTT    time.Duration `json:"rtt"`
+
+	// Corrected is set when the device clock was set after the
+	// reading.
+	Corrected bool  `json:"corrected,omitempty"`
+	Err       error `json:"-"`
+}
+
+// String summarizes the reading.
+func (r ClockReading) String() string {
+	if r.Err != nil {
+		return fmt.Sprintf("%s: clock error: %v", r.Device, r.Err)
+	}
+	s := fmt.Sprintf("%s: clock offset %v (rtt %v)", r.Device, r.Offset.Round(time.Millisecond), r.RTT.Round(time.Millisecond))
+	if r.Corrected {
+		s += ", corrected"
+	}
+	return s
+}
+
+// ClockOffset measures the offset of the device's clock from local
+// time. The device reports whole seconds, so the reading is taken to
+// be the middle of the reported second, and it is compared with the
+// local time half way through the round trip. The result is accurate
+// to about half a second plus half the round trip time.
+func (c *Conn) ClockOffset() (offset, rtt time.Duration, err error) {
+	t0 := time.Now()
+	dt, err := c.GetTime()
+	t1 := time.Now()
+	if err != nil {
+		return 0, 0, err
+	}
+	rtt = t1.Sub(t0)
+	mid := t0.Add(rtt / 2)
+	return dt.Add(500 * time.Millisecond).Sub(mid), rtt, nil
+}
+
+// SyncClock sets the device clock to local time, keeping the device's
+// timezone. The devices only accept whole seconds, so the time is
+// sent when it will arrive just after a second boundary. The rtt is
+// the round trip time measured by ClockOffset.
+func (c *Conn) SyncClock(rtt time.Duration) error {
+	loc, err := c.GetTimeZone()
+	if err != nil {
+		return err
+	}
+	index, err := TimeZoneIndex(loc)
+	if err != nil {
+		return err
+	}
+	arrive := time.Now().Add(rtt / 2)
+	next := arrive.Truncate(time.Second).Add(time.Second)
+	time.Sleep(next.Sub(arrive))
+	return c.setTime(next.In(loc), index)
+}
+
+// TimeSync keeps the clocks of a set of devices close to local time.
+type TimeSync struct {
+	// Devices lists the addresses of the devices.
+	Devices []string
+
+	// Threshold is the clock offset beyond which a device clock is
+	// corrected. If zero, 2 seconds is used. The devices only
+	// track whole seconds, so smaller thresholds are not useful.
+	Threshold time.Duration
+
+	// DryRun only measures and reports the offsets.
+	DryRun bool
+
+	// Store, if not nil, records each reading for DriftReport.
+	Store *Store
+
+	// Timeout is used to connect to the devices. If zero,
+	// DefaultTimeout is used.
+	Timeout time.Duration
+
+	// Log, if not nil, is called with each reading.
+	Log func(ClockReading)
+}
+
+func (s *TimeSync) timeout() time.Duration {
+	if s.Timeout == 0 {
+		return DefaultTimeout
+	}
+	return s.Timeout
+}
+
+// check measures, and if needed corrects, the clock of one device.
+func (s *TimeSync) check(device string) ClockReading {
+	r := ClockReading{Device: device, When: time.Now()}
+	c, err := DialTimeout(device, s.timeout())
+	if err != nil {
+		r.Err = err
+		return r
+	}
+	defer c.Close()
+	if r.Offset, r.RTT, r.Err = c.ClockOffset(); r.Err != nil {
+		return r
+	}
+	threshold := s.Threshold
+	if threshold == 0 {
+		threshold = 2 * time.Second
+	}
+	if s.DryRun || (r.Offset < threshold && r.Offset > -threshold) {
+		return r
+	}
+	if r.Err = c.SyncClock(r.RTT); r.Err == nil {
+		r.Corrected = true
+	}
+	return r
+}
+
+// Check measures the clocks of all of the devices, in parallel, and
+// corrects those that are off by more than the Threshold.
+func (s *TimeSync) Check() []ClockReading {
+	readings := make([]ClockReading, len(s.Devices))
+	var wg sync.WaitGroup
+	for i, d := range s.Devices {
+		wg.Add(1)
+		go func(i int, d string) {
+			defer wg.Done()
+			readings[i] = s.check(d)
+		}(i, d)
+	}
+	wg.Wait()
+	for _, r := range readings {
+		if s.Store != nil && r.Err == nil {
+			if err := s.Store.RecordClock(r); err != nil && s.Log != nil {
+				s.Log(ClockReading{Device: r.Device, When: r.When, Err: err})
+			}
+		}
+		if s.Log != nil {
+			s.Log(r)
+		}
+	}
+	return readings
+}
+
+// Run calls Check every interval until done is closed.
+func (s *TimeSync) Run(every time.Duration, done <-chan struct{}) {
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+	for {
+		s.Check()
+		select {
+		case <-done:
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// RecordClock adds a clock reading to the device's clock history.
+// These are kept apart from the other records, and are not
+// compacted.
+func (s *Store) RecordClock(r ClockReading) error {
+	path, err := s.path(r.Device, "clock")
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return appendJSON(path, r)
+}
+
+// ClockReadings returns the device's clock readings in the window
+// [from, to).
+func (s *Store) ClockReadings(device string, from, to time.Time) ([]ClockReading, error) {
+	path, err := s.path(device, "clock")
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var rs []ClockReading
+	err = readJSON(path, func(line []byte) error {
+		var r ClockReading
+		if err := json.Unmarshal(line, &r); err != nil {
+			return err
+		}
+		if inWindow(r.When, from, to) {
+			r.Device = device
+			rs = append(rs, r)
+		}
+		return nil
+	})
+	return rs, err
+}
+
+// Drift summarizes how quickly a device clock drifts.
+type Drift struct {
+	Device      string
+	Readings    int
+	Corrections int
+
+	// MaxOffset is the largest offset, in either direction, seen.
+	MaxOffset time.Duration
+
+	// PerDay is the mean rate at which the clock gains time
+	// (negative if it loses time), measured between readings.
+	PerDay time.Duration
+
+	// Span is the time over which PerDay was measured.
+	Span time.Duration
+}
+
+// String summarizes the drift.
+func (d *Drift) String() string {
+	return fmt.Sprintf("%s: drift %v/day over %v (max offset %v, %d readings, %d corrections)",
+		d.Device, d.PerDay.Round(time.Millisecond), d.Span.Round(time.Minute), d.MaxOffset.Round(time.Millisecond), d.Readings, d.Corrections)
+}
+
+// DriftReport works out the clock drift of a device from its clock
+// readings in the window [from, to). Following a correction, the
+// clock is taken to have started again from zero offset.
+func (s *Store) DriftReport(device string, from, to time.Time) (*Drift, error) {
+	rs, err := s.ClockReadings(device, from, to)
+	if err != nil {
+		return nil, err
+	}
+	d := &Drift{Device: device, Readings: len(rs)}
+	var gained time.Duration
+	for i, r := range rs {
+		if r.Offset > d.MaxOffset {
+			d.MaxOffset = r.Offset
+		} else if -r.Offset > d.MaxOffset {
+			d.MaxOffset = -r.Offset
+		}
+		if r.Corrected {
+			d.Corrections++
+		}
+		if i == 0 {
+			continue
+		}
+		prev := rs[i-1]
+		start := prev.Offset
+		if prev.Corrected {
+			start = 0
+		}
+		gained += r.Offset - start
+		d.Span += r.When.Sub(prev.When)
+	}
+	if d.Span > 0 {
+		d.PerDay = time.Duration(float64(gained) * float64(24*time.Hour) / float64(d.Span))
+	}
+	return d, nil
+}
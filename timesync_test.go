@@ -0,0 +1,109 @@
+package tplinky
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock serves the time module of a device whose clock stands
+// still at the wall clock time it was last set to. A negative index
+// makes reading the timezone fail until it is set.
+func fakeClock(t *testing.T, index int) (addr string, wall func() map[string]interface{}) {
+	var mu sync.Mutex
+	clock := map[string]interface{}{"year": 2025, "month": 1, "mday": 1, "hour": 0, "min": 0, "sec": 0}
+	addr = fakeDevice(t, func(req map[string]interface{}) interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		m := module(req, "time")
+		if m == nil {
+			return map[string]interface{}{}
+		}
+		resp := make(map[string]interface{})
+		if set, ok := m["set_timezone"].(map[string]interface{}); ok {
+			for k := range clock {
+				clock[k] = set[k]
+			}
+			index = int(set["index"].(float64))
+			resp["set_timezone"] = map[string]interface{}{"err_code": 0}
+		}
+		if _, ok := m["get_time"]; ok {
+			resp["get_time"] = clock
+		}
+		if _, ok := m["get_timezone"]; ok && index < 0 {
+			resp["get_timezone"] = map[string]interface{}{"err_code": -1, "err_msg": "no timezone"}
+		} else if ok {
+			resp["get_timezone"] = map[string]interface{}{"index": index}
+		}
+		return map[string]interface{}{"time": resp}
+	})
+	return addr, func() map[string]interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		return clock
+	}
+}
+
+func TestSetTimeRoundTripDST(t *testing.T) {
+	tests := []struct {
+		index int
+		hour  float64
+	}{
+		{18, 12}, // Eastern daylight time, -0400.
+		{9, 10},  // Mountain daylight time, -0600.
+		{7, 9},   // Arizona keeps -0700.
+	}
+	instant := time.Date(2025, time.July, 15, 16, 0, 0, 0, time.UTC)
+	for _, tc := range tests {
+		addr, wall := fakeClock(t, tc.index)
+		c, err := Dial(addr)
+		if err != nil {
+			t.Fatalf("unable to dial fake device: %v", err)
+		}
+		if err := c.SetTime(instant); err != nil {
+			t.Fatalf("zone %d: SetTime failed: %v", tc.index, err)
+		}
+		if got := wall()["hour"]; got != tc.hour {
+			t.Errorf("zone %d: device wall clock hour = %v, want %v", tc.index, got, tc.hour)
+		}
+		got, err := c.GetTime()
+		if err != nil {
+			t.Fatalf("zone %d: GetTime failed: %v", tc.index, err)
+		}
+		if !got.Equal(instant) {
+			t.Errorf("zone %d: GetTime = %v, want %v", tc.index, got, instant)
+		}
+		c.Close()
+	}
+}
+
+func TestSetTimeUnknownZone(t *testing.T) {
+	denver, err := time.LoadLocation("America/Denver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		loc   *time.Location
+		index float64
+		hour  float64
+	}{
+		{denver, 9, 10},
+		{time.FixedZone("Mars", 3*3600+17*60), 38, 16},
+	}
+	instant := time.Date(2025, time.July, 15, 16, 0, 0, 0, time.UTC)
+	for _, tc := range tests {
+		addr, wall := fakeClock(t, -1)
+		c, err := Dial(addr)
+		if err != nil {
+			t.Fatalf("unable to dial fake device: %v", err)
+		}
+		if err := c.SetTime(instant.In(tc.loc)); err != nil {
+			t.Errorf("%s: SetTime failed: %v", tc.loc, err)
+		}
+		got, err := c.timeZoneIndex()
+		if err != nil || float64(got) != tc.index || wall()["hour"] != tc.hour {
+			t.Errorf("%s: device set to %v at hour %v, want zone %v at hour %v", tc.loc, got, wall()["hour"], tc.index, tc.hour)
+		}
+		c.Close()
+	}
+}
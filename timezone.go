@@ -0,0 +1,249 @@
+package tplinky
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrUnknownZone is returned when a timezone has no equivalent in
+// the device timezone table.
+var ErrUnknownZone = errors.New("timezone not in device table")
+
+// timeZones maps the timezone index used by the devices to the
+// equivalent IANA timezone name. The devices apply the daylight
+// saving rules of the indexed zone themselves.
+var timeZones = []string{
+	"Etc/GMT+12",
+	"Pacific/Samoa",
+	"US/Hawaii",
+	"US/Alaska",
+	"Mexico/BajaNorte",
+	"Etc/GMT+8",
+	"PST8PDT",
+	"US/Arizona",
+	"America/Mazatlan",
+	"America/Denver",
+	"MST7MDT",
+	"Mexico/General",
+	"Etc/GMT+6",
+	"CST6CDT",
+	"America/Monterrey",
+	"Canada/Saskatchewan",
+	"America/Bogota",
+	"Etc/GMT+5",
+	"America/New_York",
+	"America/Indiana/Indianapolis",
+	"America/Caracas",
+	"America/Asuncion",
+	"Etc/GMT+4",
+	"Canada/Atlantic",
+	"America/Cuiaba",
+	"Brazil/West",
+	"America/Santiago",
+	"Canada/Newfoundland",
+	"America/Sao_Paulo",
+	"America/Argentina/Buenos_Aires",
+	"America/Cayenne",
+	"America/Miquelon",
+	"America/Montevideo",
+	"Chile/Continental",
+	"Etc/GMT+2",
+	"Atlantic/Azores",
+	"Atlantic/Cape_Verde",
+	"Africa/Casablanca",
+	"UCT",
+	"GB",
+	"Africa/Monrovia",
+	"Europe/Amsterdam",
+	"Europe/Belgrade",
+	"Europe/Brussels",
+	"Europe/Sarajevo",
+	"Africa/Lagos",
+	"Africa/Windhoek",
+	"Asia/Amman",
+	"Europe/Athens",
+	"Asia/Beirut",
+	"Africa/Cairo",
+	"Asia/Damascus",
+	"EET",
+	"Africa/Harare",
+	"Europe/Helsinki",
+	"Asia/Istanbul",
+	"Asia/Jerusalem",
+	"Europe/Kaliningrad",
+	"Africa/Tripoli",
+	"Asia/Baghdad",
+	"Asia/Kuwait",
+	"Europe/Minsk",
+	"Europe/Moscow",
+	"Africa/Nairobi",
+	"Asia/Tehran",
+	"Asia/Muscat",
+	"Asia/Baku",
+	"Europe/Samara",
+	"Indian/Mauritius",
+	"Asia/Tbilisi",
+	"Asia/Yerevan",
+	"Asia/Kabul",
+	"Asia/Ashgabat",
+	"Asia/Yekaterinburg",
+	"Asia/Karachi",
+	"Asia/Kolkata",
+	"Asia/Colombo",
+	"Asia/Kathmandu",
+	"Asia/Almaty",
+	"Asia/Dhaka",
+	"Asia/Novosibirsk",
+	"Asia/Rangoon",
+	"Asia/Bangkok",
+	"Asia/Krasnoyarsk",
+	"Asia/Chongqing",
+	"Asia/Irkutsk",
+	"Asia/Singapore",
+	"Australia/Perth",
+	"Asia/Taipei",
+	"Asia/Ulaanbaatar",
+	"Asia/Tokyo",
+	"Asia/Seoul",
+	"Asia/Yakutsk",
+	"Australia/Adelaide",
+	"Australia/Darwin",
+	"Australia/Brisbane",
+	"Australia/Canberra",
+	"Pacific/Guam",
+	"Australia/Hobart",
+	"Antarctica/DumontDUrville",
+	"Asia/Magadan",
+	"Asia/Srednekolymsk",
+	"Etc/GMT-11",
+	"Asia/Anadyr",
+	"Pacific/Auckland",
+	"Etc/GMT-12",
+	"Pacific/Fiji",
+	"Etc/GMT-13",
+	"Pacific/Apia",
+	"Etc/GMT-14",
+}
+
+// zoneAliases maps common IANA names to the index of the table entry
+// that describes the same zone under another name. The IANA zones
+// MST and EST are fixed offsets that never change for daylight
+// saving time, so they map to Arizona and Etc/GMT+5, not to Mountain
+// and Eastern Time.
+var zoneAliases = map[string]int{
+	"America/Los_Angeles": 6,
+	"US/Pacific":          6,
+	"America/Phoenix":     7,
+	"MST":                 7,
+	"US/Mountain":         9,
+	"America/Chicago":     13,
+	"US/Central":          13,
+	"EST":                 17,
+	"EST5EDT":             18,
+	"US/Eastern":          18,
+	"Etc/UTC":             38,
+	"UTC":                 38,
+	"Europe/London":       39,
+}
+
+// TimeZoneName returns the IANA name of the device timezone index.
+func TimeZoneName(index int) (string, error) {
+	if index < 0 || index >= len(timeZones) {
+		return "", fmt.Errorf("timezone index %d: %w", index, ErrUnknownZone)
+	}
+	return timeZones[index], nil
+}
+
+// LoadTimeZone returns the location of the device timezone index.
+func LoadTimeZone(index int) (*time.Location, error) {
+	name, err := TimeZoneName(index)
+	if err != nil {
+		return nil, err
+	}
+	return time.LoadLocation(name)
+}
+
+// zoneOffsets samples the UTC offset of a location every six hours
+// through the year. Locations with the same samples keep the same
+// time.
+func zoneOffsets(loc *time.Location, year int) []int {
+	var offs []int
+	start := time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)
+	for t := start; t.Year() == year; t = t.Add(6 * time.Hour) {
+		_, off := t.In(loc).Zone()
+		offs = append(offs, off)
+	}
+	return offs
+}
+
+// TimeZoneIndex returns the device timezone index for a location.
+// Locations that are not in the table by name are matched to the
+// first zone that keeps the same time through the current year.
+func TimeZoneIndex(loc *time.Location) (int, error) {
+	name := loc.String()
+	for i, z := range timeZones {
+		if z == name {
+			return i, nil
+		}
+	}
+	if i, ok := zoneAliases[name]; ok {
+		return i, nil
+	}
+	year := time.Now().Year()
+	want := zoneOffsets(loc, year)
+next:
+	for i, z := range timeZones {
+		zl, err := time.LoadLocation(z)
+		if err != nil {
+			continue
+		}
+		got := zoneOffsets(zl, year)
+		for j := range want {
+			if got[j] != want[j] {
+				continue next
+			}
+		}
+		return i, nil
+	}
+	return 0, fmt.Errorf("%s: %w", name, ErrUnknownZone)
+}
+
+// timeZoneIndex reads the timezone index of the device.
+func (c *Conn) timeZoneIndex() (int, error) {
+	resp, err := c.Send(Control{
+		Time: &DevTime{
+			GetTimeZone: &RawNull,
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+	if resp.Time == nil || resp.Time.GetTimeZone == nil {
+		return 0, ErrTimeFailed
+	}
+	z := resp.Time.GetTimeZone
+	if err := ruleError("time", z.ErrCode, z.ErrMsg); err != nil {
+		return 0, err
+	}
+	return z.Index, nil
+}
+
+// GetTimeZone reads the timezone of the device.
+func (c *Conn) GetTimeZone() (*time.Location, error) {
+	index, err := c.timeZoneIndex()
+	if err != nil {
+		return nil, err
+	}
+	return LoadTimeZone(index)
+}
+
+// SetTimeZone sets the timezone of the device, and sets its clock to
+// the current time in that zone.
+func (c *Conn) SetTimeZone(loc *time.Location) error {
+	index, err := TimeZoneIndex(loc)
+	if err != nil {
+		return err
+	}
+	return c.setTime(time.Now().In(loc), index)
+}
@@ -0,0 +1,77 @@
+package tplinky
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeZoneIndex(t *testing.T) {
+	tests := []struct {
+		name  string
+		index int
+	}{
+		{"America/New_York", 18},
+		{"US/Eastern", 18},
+		{"EST5EDT", 18},
+		{"EST", 17},
+		{"America/Toronto", 18},
+		{"America/Denver", 9},
+		{"US/Mountain", 9},
+		{"MST", 7},
+		{"America/Phoenix", 7},
+		{"America/Los_Angeles", 6},
+		{"America/Chicago", 13},
+		{"Europe/London", 39},
+		{"UTC", 38},
+		{"Asia/Tokyo", 90},
+	}
+	for _, tc := range tests {
+		loc, err := time.LoadLocation(tc.name)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		got, err := TimeZoneIndex(loc)
+		if err != nil {
+			t.Errorf("TimeZoneIndex(%s) failed: %v", tc.name, err)
+			continue
+		}
+		if got != tc.index {
+			t.Errorf("TimeZoneIndex(%s) = %d, want %d", tc.name, got, tc.index)
+		}
+	}
+}
+
+func TestTimeZoneTable(t *testing.T) {
+	for i := range timeZones {
+		if _, err := LoadTimeZone(i); err != nil {
+			t.Errorf("LoadTimeZone(%d): %v", i, err)
+		}
+	}
+	if _, err := LoadTimeZone(len(timeZones)); err == nil {
+		t.Errorf("LoadTimeZone(%d) succeeded", len(timeZones))
+	}
+}
+
+func TestTimeZoneDST(t *testing.T) {
+	tests := []struct {
+		index          int
+		winter, summer string
+	}{
+		{18, "-0500", "-0400"},
+		{9, "-0700", "-0600"},
+		{7, "-0700", "-0700"},
+		{39, "+0000", "+0100"},
+	}
+	for _, tc := range tests {
+		loc, err := LoadTimeZone(tc.index)
+		if err != nil {
+			t.Fatalf("LoadTimeZone(%d): %v", tc.index, err)
+		}
+		if got := time.Date(2025, time.January, 15, 12, 0, 0, 0, loc).Format("-0700"); got != tc.winter {
+			t.Errorf("zone %d in January: got %s, want %s", tc.index, got, tc.winter)
+		}
+		if got := time.Date(2025, time.July, 15, 12, 0, 0, 0, loc).Format("-0700"); got != tc.summer {
+			t.Errorf("zone %d in July: got %s, want %s", tc.index, got, tc.summer)
+		}
+	}
+}
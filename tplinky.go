@@ -68,11 +68,11 @@ type ActionType struct {
 // Child is a structure containing sub-plug information. This is
 // present on the EP40(US) device.
 type Child struct {
-	ID         string     `json:"id",omitempty`
+	ID         string     `json:"id,omitempty"`
 	State      int        `json:"state"`
-	Alias      string     `json:"alias",omitempty`
+	Alias      string     `json:"alias,omitempty"`
 	OnTime     int        `json:"on_time"`
-	NextAction ActionType `json:"next_action",omitempty`
+	NextAction ActionType `json:"next_action,omitempty"`
 }
 
 // ControlContext is a control structure used to select power strip
@@ -92,7 +92,7 @@ type TimeZone struct {
 	Hour    int    `json:"hour"`
 	Min     int    `json:"min"`
 	Sec     int    `json:"sec"`
-	Index   int    `json:"index,omitempty"`
+	Index   int    `json:"index"`
 	ErrCode int    `json:"err_code,omitempty"`
 	ErrMsg  string `json:"err_msg,omitempty"`
 }
@@ -119,11 +119,31 @@ type EMeterResponse struct {
 	TotalWH   int `json:"total_wh,omitempty"`
 }
 
+// DayStat holds the energy consumed on one day. Older firmware
+// reports Energy in kWh, newer firmware reports EnergyWH.
+type DayStat struct {
+	Year     int     `json:"year"`
+	Month    int     `json:"month"`
+	Day      int     `json:"day"`
+	EnergyWH int     `json:"energy_wh,omitempty"`
+	Energy   float64 `json:"energy,omitempty"`
+}
+
+// DayStatResponse is used to request, and holds the response of, an
+// E-meter get_daystat command.
+type DayStatResponse struct {
+	Year    int       `json:"year,omitempty"`
+	Month   int       `json:"month,omitempty"`
+	DayList []DayStat `json:"day_list,omitempty"`
+	ErrCode int       `json:"err_code,omitempty"`
+}
+
 // EMeter is used to request E-meter functions and also supports
 // responses.
 type EMeter struct {
-	EraseEMeterStat *EMeterResponse `json:"erase_emeter_stat,omitempty"`
-	GetRealTime     *EMeterResponse `json:"get_realtime,omitempty"`
+	EraseEMeterStat *EMeterResponse  `json:"erase_emeter_stat,omitempty"`
+	GetRealTime     *EMeterResponse  `json:"get_realtime,omitempty"`
+	GetDayStat      *DayStatResponse `json:"get_daystat,omitempty"`
 }
 
 // SystemCommands holds a superset of the command structure for
@@ -178,16 +198,158 @@ type NetIfResponse struct {
 	GetScanInfoResponse *GetScanInfoResponse `json:"get_scaninfo,omitempty"`
 }
 
+// ScheduleRule is an on-device schedule rule. WDay holds 7 flags,
+// starting with Sunday, for the days of the week on which a repeating
+// rule fires. Non-repeating rules fire once on the Year, Month and
+// Day. The STimeOpt selects how the start time, SMin minutes past
+// midnight, is interpreted: 0 for a fixed time of day, 1 for
+// sunrise, and 2 for sunset (with SOffset minutes of offset). SAct is
+// the action at that time: 1 for on and 0 for off. The End fields are
+// the same for an optional second action, and are -1 when unused.
+type ScheduleRule struct {
+	ID       string `json:"id,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Enable   int    `json:"enable"`
+	WDay     []int  `json:"wday"`
+	Repeat   int    `json:"repeat"`
+	STimeOpt int    `json:"stime_opt"`
+	SMin     int    `json:"smin"`
+	SOffset  int    `json:"soffset,omitempty"`
+	SAct     int    `json:"sact"`
+	ETimeOpt int    `json:"etime_opt"`
+	EMin     int    `json:"emin"`
+	EOffset  int    `json:"eoffset,omitempty"`
+	EAct     int    `json:"eact"`
+	Year     int    `json:"year"`
+	Month    int    `json:"month"`
+	Day      int    `json:"day"`
+}
+
+// RuleList holds the response of a get_rules command.
+type RuleList struct {
+	RuleList json.RawMessage `json:"rule_list,omitempty"`
+	Enable   int             `json:"enable,omitempty"`
+	Version  int             `json:"version,omitempty"`
+	ErrCode  int             `json:"err_code,omitempty"`
+	ErrMsg   string          `json:"err_msg,omitempty"`
+}
+
+// RuleResult holds a rule identifier, for commands that act on a
+// rule, and the result of the rule commands.
+type RuleResult struct {
+	ID      string `json:"id,omitempty"`
+	Enable  *int   `json:"enable,omitempty"`
+	ErrCode int    `json:"err_code,omitempty"`
+	ErrMsg  string `json:"err_msg,omitempty"`
+}
+
+// Schedule holds schedule module commands and their responses.
+type Schedule struct {
+	GetRules         *RuleList     `json:"get_rules,omitempty"`
+	AddRule          *ScheduleRule `json:"add_rule,omitempty"`
+	EditRule         *ScheduleRule `json:"edit_rule,omitempty"`
+	DeleteRule       *RuleResult   `json:"delete_rule,omitempty"`
+	DeleteAllRules   *RuleResult   `json:"delete_all_rules,omitempty"`
+	SetOverallEnable *RuleResult   `json:"set_overall_enable,omitempty"`
+}
+
+// ScheduleResponse holds the responses to schedule module commands.
+type ScheduleResponse struct {
+	GetRules         *RuleList   `json:"get_rules,omitempty"`
+	AddRule          *RuleResult `json:"add_rule,omitempty"`
+	EditRule         *RuleResult `json:"edit_rule,omitempty"`
+	DeleteRule       *RuleResult `json:"delete_rule,omitempty"`
+	DeleteAllRules   *RuleResult `json:"delete_all_rules,omitempty"`
+	SetOverallEnable *RuleResult `json:"set_overall_enable,omitempty"`
+}
+
+// CountdownRule is an on-device countdown rule, which performs Act
+// (1 for on, 0 for off) Delay seconds after it is enabled. Remain
+// reports the seconds left before it fires.
+type CountdownRule struct {
+	ID     string `json:"id,omitempty"`
+	Name   string `json:"name,omitempty"`
+	Enable int    `json:"enable"`
+	Delay  int    `json:"delay"`
+	Act    int    `json:"act"`
+	Remain int    `json:"remain,omitempty"`
+}
+
+// CountDown holds count_down module commands.
+type CountDown struct {
+	GetRules       *RuleList      `json:"get_rules,omitempty"`
+	AddRule        *CountdownRule `json:"add_rule,omitempty"`
+	EditRule       *CountdownRule `json:"edit_rule,omitempty"`
+	DeleteRule     *RuleResult    `json:"delete_rule,omitempty"`
+	DeleteAllRules *RuleResult    `json:"delete_all_rules,omitempty"`
+}
+
+// CountDownResponse holds the responses to count_down module
+// commands.
+type CountDownResponse struct {
+	GetRules       *RuleList   `json:"get_rules,omitempty"`
+	AddRule        *RuleResult `json:"add_rule,omitempty"`
+	EditRule       *RuleResult `json:"edit_rule,omitempty"`
+	DeleteRule     *RuleResult `json:"delete_rule,omitempty"`
+	DeleteAllRules *RuleResult `json:"delete_all_rules,omitempty"`
+}
+
+// AwayRule is an on-device anti-theft (away mode) rule. Between the
+// start and end times, the device switches its relay on and off at
+// random to make the home look occupied. The fields have the same
+// meaning as those of a ScheduleRule.
+type AwayRule struct {
+	ID        string `json:"id,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Enable    int    `json:"enable"`
+	WDay      []int  `json:"wday"`
+	Repeat    int    `json:"repeat"`
+	STimeOpt  int    `json:"stime_opt"`
+	SMin      int    `json:"smin"`
+	SOffset   int    `json:"soffset,omitempty"`
+	ETimeOpt  int    `json:"etime_opt"`
+	EMin      int    `json:"emin"`
+	EOffset   int    `json:"eoffset,omitempty"`
+	Frequency int    `json:"frequency,omitempty"`
+	Year      int    `json:"year"`
+	Month     int    `json:"month"`
+	Day       int    `json:"day"`
+}
+
+// AntiTheft holds anti_theft module commands.
+type AntiTheft struct {
+	GetRules         *RuleList   `json:"get_rules,omitempty"`
+	AddRule          *AwayRule   `json:"add_rule,omitempty"`
+	EditRule         *AwayRule   `json:"edit_rule,omitempty"`
+	DeleteRule       *RuleResult `json:"delete_rule,omitempty"`
+	DeleteAllRules   *RuleResult `json:"delete_all_rules,omitempty"`
+	SetOverallEnable *RuleResult `json:"set_overall_enable,omitempty"`
+}
+
+// AntiTheftResponse holds the responses to anti_theft module
+// commands.
+type AntiTheftResponse struct {
+	GetRules         *RuleList   `json:"get_rules,omitempty"`
+	AddRule          *RuleResult `json:"add_rule,omitempty"`
+	EditRule         *RuleResult `json:"edit_rule,omitempty"`
+	DeleteRule       *RuleResult `json:"delete_rule,omitempty"`
+	DeleteAllRules   *RuleResult `json:"delete_all_rules,omitempty"`
+	SetOverallEnable *RuleResult `json:"set_overall_enable,omitempty"`
+}
+
 // Control is a structure containing the TP-link control syntax as
 // described here:
 //
 //	https://github.com/softScheck/tplink-smartplug/blob/master/tplink-smarthome-commands.txt
 type Control struct {
-	Context *ControlContext `json:"context,omitempty"`
-	System  *SystemCommands `json:"system,omitempty"`
-	Time    *DevTime        `json:"time,omitempty"`
-	NetIf   *NetIfCommands  `json:"netif,omitempty"`
-	EMeter  *EMeter         `json:"emeter,omitempty"`
+	Context   *ControlContext `json:"context,omitempty"`
+	System    *SystemCommands `json:"system,omitempty"`
+	Time      *DevTime        `json:"time,omitempty"`
+	NetIf     *NetIfCommands  `json:"netif,omitempty"`
+	EMeter    *EMeter         `json:"emeter,omitempty"`
+	Schedule  *Schedule       `json:"schedule,omitempty"`
+	CountDown *CountDown      `json:"count_down,omitempty"`
+	AntiTheft *AntiTheft      `json:"anti_theft,omitempty"`
 }
 
 // GetSysinfo holds the empty request for obtaining Sysinfo from the
@@ -234,17 +396,21 @@ type SystemResponse struct {
 
 // Response is a structure containing the TP-link control response.
 type Response struct {
-	System *SystemResponse `json:"system,omitempty"`
-	Time   *TimeResponse   `json:"time,omitempty"`
-	NetIf  *NetIfResponse  `json:"netif,omitempty"`
-	EMeter *EMeter         `json:"emeter,omitempty"`
+	System    *SystemResponse    `json:"system,omitempty"`
+	Time      *TimeResponse      `json:"time,omitempty"`
+	NetIf     *NetIfResponse     `json:"netif,omitempty"`
+	EMeter    *EMeter            `json:"emeter,omitempty"`
+	Schedule  *ScheduleResponse  `json:"schedule,omitempty"`
+	CountDown *CountDownResponse `json:"count_down,omitempty"`
+	AntiTheft *AntiTheftResponse `json:"anti_theft,omitempty"`
 }
 
 // Conn holds an open connection to a TP-Link device. It uses the port
 // 9999 TCP protocol for communication.
 type Conn struct {
-	target string
-	conn   net.Conn
+	target  string
+	timeout time.Duration
+	conn    net.Conn
 }
 
 // Encode translates to and from the obfuscation format of the tp-link
@@ -283,6 +449,11 @@ func Decode(p []byte) *bytes.Buffer {
 	return b
 }
 
+// Addr returns the "host:port" address of the connected device.
+func (c *Conn) Addr() string {
+	return c.target
+}
+
 // Read reads and decodes upto len(p) bytes from the target.
 func (c *Conn) Read(p []byte) (n int, err error) {
 	if n, err = c.conn.Read(p); err != nil {
@@ -314,7 +485,8 @@ func (c *Conn) Close() error {
 }
 
 // Dial the TP-link target with a custom dial timeout, returning an
-// open connection or an error.
+// open connection or an error. The timeout also limits how long each
+// command sent over the connection waits for its reply.
 func DialTimeout(target string, timeout time.Duration) (*Conn, error) {
 	if !strings.Contains(target, ":") {
 		target += ":9999"
@@ -325,8 +497,9 @@ func DialTimeout(target string, timeout time.Duration) (*Conn, error) {
 		return nil, err
 	}
 	return &Conn{
-		target: target,
-		conn:   conn,
+		target:  target,
+		timeout: timeout,
+		conn:    conn,
 	}, nil
 }
 
@@ -343,8 +516,12 @@ func (c *Conn) Send(cmd Control) (*Response, error) {
 	}
 	var b bytes.Buffer
 	json.Compact(&b, j)
+	timeout := c.timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
 	defer c.conn.SetDeadline(time.Time{})
-	c.conn.SetDeadline(time.Now().Add(DefaultTimeout))
+	c.conn.SetDeadline(time.Now().Add(timeout))
 	if _, err := c.conn.Write(Encode(b.Bytes()).Bytes()); err != nil {
 		return nil, err
 	}
@@ -356,7 +533,9 @@ func (c *Conn) Send(cmd Control) (*Response, error) {
 			return nil, err
 		}
 		resp = append(resp, d[:n]...)
-		if n != 1028 {
+		// The reply is prefixed with its length, and large
+		// replies can arrive in several reads.
+		if len(resp) >= 4 && len(resp)-4 >= int(binary.BigEndian.Uint32(resp)) {
 			break
 		}
 	}
@@ -0,0 +1,74 @@
+package tplinky
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sysinfoReply returns a get_sysinfo reply for the alias.
+func sysinfoReply(alias string) map[string]interface{} {
+	return map[string]interface{}{
+		"system": map[string]interface{}{
+			"get_sysinfo": map[string]interface{}{"alias": alias},
+		},
+	}
+}
+
+func TestSendSplitReply(t *testing.T) {
+	// The old reader stopped at the first read shorter than its
+	// 1028 byte buffer, and blocked on a reply of exactly that
+	// length.
+	base, err := json.Marshal(sysinfoReply(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		alias string
+		size  int
+	}{
+		{"short", 3},
+		{strings.Repeat("x", 5000), 700},
+		{strings.Repeat("y", 1024-len(base)), 1028},
+		{strings.Repeat("z", 1024-len(base)), 2},
+	}
+	for _, tc := range tests {
+		alias := tc.alias
+		addr := fakeDevice(t, func(req map[string]interface{}) interface{} {
+			return chunked{sysinfoReply(alias), tc.size}
+		})
+		c, err := DialTimeout(addr, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := fmt.Sprintf("%d bytes in %d byte pieces", len(alias)+len(base)+4, tc.size)
+		sys, err := c.GetStatus()
+		if err != nil {
+			t.Errorf("%s: GetStatus failed: %v", name, err)
+		} else if sys.Alias != alias {
+			t.Errorf("%s: got alias of %d bytes, want %d", name, len(sys.Alias), len(alias))
+		}
+		c.Close()
+	}
+}
+
+func TestSendTimeout(t *testing.T) {
+	addr := fakeDevice(t, func(req map[string]interface{}) interface{} {
+		time.Sleep(DefaultTimeout + time.Second)
+		return sysinfoReply("late")
+	})
+	c, err := DialTimeout(addr, 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	start := time.Now()
+	if _, err := c.GetStatus(); err == nil {
+		t.Error("GetStatus succeeded with no timely reply")
+	}
+	if took := time.Since(start); took >= DefaultTimeout {
+		t.Errorf("GetStatus took %v, want the 100ms dial timeout", took)
+	}
+}
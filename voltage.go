@@ -0,0 +1,404 @@
+package tplinky
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The kinds of VoltageEvent.
+const (
+	VoltageSag    = "sag"
+	VoltageSwell  = "swell"
+	VoltageOutage = "outage"
+)
+
+// VoltageEvent records a period during which the mains voltage seen
+// by a device was outside of its normal range. An event that is
+// still in progress has a zero End.
+type VoltageEvent struct {
+	Device string
+	Kind   string
+	Start  time.Time
+	End    time.Time
+	MinMV  int
+	MaxMV  int
+}
+
+// Duration returns the length of the event, or the time since it
+// started for events in progress.
+func (e VoltageEvent) Duration() time.Duration {
+	if e.End.IsZero() {
+		return time.Since(e.Start)
+	}
+	return e.End.Sub(e.Start)
+}
+
+// String summarizes the event.
+func (e VoltageEvent) String() string {
+	s := fmt.Sprintf("%s %s at %s", e.Device, e.Kind, e.Start.Format("2006-01-02 15:04:05"))
+	if !e.End.IsZero() {
+		s += fmt.Sprintf(" for %v", e.End.Sub(e.Start).Round(time.Second))
+	}
+	if e.Kind != VoltageOutage || e.MaxMV != 0 {
+		s += fmt.Sprintf(" (%.1f-%.1fVAC)", float64(e.MinMV)/1e3, float64(e.MaxMV)/1e3)
+	}
+	return s
+}
+
+// VoltageStats summarizes the voltage readings of a device.
+type VoltageStats struct {
+	Samples    int
+	MinMV      int
+	MaxMV      int
+	SumMV      int64
+	Sags       int
+	Swells     int
+	Outages    int
+	SagTime    time.Duration
+	SwellTime  time.Duration
+	OutageTime time.Duration
+}
+
+// MeanMV returns the mean voltage reading.
+func (s *VoltageStats) MeanMV() float64 {
+	if s.Samples == 0 {
+		return 0
+	}
+	return float64(s.SumMV) / float64(s.Samples)
+}
+
+// PowerQuality summarizes the mains voltage seen by a set of devices
+// over a day.
+type PowerQuality struct {
+	Day     time.Time
+	Devices map[string]*VoltageStats
+
+	// Correlated lists groups of events that several devices saw
+	// at the same time. These are likely to be real mains events
+	// rather than problems with one device.
+	Correlated [][]VoltageEvent
+}
+
+// VoltageMonitor samples the voltage readings of E-Meter capable
+// devices and records sag, swell and outage events.
+type VoltageMonitor struct {
+	// Devices lists the addresses of the monitored devices.
+	Devices []string
+
+	// NominalMV is the nominal mains voltage, typically 120000
+	// or 230000.
+	NominalMV int
+
+	// A sag is a reading more than SagPct percent below nominal,
+	// and a swell is one more than SwellPct above it. Zero values
+	// default to 10 percent. A reading below half of nominal, or
+	// an unreachable device, is treated as an outage.
+	SagPct   float64
+	SwellPct float64
+
+	// Timeout is used to connect to the devices. If zero,
+	// DefaultTimeout is used.
+	Timeout time.Duration
+
+	// Log, if not nil, is called with each event when it starts
+	// and again when it ends.
+	Log func(VoltageEvent)
+
+	// LogError, if not nil, is called when a reading fails for a
+	// reason other than the device being unreachable. Such readings
+	// are skipped. A device without an E-Meter is reported once,
+	// and is not sampled again.
+	LogError func(device string, err error)
+
+	mu        sync.Mutex
+	open      map[string]*VoltageEvent
+	events    []VoltageEvent
+	stats     map[string]map[string]*VoltageStats
+	unmetered map[string]bool
+}
+
+func (m *VoltageMonitor) timeout() time.Duration {
+	if m.Timeout == 0 {
+		return DefaultTimeout
+	}
+	return m.Timeout
+}
+
+// classify returns the kind of event a reading belongs to, or "" for
+// a normal reading.
+func (m *VoltageMonitor) classify(mv int, reachable bool) string {
+	sag, swell := m.SagPct, m.SwellPct
+	if sag == 0 {
+		sag = 10
+	}
+	if swell == 0 {
+		swell = 10
+	}
+	switch n := float64(m.NominalMV); {
+	case !reachable || float64(mv) < n/2:
+		return VoltageOutage
+	case float64(mv) < n*(1-sag/100):
+		return VoltageSag
+	case float64(mv) > n*(1+swell/100):
+		return VoltageSwell
+	}
+	return ""
+}
+
+// Add records a voltage reading for a device. An unreachable device
+// is recorded with reachable false.
+func (m *VoltageMonitor) Add(device string, when time.Time, mv int, reachable bool) {
+	kind := m.classify(mv, reachable)
+	var logged []VoltageEvent
+
+	m.mu.Lock()
+	if m.open == nil {
+		m.open = make(map[string]*VoltageEvent)
+		m.stats = make(map[string]map[string]*VoltageStats)
+	}
+	day := when.Format("2006-01-02")
+	if m.stats[day] == nil {
+		m.stats[day] = make(map[string]*VoltageStats)
+	}
+	st := m.stats[day][device]
+	if st == nil {
+		st = &VoltageStats{}
+		m.stats[day][device] = st
+	}
+	if reachable {
+		if st.Samples == 0 || mv < st.MinMV {
+			st.MinMV = mv
+		}
+		if mv > st.MaxMV {
+			st.MaxMV = mv
+		}
+		st.Samples++
+		st.SumMV += int64(mv)
+	}
+
+	e := m.open[device]
+	if e != nil && e.Kind != kind {
+		e.End = when
+		m.events = append(m.events, *e)
+		logged = append(logged, *e)
+		delete(m.open, device)
+		e = nil
+	}
+	if kind != "" {
+		if e == nil {
+			e = &VoltageEvent{Device: device, Kind: kind, Start: when, MinMV: mv, MaxMV: mv}
+			m.open[device] = e
+			logged = append(logged, *e)
+			switch kind {
+			case VoltageSag:
+				st.Sags++
+			case VoltageSwell:
+				st.Swells++
+			case VoltageOutage:
+				st.Outages++
+			}
+		}
+		if reachable {
+			if mv < e.MinMV {
+				e.MinMV = mv
+			}
+			if mv > e.MaxMV {
+				e.MaxMV = mv
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	if m.Log != nil {
+		for _, e := range logged {
+			m.Log(e)
+		}
+	}
+}
+
+// sample reads the voltage of one device. Only a device that cannot
+// be connected to, or that does not answer in time, is recorded as
+// unreachable.
+func (m *VoltageMonitor) sample(d string) {
+	c, err := DialTimeout(d, m.timeout())
+	if err != nil {
+		m.Add(d, time.Now(), 0, false)
+		return
+	}
+	s, err := c.EMonState()
+	c.Close()
+	var ne net.Error
+	switch {
+	case err == nil:
+		m.Add(d, time.Now(), s.VoltageMV, true)
+	case errors.As(err, &ne) && ne.Timeout():
+		m.Add(d, time.Now(), 0, false)
+	default:
+		if errors.Is(err, ErrNoEMeter) {
+			m.mu.Lock()
+			if m.unmetered == nil {
+				m.unmetered = make(map[string]bool)
+			}
+			m.unmetered[d] = true
+			m.mu.Unlock()
+		}
+		if m.LogError != nil {
+			m.LogError(d, err)
+		}
+	}
+}
+
+// Sample reads the voltage of all of the devices, in parallel.
+func (m *VoltageMonitor) Sample() {
+	var wg sync.WaitGroup
+	for _, d := range m.Devices {
+		m.mu.Lock()
+		skip := m.unmetered[d]
+		m.mu.Unlock()
+		if skip {
+			continue
+		}
+		wg.Add(1)
+		go func(d string) {
+			defer wg.Done()
+			m.sample(d)
+		}(d)
+	}
+	wg.Wait()
+}
+
+// Run calls Sample every interval until done is closed.
+func (m *VoltageMonitor) Run(every time.Duration, done <-chan struct{}) {
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+	for {
+		m.Sample()
+		select {
+		case <-done:
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// Events returns the recorded events, including those in progress,
+// that started in the window [from, to).
+func (m *VoltageMonitor) Events(from, to time.Time) []VoltageEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var es []VoltageEvent
+	for _, e := range m.events {
+		if inWindow(e.Start, from, to) {
+			es = append(es, e)
+		}
+	}
+	for _, e := range m.open {
+		if inWindow(e.Start, from, to) {
+			es = append(es, *e)
+		}
+	}
+	sort.Slice(es, func(i, j int) bool { return es[i].Start.Before(es[j].Start) })
+	return es
+}
+
+// CorrelateVoltage groups events of the same kind, seen by different
+// devices, that overlap in time, allowing for slack between the
+// devices' observations. Only groups that involve more than one
+// device are returned.
+func CorrelateVoltage(events []VoltageEvent, slack time.Duration) [][]VoltageEvent {
+	es := append([]VoltageEvent(nil), events...)
+	sort.Slice(es, func(i, j int) bool { return es[i].Start.Before(es[j].Start) })
+	var groups [][]VoltageEvent
+	used := make([]bool, len(es))
+	for i := range es {
+		if used[i] {
+			continue
+		}
+		group := []VoltageEvent{es[i]}
+		devices := map[string]bool{es[i].Device: true}
+		end := es[i].End
+		if end.IsZero() {
+			end = time.Now()
+		}
+		for j := i + 1; j < len(es) && !es[j].Start.After(end.Add(slack)); j++ {
+			if used[j] || es[j].Kind != es[i].Kind || devices[es[j].Device] {
+				continue
+			}
+			used[j] = true
+			devices[es[j].Device] = true
+			group = append(group, es[j])
+			if es[j].End.After(end) {
+				end = es[j].End
+			}
+		}
+		if len(devices) > 1 {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// DailySummary summarizes the readings and events of the day
+// containing t.
+func (m *VoltageMonitor) DailySummary(t time.Time) *PowerQuality {
+	from := startOfDay(t)
+	to := from.AddDate(0, 0, 1)
+	events := m.Events(from, to)
+	pq := &PowerQuality{
+		Day:        from,
+		Devices:    make(map[string]*VoltageStats),
+		Correlated: CorrelateVoltage(events, 5*time.Second),
+	}
+	m.mu.Lock()
+	for d, st := range m.stats[from.Format("2006-01-02")] {
+		c := *st
+		pq.Devices[d] = &c
+	}
+	m.mu.Unlock()
+	for _, e := range events {
+		st := pq.Devices[e.Device]
+		if st == nil {
+			continue
+		}
+		end := e.End
+		if end.IsZero() || end.After(to) {
+			end = to
+			if now := time.Now(); now.Before(end) {
+				end = now
+			}
+		}
+		switch d := end.Sub(e.Start); e.Kind {
+		case VoltageSag:
+			st.SagTime += d
+		case VoltageSwell:
+			st.SwellTime += d
+		case VoltageOutage:
+			st.OutageTime += d
+		}
+	}
+	return pq
+}
+
+// Forget discards the closed events and daily statistics from before
+// the specified time.
+func (m *VoltageMonitor) Forget(before time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var es []VoltageEvent
+	for _, e := range m.events {
+		if !e.End.Before(before) {
+			es = append(es, e)
+		}
+	}
+	m.events = es
+	cut := startOfDay(before).Format("2006-01-02")
+	for day := range m.stats {
+		if day < cut {
+			delete(m.stats, day)
+		}
+	}
+}
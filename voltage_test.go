@@ -0,0 +1,62 @@
+package tplinky
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestVoltageMonitorSample(t *testing.T) {
+	metered := fakeDevice(t, func(req map[string]interface{}) interface{} {
+		return map[string]interface{}{
+			"emeter": map[string]interface{}{
+				"get_realtime": map[string]interface{}{"voltage_mv": 121000, "power_mw": 5000},
+			},
+		}
+	})
+	unmetered := fakeDevice(t, func(req map[string]interface{}) interface{} {
+		return map[string]interface{}{
+			"emeter": map[string]interface{}{"err_code": -1, "err_msg": "module not support"},
+		}
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone := l.Addr().String()
+	l.Close()
+
+	var events []VoltageEvent
+	errs := make(map[string]error)
+	m := &VoltageMonitor{
+		Devices:   []string{metered, unmetered, gone},
+		NominalMV: 120000,
+		Timeout:   time.Second,
+		Log: func(e VoltageEvent) {
+			events = append(events, e)
+		},
+		LogError: func(device string, err error) {
+			if errs[device] != nil {
+				t.Errorf("%s: error reported again: %v", device, err)
+			}
+			errs[device] = err
+		},
+	}
+	m.Sample()
+	m.Sample()
+
+	if len(events) != 1 || events[0].Device != gone || events[0].Kind != VoltageOutage {
+		t.Errorf("got events %v, want one outage for %s", events, gone)
+	}
+	if len(errs) != 1 || !errors.Is(errs[unmetered], ErrNoEMeter) {
+		t.Errorf("got errors %v, want ErrNoEMeter for %s", errs, unmetered)
+	}
+	pq := m.DailySummary(time.Now())
+	if st := pq.Devices[metered]; st == nil || st.Samples != 2 || st.MinMV != 121000 {
+		t.Errorf("%s: got stats %+v, want 2 samples at 121000mV", metered, st)
+	}
+	if st := pq.Devices[unmetered]; st != nil {
+		t.Errorf("%s: got stats %+v, want none", unmetered, st)
+	}
+}
@@ -0,0 +1,147 @@
+package tplinky
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNoSSID is returned when the device cannot see the WiFi
+	// network it is asked to join.
+	ErrNoSSID = errors.New("device cannot see the WiFi network")
+
+	// ErrNotJoined is returned when the device did not appear on
+	// the network it was asked to join.
+	ErrNotJoined = errors.New("device did not appear on the WiFi network")
+
+	// ErrNoNetwork is returned by JoinWiFi when it is given no
+	// network to look for the device on.
+	ErrNoNetwork = errors.New("no network to confirm the device joined")
+)
+
+// WeakRSSI is the signal strength, in dBm, below which a WiFi
+// connection is likely to be unreliable.
+const WeakRSSI = -70
+
+// FindAP looks for the named network in a WiFi scan. When several
+// access points share the name, the strongest one is returned, and
+// those whose RSSI is not reported are only returned if no other is.
+func (s *GetScanInfoResponse) FindAP(ssid string) *APEntry {
+	var best *APEntry
+	for _, ap := range s.APList {
+		if ap.SSID != ssid {
+			continue
+		}
+		if best == nil || (ap.RSSI != 0 && (best.RSSI == 0 || ap.RSSI > best.RSSI)) {
+			best = ap
+		}
+	}
+	return best
+}
+
+// setStaInfo sends the WiFi credentials to the device.
+func (c *Conn) setStaInfo(ssid, password string, keyType int) error {
+	_, err := c.Send(Control{
+		NetIf: &NetIfCommands{
+			SetStaInfo: &StaInfoParameters{
+				SSID:     ssid,
+				Password: password,
+				KeyType:  keyType,
+			},
+		},
+	})
+	return err
+}
+
+// FindMac scans a network, as Scan does, for the device with the MAC
+// address, returning its address.
+func FindMac(network, mac string, timeout time.Duration) (string, *Sysinfo) {
+	for addr, sys := range Scan(network, timeout) {
+		if strings.EqualFold(sys.Mac, mac) {
+			return addr, sys
+		}
+	}
+	return "", nil
+}
+
+// Joined describes the outcome of JoinWiFi.
+type Joined struct {
+	// AP is the access point the device was seen to join, or nil
+	// if the device could not see the network.
+	AP *APEntry
+
+	// Weak indicates that the device saw the access point with a
+	// signal below WeakRSSI.
+	Weak bool
+
+	// Addr is the device's address on the new network. It is
+	// empty when the join was not verified, as with SendWiFi.
+	Addr string
+
+	// Took is how long the device took to appear on the network.
+	Took time.Duration
+}
+
+// SendWiFi gives the device the settings to join a WiFi network,
+// without confirming that it joined. The network's key type is taken
+// from a WiFi scan by the device. If the device cannot see the
+// network, as with one that hides its SSID, keyType is used instead,
+// unless it is negative, in which case ErrNoSSID is returned.
+func (c *Conn) SendWiFi(ssid, password string, keyType int) (*Joined, error) {
+	j := &Joined{}
+	scan, err := c.ListWiFi()
+	if err == nil {
+		j.AP = scan.FindAP(ssid)
+	} else if keyType < 0 {
+		return nil, err
+	}
+	if j.AP != nil {
+		keyType = j.AP.KeyType
+		j.Weak = j.AP.RSSI != 0 && j.AP.RSSI < WeakRSSI
+	} else if keyType < 0 {
+		return nil, fmt.Errorf("%q: %w", ssid, ErrNoSSID)
+	}
+	return j, c.setStaInfo(ssid, password, keyType)
+}
+
+// JoinWiFi makes the device join a WiFi network, as SendWiFi does,
+// and confirms that it joined by scanning network, a CIDR subnet, for
+// up to wait, until the device appears on it with the same MAC
+// address. The scan uses the timeout the device was dialed with.
+// Without a network, ErrNoNetwork is returned and nothing is sent.
+func (c *Conn) JoinWiFi(ssid, password string, keyType int, network string, wait time.Duration) (*Joined, error) {
+	if network == "" {
+		return nil, ErrNoNetwork
+	}
+	sys, err := c.GetStatus()
+	if err != nil {
+		return nil, err
+	}
+	j, err := c.SendWiFi(ssid, password, keyType)
+	if err != nil {
+		return j, err
+	}
+	if j.Addr, j.Took, err = waitForMac(network, sys.Mac, c.timeout, wait); err != nil {
+		return j, fmt.Errorf("%q: %w", ssid, err)
+	}
+	return j, nil
+}
+
+// waitForMac scans a network, as FindMac does, every few seconds
+// until the device with the MAC address appears on it, or until wait
+// has passed. It returns the device's address and how long it took
+// to appear.
+func waitForMac(network, mac string, timeout, wait time.Duration) (string, time.Duration, error) {
+	start := time.Now()
+	for {
+		if addr, _ := FindMac(network, mac, timeout); addr != "" {
+			return addr, time.Since(start), nil
+		}
+		if time.Since(start) > wait {
+			return "", 0, fmt.Errorf("%s: %w", mac, ErrNotJoined)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
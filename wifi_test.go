@@ -0,0 +1,121 @@
+package tplinky
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestSendWiFi(t *testing.T) {
+	var mu sync.Mutex
+	var sent []map[string]interface{}
+	addr := fakeDevice(t, func(req map[string]interface{}) interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		if module(req, "system") != nil {
+			return map[string]interface{}{
+				"system": map[string]interface{}{
+					"get_sysinfo": map[string]interface{}{"mac": "50:C7:BF:00:00:01"},
+				},
+			}
+		}
+		netif := module(req, "netif")
+		if set, ok := netif["set_stainfo"].(map[string]interface{}); ok {
+			sent = append(sent, set)
+			return map[string]interface{}{"netif": map[string]interface{}{"set_stainfo": map[string]interface{}{}}}
+		}
+		return map[string]interface{}{
+			"netif": map[string]interface{}{
+				"get_scaninfo": map[string]interface{}{
+					"ap_list": []map[string]interface{}{
+						{"ssid": "Cafe", "key_type": 0, "rssi": -50},
+						{"ssid": "Home", "key_type": 3, "rssi": -82},
+						{"ssid": "Home", "key_type": 3, "rssi": -75},
+					},
+				},
+			},
+		}
+	})
+	c, err := Dial(addr)
+	if err != nil {
+		t.Fatalf("unable to dial fake device: %v", err)
+	}
+	defer c.Close()
+
+	tests := []struct {
+		ssid    string
+		keyType int
+		sent    float64
+		seen    bool
+		weak    bool
+	}{
+		{"Home", 2, 3, true, true},
+		{"Cafe", 3, 0, true, false},
+		{"Hidden", 2, 2, false, false},
+	}
+	for _, tc := range tests {
+		mu.Lock()
+		sent = nil
+		mu.Unlock()
+		j, err := c.SendWiFi(tc.ssid, "secret", tc.keyType)
+		if err != nil {
+			t.Fatalf("SendWiFi(%q) failed: %v", tc.ssid, err)
+		}
+		if (j.AP != nil) != tc.seen || j.Weak != tc.weak {
+			t.Errorf("SendWiFi(%q) = %+v, want seen=%v weak=%v", tc.ssid, j, tc.seen, tc.weak)
+		}
+		if j.AP != nil && j.AP.RSSI != -75 && tc.ssid == "Home" {
+			t.Errorf("SendWiFi(%q) chose %+v, want the strongest access point", tc.ssid, j.AP)
+		}
+		mu.Lock()
+		if len(sent) != 1 || sent[0]["ssid"] != tc.ssid || sent[0]["key_type"] != tc.sent {
+			t.Errorf("SendWiFi(%q) sent %v, want key type %v", tc.ssid, sent, tc.sent)
+		}
+		mu.Unlock()
+	}
+
+	mu.Lock()
+	sent = nil
+	mu.Unlock()
+	if _, err := c.SendWiFi("Hidden", "secret", -1); !errors.Is(err, ErrNoSSID) {
+		t.Errorf("SendWiFi of an unseen network with no key type: got %v, want ErrNoSSID", err)
+	}
+	if _, err := c.JoinWiFi("Home", "secret", 3, "", 0); !errors.Is(err, ErrNoNetwork) {
+		t.Errorf("JoinWiFi with no network: got %v, want ErrNoNetwork", err)
+	}
+	mu.Lock()
+	if len(sent) != 0 {
+		t.Errorf("refused joins sent %v", sent)
+	}
+	mu.Unlock()
+}
+
+func TestFindAP(t *testing.T) {
+	scan := &GetScanInfoResponse{APList: []*APEntry{
+		{SSID: "Home", KeyType: 2},
+		{SSID: "Home", KeyType: 3, RSSI: -82},
+		{SSID: "Home", KeyType: 3, RSSI: -71},
+		{SSID: "Old", KeyType: 1},
+		{SSID: "Old", KeyType: 2},
+		{SSID: "Cafe", KeyType: 0, RSSI: -60},
+		{SSID: "Cafe", KeyType: 0},
+	}}
+	tests := []struct {
+		ssid    string
+		keyType int
+		rssi    int
+	}{
+		{"Home", 3, -71},
+		{"Old", 1, 0},
+		{"Cafe", 0, -60},
+	}
+	for _, tc := range tests {
+		ap := scan.FindAP(tc.ssid)
+		if ap == nil || ap.KeyType != tc.keyType || ap.RSSI != tc.rssi {
+			t.Errorf("FindAP(%q) = %+v, want key type %d at %ddBm", tc.ssid, ap, tc.keyType, tc.rssi)
+		}
+	}
+	if ap := scan.FindAP("Missing"); ap != nil {
+		t.Errorf("FindAP(%q) = %+v, want nil", "Missing", ap)
+	}
+}
@@ -0,0 +1,247 @@
+package tplinky
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// yamlLine is a significant line of a YAML document.
+type yamlLine struct {
+	n      int
+	indent int
+	text   string
+}
+
+// yamlToJSON converts a YAML document into JSON, so it can be decoded
+// like a JSON configuration file. Only the block style subset of YAML
+// that configuration files tend to use is supported: nested mappings
+// and sequences, plain and quoted scalars, flow sequences of scalars
+// and comments. Anchors, tags, multi-line scalars and multiple
+// documents are not.
+func yamlToJSON(data []byte) ([]byte, error) {
+	var lines []yamlLine
+	for i, l := range strings.Split(string(data), "\n") {
+		l = strings.TrimRight(yamlComment(l), " \t\r")
+		text := strings.TrimLeft(l, " ")
+		if text == "" || text == "---" {
+			continue
+		}
+		if strings.HasPrefix(text, "\t") {
+			return nil, fmt.Errorf("yaml line %d: tab indentation", i+1)
+		}
+		lines = append(lines, yamlLine{n: i + 1, indent: len(l) - len(text), text: text})
+	}
+	if len(lines) == 0 {
+		return []byte("null"), nil
+	}
+	v, next, err := yamlBlock(lines, 0, lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if next != len(lines) {
+		return nil, fmt.Errorf("yaml line %d: unexpected indentation", lines[next].n)
+	}
+	return json.Marshal(v)
+}
+
+// yamlComment strips any comment from a line.
+func yamlComment(l string) string {
+	quote := byte(0)
+	for i := 0; i < len(l); i++ {
+		switch c := l[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || l[i-1] == ' ' || l[i-1] == '\t'):
+			return l[:i]
+		}
+	}
+	return l
+}
+
+// yamlKey splits a "key: value" mapping entry. The value may be
+// empty.
+func yamlKey(text string) (key, value string, ok bool) {
+	quote := byte(0)
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ':' && (i+1 == len(text) || text[i+1] == ' '):
+			key = strings.TrimSpace(text[:i])
+			if k, err := yamlScalar(key); err == nil {
+				if s, ok := k.(string); ok {
+					key = s
+				}
+			}
+			return key, strings.TrimSpace(text[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+// yamlItem confirms the text is a sequence item, returning the
+// text after the dash.
+func yamlItem(text string) (string, bool) {
+	if text == "-" {
+		return "", true
+	}
+	if strings.HasPrefix(text, "- ") {
+		return strings.TrimLeft(text[2:], " "), true
+	}
+	return "", false
+}
+
+// yamlBlock decodes the mapping or sequence that starts at lines[i]
+// with the given indentation. It returns the index of the first line
+// after it.
+func yamlBlock(lines []yamlLine, i, indent int) (interface{}, int, error) {
+	if _, ok := yamlItem(lines[i].text); ok {
+		var seq []interface{}
+		for i < len(lines) && lines[i].indent == indent {
+			rest, ok := yamlItem(lines[i].text)
+			if !ok {
+				// A sequence indented to the same depth as
+				// its key ends at the next key.
+				break
+			}
+			var v interface{}
+			var err error
+			_, _, isMap := yamlKey(rest)
+			_, isSeq := yamlItem(rest)
+			switch {
+			case rest == "":
+				v, i, err = yamlValue(lines, i, indent)
+			case isMap || isSeq:
+				// The item is a block that starts on the
+				// same line as the dash.
+				lines[i].indent += len(lines[i].text) - len(rest)
+				lines[i].text = rest
+				v, i, err = yamlBlock(lines, i, lines[i].indent)
+			default:
+				v, err = yamlScalar(rest)
+				i++
+			}
+			if err != nil {
+				return nil, i, err
+			}
+			seq = append(seq, v)
+		}
+		return seq, i, nil
+	}
+	m := make(map[string]interface{})
+	for i < len(lines) && lines[i].indent == indent {
+		key, value, ok := yamlKey(lines[i].text)
+		if !ok {
+			return nil, i, fmt.Errorf("yaml line %d: expected \"key: value\"", lines[i].n)
+		}
+		if _, dup := m[key]; dup {
+			return nil, i, fmt.Errorf("yaml line %d: duplicate key %q", lines[i].n, key)
+		}
+		var v interface{}
+		var err error
+		if value == "" {
+			v, i, err = yamlValue(lines, i, indent)
+		} else {
+			v, err = yamlScalar(value)
+			i++
+		}
+		if err != nil {
+			return nil, i, err
+		}
+		m[key] = v
+	}
+	return m, i, nil
+}
+
+// yamlValue decodes the block that follows lines[i], whose own value
+// is empty. A sequence may be indented to the same depth as its key.
+func yamlValue(lines []yamlLine, i, indent int) (interface{}, int, error) {
+	i++
+	if i == len(lines) {
+		return nil, i, nil
+	}
+	l := lines[i]
+	if _, ok := yamlItem(l.text); l.indent > indent || (ok && l.indent == indent && !strings.HasPrefix(lines[i-1].text, "-")) {
+		return yamlBlock(lines, i, l.indent)
+	}
+	return nil, i, nil
+}
+
+// yamlSplit splits the entries of a flow sequence at the commas
+// that are not quoted.
+func yamlSplit(s string) []string {
+	var parts []string
+	quote := byte(0)
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// yamlScalar decodes a scalar, or a flow sequence of scalars.
+func yamlScalar(s string) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(s, "\""):
+		return strconv.Unquote(s)
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return nil, fmt.Errorf("yaml: unterminated string %s", s)
+		}
+		return strings.Replace(s[1:len(s)-1], "''", "'", -1), nil
+	case strings.HasPrefix(s, "["):
+		if !strings.HasSuffix(s, "]") {
+			return nil, fmt.Errorf("yaml: unterminated sequence %s", s)
+		}
+		seq := []interface{}{}
+		inner := strings.TrimSpace(s[1 : len(s)-1])
+		if inner == "" {
+			return seq, nil
+		}
+		for _, e := range yamlSplit(inner) {
+			v, err := yamlScalar(strings.TrimSpace(e))
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+		}
+		return seq, nil
+	case s == "{}":
+		return map[string]interface{}{}, nil
+	case strings.HasPrefix(s, "{"), strings.HasPrefix(s, "&"), strings.HasPrefix(s, "*"), strings.HasPrefix(s, "!"), s == "|", s == ">":
+		return nil, fmt.Errorf("yaml: unsupported value %s", s)
+	}
+	switch s {
+	case "~", "null", "Null", "NULL":
+		return nil, nil
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+		return f, nil
+	}
+	return s, nil
+}
@@ -0,0 +1,78 @@
+package tplinky
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestYAMLToJSON(t *testing.T) {
+	tests := []struct {
+		yaml, json string
+	}{
+		{"a: 1\nb: two\nc: true\nd: ~\n", `{"a":1,"b":"two","c":true,"d":null}`},
+		{"a:\n  b:\n    c: 'it''s'\n  d: [1, x]\n", `{"a":{"b":{"c":"it's"},"d":[1,"x"]}}`},
+		{"- 1\n- - 2\n  - 3\n-\n  x: \"#y\" # comment\n", `[1,[2,3],{"x":"#y"}]`},
+		{"list:\n- a: 1\n  b:\n  - 2\nnext: 07:00\n", `{"list":[{"a":1,"b":[2]}],"next":"07:00"}`},
+		{"---\nurl: http://host/a#b\n", `{"url":"http://host/a#b"}`},
+		{"", `null`},
+		{"# only a comment\n\n", `null`},
+
+		// Quoting.
+		{`a: "1"` + "\nb: '2'\n", `{"a":"1","b":"2"}`},
+		{`a: "tab\there \"q\""` + "\n", `{"a":"tab\there \"q\""}`},
+		{`a: 'no \t escape'` + "\n", `{"a":"no \\t escape"}`},
+		{`"quoted: key": x` + "\n'single key': y\n", `{"quoted: key":"x","single key":"y"}`},
+		{`a: "true"` + "\nb: 'null'\nc: \"\"\n", `{"a":"true","b":"null","c":""}`},
+		{"a: [\"x, y\", 'z', w]\n", `{"a":["x, y","z","w"]}`},
+
+		// Comments.
+		{"a: 1 # one\n# b: 2\n  # indented\nc: 3\n", `{"a":1,"c":3}`},
+		{"a: x#y\nb: 'x # y'\nc: \"x # y\" # z\n", `{"a":"x#y","b":"x # y","c":"x # y"}`},
+		{"a: # the block follows\n  b: 1\n", `{"a":{"b":1}}`},
+
+		// Nesting.
+		{"a:\n  - b:\n      c: 1\n    d: 2\n  - 3\ne: 4\n", `{"a":[{"b":{"c":1},"d":2},3],"e":4}`},
+		{"a:\nb: 1\n", `{"a":null,"b":1}`},
+		{"a: {}\nb: []\n", `{"a":{},"b":[]}`},
+		{"  a: 1\n  b: 2\n", `{"a":1,"b":2}`},
+	}
+	for _, tc := range tests {
+		data, err := yamlToJSON([]byte(tc.yaml))
+		if err != nil {
+			t.Errorf("yamlToJSON(%q) failed: %v", tc.yaml, err)
+			continue
+		}
+		var got, want interface{}
+		json.Unmarshal(data, &got)
+		if err := json.Unmarshal([]byte(tc.json), &want); err != nil {
+			t.Fatalf("bad test JSON %s: %v", tc.json, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("yamlToJSON(%q) = %s, want %s", tc.yaml, data, tc.json)
+		}
+	}
+	for _, bad := range []string{
+		"a: 1\n  b: 2\n",
+		"a: 1\na: 2\n",
+		"a: &x 1\n",
+		"a: *x\n",
+		"a: !tag 1\n",
+		"just text\n",
+		"a: |\n  text\n",
+		"a: {b: 1}\n",
+		"a: [1, 2\n",
+		"a: \"open\n",
+		"a: 'open\n",
+		"a: \"x\" y\n",
+		"a:\n\tb: 1\n",
+		"a:\n    b: 1\n  c: 2\n",
+		"- 1\nb: 2\n",
+		"a: 1\n- 2\n",
+		"a:\n  - 1\n  b: 2\n",
+	} {
+		if data, err := yamlToJSON([]byte(bad)); err == nil {
+			t.Errorf("yamlToJSON(%q) = %s, want an error", bad, data)
+		}
+	}
+}